@@ -0,0 +1,81 @@
+// Command purge removes the events older than -days from the outbox
+// collection once the relay has published them, archiving them to
+// compressed JSON lines files first when -archive-dir is set. It is
+// configured like the api, by a PURGE_CONFIG_FILE, the COUCHBASE_* envs of
+// the relay and flags.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/relay"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/retention"
+)
+
+func main() {
+	cfg, err := config.LoadPurge(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// a long purge picks up the rotated secret files on its new connections.
+	credentials := cfg.Couchbase.RotatingCredentials()
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go credentials.Watch(ctx)
+
+	cluster, err := credentials.Connect()
+	if err != nil {
+		log.Fatalf("could not connect to couchbase: %s", err)
+	}
+	defer cluster.Close(nil)
+
+	scope := cluster.Bucket(cfg.Couchbase.Bucket).Scope(cfg.Couchbase.Scope)
+	outboxCollection := scope.Collection(cfg.Couchbase.OutboxCollection)
+
+	opts := retention.PurgeOptions{
+		Collection:  outboxCollection,
+		Format:      cfg.Format,
+		Before:      time.Now().AddDate(0, 0, -cfg.Days),
+		BatchSize:   cfg.BatchSize,
+		Unpublished: !cfg.RequirePublished,
+		DryRun:      cfg.DryRun,
+	}
+
+	// without a checkpoint collection only the events marked by the polling
+	// relay count as published.
+	if cfg.CheckpointCollection != "" {
+		opts.Checkpoints = relay.NewCouchbaseCheckpointStore(scope.Collection(cfg.CheckpointCollection), cfg.RelayName)
+	}
+
+	if cfg.ArchiveDir != "" {
+		archive, err := retention.NewArchive(cfg.ArchiveDir, outboxCollection.Name())
+		if err != nil {
+			log.Fatalf("could not create the archive: %s", err)
+		}
+		opts.Archive = archive
+		log.Printf("archiving purged events to %s", archive.Path())
+	}
+
+	result, err := retention.Purge(opts)
+	if opts.Archive != nil {
+		if err := opts.Archive.Close(); err != nil {
+			log.Printf("could not close archive %s: %s", opts.Archive.Path(), err)
+		}
+	}
+	log.Printf("purged %d events older than %d days, kept %d unpublished and %d changed", result.Removed, cfg.Days, result.Unpublished, result.Changed)
+	if err != nil {
+		log.Printf("could not purge the outbox: %s", err)
+		os.Exit(1)
+	}
+}
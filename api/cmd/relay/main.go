@@ -0,0 +1,168 @@
+// Command relay publishes the outbox collection to Kafka over DCP, it takes
+// the place of the Kafka Connect couchbase connector. It is configured like
+// the api, by a RELAY_CONFIG_FILE, the COUCHBASE_* envs plus
+// COUCHBASE_CHECKPOINT_COLLECTION, KAFKA_BROKERS and KAFKA_TOPIC, and flags.
+// With RELAY_MODE=poll it polls the outbox with N1QL instead, for users
+// without DCP access. With COUCHBASE_DLQ_COLLECTION it dead letters what it
+// cannot publish and serves the dead letters on RELAY_ADMIN_PORT, on localhost
+// unless RELAY_ADMIN_TOKEN guards them.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/relay"
+)
+
+func main() {
+	cfg, err := config.LoadRelay(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the connections ask for the credentials on every new socket, so they
+	// pick up the rotated secret files without reconnecting.
+	credentials := cfg.Couchbase.RotatingCredentials()
+	go credentials.Watch(ctx)
+
+	cluster, err := credentials.Connect()
+	if err != nil {
+		log.Fatalf("could not connect to couchbase: %s", err)
+	}
+	defer cluster.Close(nil)
+
+	scope := cluster.Bucket(cfg.Couchbase.Bucket).Scope(cfg.Couchbase.Scope)
+	outboxCollection := scope.Collection(cfg.Couchbase.OutboxCollection)
+
+	envelope, err := outbox.NewEnvelope(cfg.Format, "")
+	if err != nil {
+		log.Fatalf("could not create the envelope: %s", err)
+	}
+
+	// the relay checkpoints what the producer accepted, it never runs without a broker.
+	producer := relay.NewKafkaProducer(cfg.Kafka.Brokers, cfg.Kafka.Topic)
+	defer producer.Close()
+
+	// without a dead letter collection the relay retries publishing forever.
+	var deadLetters relay.DeadLetterStore
+	if cfg.DeadLetterCollection != "" {
+		deadLetters, err = relay.NewCouchbaseDeadLetterStore(scope.Collection(cfg.DeadLetterCollection))
+		if err != nil {
+			log.Fatalf("could not open the dead letters: %s", err)
+		}
+	}
+
+	var outboxRelay interface {
+		Run(ctx context.Context) error
+		relay.Requeuer
+	}
+	switch cfg.Mode {
+	case config.RelayModeDCP:
+		checkpointCollection := scope.Collection(cfg.CheckpointCollection)
+
+		instanceID := cfg.InstanceID
+		if instanceID == "" {
+			hostname, _ := os.Hostname()
+			instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+
+		security, err := credentials.DCPSecurityConfig()
+		if err != nil {
+			log.Fatalf("could not configure the DCP security: %s", err)
+		}
+
+		opts := relay.DCPRelayOptions{
+			Name:        cfg.Name,
+			ConnStr:     cfg.Couchbase.Host,
+			Security:    security,
+			Collection:  outboxCollection,
+			Checkpoints: relay.NewCouchbaseCheckpointStore(checkpointCollection, cfg.Name),
+			Producer:    producer,
+			Envelope:    envelope,
+			DeadLetters: deadLetters,
+			MaxAttempts: cfg.MaxAttempts,
+			Workers:     cfg.Workers,
+			BatchSize:   cfg.BatchSize,
+			Membership: relay.NewMembership(checkpointCollection, relay.MembershipOptions{
+				Group:             cfg.Name,
+				InstanceID:        instanceID,
+				HeartbeatInterval: time.Duration(cfg.HeartbeatInterval),
+				LeaseTimeout:      time.Duration(cfg.LeaseTimeout),
+			}),
+		}
+		if cfg.Reorder {
+			opts.Reorder = &relay.ReorderOptions{GapTimeout: time.Duration(cfg.GapTimeout)}
+			opts.Sequences = relay.NewCouchbaseCheckpointStore(checkpointCollection, cfg.Name)
+		}
+		outboxRelay, err = relay.NewDCPRelay(opts)
+	case config.RelayModePoll:
+		outboxRelay, err = relay.NewPollRelay(relay.PollRelayOptions{
+			Name:         cfg.Name,
+			Collection:   outboxCollection,
+			Producer:     producer,
+			Envelope:     envelope,
+			Format:       cfg.Format,
+			BatchSize:    cfg.BatchSize,
+			MaxInFlight:  cfg.MaxInFlight,
+			PollInterval: time.Duration(cfg.PollInterval),
+			ClaimTimeout: time.Duration(cfg.ClaimTimeout),
+			DeadLetters:  deadLetters,
+			MaxAttempts:  cfg.MaxAttempts,
+			Delete:       cfg.DeletePublished,
+		})
+	}
+	if err != nil {
+		log.Fatalf("could not create the relay: %s", err)
+	}
+
+	if cfg.Admin.Port != 0 && deadLetters != nil {
+		go serveAdmin(cfg.Admin, relay.NewDeadLetterHandler(deadLetters, outboxRelay))
+	}
+
+	log.Printf("relay %s is relaying %s.%s in %s mode", cfg.Name, outboxCollection.ScopeName(), outboxCollection.Name(), cfg.Mode)
+	if err = outboxRelay.Run(ctx); err != nil {
+		log.Fatalf("relay %s stopped: %s", cfg.Name, err)
+	}
+}
+
+// serveAdmin serves the dead letter endpoints, behind the token when there is
+// one and over https when a certificate is configured.
+func serveAdmin(cfg config.RelayAdmin, handler http.Handler) {
+	if cfg.Token != "" {
+		handler = relay.RequireToken(cfg.Token, handler)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dlq", handler)
+	mux.Handle("/dlq/", handler)
+
+	server := &http.Server{
+		Addr:    net.JoinHostPort(cfg.Address, strconv.Itoa(cfg.Port)),
+		Handler: mux,
+	}
+	var err error
+	if cfg.TLS.Enabled() {
+		err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	log.Printf("could not serve the admin endpoints: %s", err)
+}
@@ -0,0 +1,86 @@
+// Command verify reads outbox events as published to Kafka, one record value
+// per line on stdin, and reports gaps and reorderings of their sequence
+// numbers. It exits with status 1 when it found any.
+//
+//	kafka-console-consumer --bootstrap-server localhost:9092 --topic demo-topic \
+//	  --from-beginning --timeout-ms 10000 | go run ./cmd/verify
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+const maxRecordSize = 16 << 20
+
+func main() {
+	format := flag.String("format", outbox.FormatCloudEvents, "envelope format of the events, cloudevents or debezium")
+	fromStart := flag.Bool("from-start", false, "expect every aggregate to start at sequence 1")
+	duplicates := flag.Bool("duplicates", false, "report duplicate events, expected with the aggregate outbox mode")
+	flag.Parse()
+
+	envelope, err := outbox.NewEnvelope(*format, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	failed, err := verify(os.Stdin, os.Stdout, os.Stderr, envelope, *fromStart, *duplicates)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verify prints the findings for the records read from in to out, and the
+// records that cannot be decoded to errOut. It reports whether any of them
+// fails the verification, duplicates do not. The error is the one of reading in.
+func verify(in io.Reader, out io.Writer, errOut io.Writer, envelope outbox.Envelope, fromStart bool, duplicates bool) (bool, error) {
+	verifier := outbox.NewVerifier(fromStart)
+	failed := false
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		events, err := outbox.DecodeRecord(envelope, scanner.Bytes())
+		if err != nil {
+			fmt.Fprintf(errOut, "line %d: %s\n", line, err)
+			failed = true
+			continue
+		}
+
+		for _, event := range events {
+			for _, finding := range verifier.Observe(event) {
+				if finding.Kind == outbox.FindingDuplicate && !duplicates {
+					continue
+				}
+				if finding.Kind != outbox.FindingDuplicate {
+					failed = true
+				}
+				fmt.Fprintln(out, finding)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return failed, err
+	}
+
+	for _, gap := range verifier.Gaps() {
+		failed = true
+		fmt.Fprintln(out, gap)
+	}
+
+	return failed, nil
+}
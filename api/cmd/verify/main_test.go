@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+func records(t *testing.T, envelope outbox.Envelope, sequences ...int64) string {
+	t.Helper()
+
+	var lines []string
+	for _, sequence := range sequences {
+		wrapped, err := envelope.Wrap(outbox.Event{ID: "event", AggregateType: "item", AggregateID: "a", Type: outbox.EventTypeUpdated, Sequence: sequence, GlobalSequence: uint64(sequence)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := json.Marshal(wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(value))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestVerify(t *testing.T) {
+	envelope, _ := outbox.NewEnvelope(outbox.FormatCloudEvents, "")
+
+	tests := []struct {
+		name       string
+		input      string
+		duplicates bool
+		failed     bool
+		out        []string
+		errOut     string
+	}{
+		{
+			name:  "in order",
+			input: records(t, envelope, 1, 2, 3),
+		},
+		{
+			name:   "gap",
+			input:  records(t, envelope, 1, 3),
+			failed: true,
+			out:    []string{"GAP item/a sequence 2"},
+		},
+		{
+			name:   "reordered",
+			input:  records(t, envelope, 1, 3, 2),
+			failed: true,
+			out:    []string{"REORDERED item/a sequence 2", "GLOBAL_REORDERED item/a sequence 2"},
+		},
+		{
+			name:  "duplicates are not reported by default",
+			input: records(t, envelope, 1, 2, 2),
+		},
+		{
+			name:       "duplicates are reported but do not fail",
+			input:      records(t, envelope, 1, 2, 2),
+			duplicates: true,
+			out:        []string{"DUPLICATE item/a sequence 2"},
+		},
+		{
+			name:   "undecodable record",
+			input:  records(t, envelope, 1) + "not json\n\n" + records(t, envelope, 2),
+			failed: true,
+			errOut: "line 2: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out, errOut bytes.Buffer
+			failed, err := verify(strings.NewReader(test.input), &out, &errOut, envelope, false, test.duplicates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed != test.failed {
+				t.Fatalf("failed is %t, expected %t", failed, test.failed)
+			}
+
+			var lines []string
+			if out.Len() > 0 {
+				lines = strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			}
+			if len(lines) != len(test.out) {
+				t.Fatalf("printed %q, expected %q", lines, test.out)
+			}
+			for i, line := range lines {
+				if !strings.HasPrefix(line, test.out[i]) {
+					t.Fatalf("printed %q, expected %q", line, test.out[i])
+				}
+			}
+
+			if !strings.HasPrefix(errOut.String(), test.errOut) || (test.errOut == "") != (errOut.Len() == 0) {
+				t.Fatalf("printed %q to stderr, expected %q", errOut.String(), test.errOut)
+			}
+		})
+	}
+}
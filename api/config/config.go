@@ -0,0 +1,275 @@
+// Package config loads the configuration of the api. The values are taken
+// from the defaults, a YAML or JSON file, the envs and the flags, each layer
+// overriding the one before.
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+	"github.com/couchbase/gocb/v2"
+)
+
+const (
+	StoreCouchbase = "couchbase"
+	StoreMemory    = "memory"
+)
+
+const redacted = "REDACTED"
+
+// Config is the effective configuration of the api. The yaml and json tags
+// name the keys of the file, env the env and the flag is the dotted path of
+// the keys. Fields tagged secret are redacted.
+type Config struct {
+	Store  string `yaml:"store" json:"store" env:"API_STORE" usage:"where the items and the outbox are kept, couchbase or memory"`
+	Events string `yaml:"events" json:"events" env:"API_EVENTS" usage:"with the memory store, the JSONL file the published events are appended to, - for stdout"`
+
+	HTTP      HTTP      `yaml:"http" json:"http"`
+	Couchbase Couchbase `yaml:"couchbase" json:"couchbase"`
+	Outbox    Outbox    `yaml:"outbox" json:"outbox"`
+}
+
+type HTTP struct {
+	Port         int      `yaml:"port" json:"port" env:"API_PORT" usage:"port of the api"`
+	AdminPort    int      `yaml:"adminPort" json:"adminPort" env:"API_ADMIN_PORT" usage:"port of the admin endpoints, 0 disables them"`
+	ReadTimeout  Duration `yaml:"readTimeout" json:"readTimeout" env:"API_READ_TIMEOUT" usage:"maximum duration for reading a request, 0 for none"`
+	WriteTimeout Duration `yaml:"writeTimeout" json:"writeTimeout" env:"API_WRITE_TIMEOUT" usage:"maximum duration for writing a response, 0 for none"`
+	IdleTimeout  Duration `yaml:"idleTimeout" json:"idleTimeout" env:"API_IDLE_TIMEOUT" usage:"how long idle keep-alive connections are kept open, 0 for the read timeout"`
+
+	TLS HTTPTLS `yaml:"tls" json:"tls"`
+}
+
+type Couchbase struct {
+	Host                  string   `yaml:"host" json:"host" env:"COUCHBASE_HOST" usage:"connection string of the cluster"`
+	Username              string   `yaml:"username" json:"username" env:"COUCHBASE_USERNAME"`
+	Password              string   `yaml:"password" json:"password" env:"COUCHBASE_PASSWORD" secret:"true"`
+	UsernameFile          string   `yaml:"usernameFile" json:"usernameFile" env:"COUCHBASE_USERNAME_FILE" usage:"file the username is read from instead, watched for rotation"`
+	PasswordFile          string   `yaml:"passwordFile" json:"passwordFile" env:"COUCHBASE_PASSWORD_FILE" usage:"file the password is read from instead, watched for rotation"`
+	SecretsPollInterval   Duration `yaml:"secretsPollInterval" json:"secretsPollInterval" env:"COUCHBASE_SECRETS_POLL_INTERVAL" usage:"how often the secret files are checked for new credentials"`
+	Bucket                string   `yaml:"bucket" json:"bucket" env:"COUCHBASE_BUCKET"`
+	Scope                 string   `yaml:"scope" json:"scope" env:"COUCHBASE_SCOPE"`
+	Collection            string   `yaml:"collection" json:"collection" env:"COUCHBASE_COLLECTION" usage:"collection of the items"`
+	OutboxCollection      string   `yaml:"outboxCollection" json:"outboxCollection" env:"COUCHBASE_OUTBOX_COLLECTION"`
+	IdempotencyCollection string   `yaml:"idempotencyCollection" json:"idempotencyCollection" env:"COUCHBASE_IDEMPOTENCY_COLLECTION"`
+	CounterCollection     string   `yaml:"counterCollection" json:"counterCollection" env:"COUCHBASE_COUNTER_COLLECTION"`
+	Durability            string   `yaml:"durability" json:"durability" env:"COUCHBASE_DURABILITY" usage:"durability of the transactions, none, majority, majorityAndPersistOnMaster or persistToMajority"`
+
+	TLS      CouchbaseTLS `yaml:"tls" json:"tls"`
+	Timeouts Timeouts     `yaml:"timeouts" json:"timeouts"`
+	Pool     Pool         `yaml:"pool" json:"pool"`
+}
+
+// Timeouts of the Couchbase operations, zero leaves the gocb default.
+type Timeouts struct {
+	Connect     Duration `yaml:"connect" json:"connect" env:"COUCHBASE_CONNECT_TIMEOUT"`
+	KV          Duration `yaml:"kv" json:"kv" env:"COUCHBASE_KV_TIMEOUT"`
+	KVDurable   Duration `yaml:"kvDurable" json:"kvDurable" env:"COUCHBASE_KV_DURABLE_TIMEOUT"`
+	Query       Duration `yaml:"query" json:"query" env:"COUCHBASE_QUERY_TIMEOUT"`
+	Management  Duration `yaml:"management" json:"management" env:"COUCHBASE_MANAGEMENT_TIMEOUT"`
+	Transaction Duration `yaml:"transaction" json:"transaction" env:"COUCHBASE_TRANSACTION_TIMEOUT"`
+}
+
+// Pool sizes the connections to the cluster, zero leaves the gocb default.
+type Pool struct {
+	KVConnections             int      `yaml:"kvConnections" json:"kvConnections" env:"COUCHBASE_KV_POOL_SIZE" usage:"number of connections to each data node"`
+	KVQueueSize               int      `yaml:"kvQueueSize" json:"kvQueueSize" env:"COUCHBASE_KV_QUEUE_SIZE" usage:"number of requests queued on each connection"`
+	MaxIdleHTTPConnections    int      `yaml:"maxIdleHttpConnections" json:"maxIdleHttpConnections" env:"COUCHBASE_MAX_IDLE_HTTP_CONNECTIONS" usage:"idle connections kept to the query and management services"`
+	MaxIdleHTTPConnsPerHost   int      `yaml:"maxIdleHttpConnectionsPerHost" json:"maxIdleHttpConnectionsPerHost" env:"COUCHBASE_MAX_IDLE_HTTP_CONNECTIONS_PER_HOST"`
+	IdleHTTPConnectionTimeout Duration `yaml:"idleHttpConnectionTimeout" json:"idleHttpConnectionTimeout" env:"COUCHBASE_IDLE_HTTP_CONNECTION_TIMEOUT"`
+}
+
+type Outbox struct {
+	Format             string   `yaml:"format" json:"format" env:"OUTBOX_EVENT_FORMAT" usage:"envelope format of the events, cloudevents or debezium"`
+	Source             string   `yaml:"source" json:"source" env:"OUTBOX_EVENT_SOURCE" usage:"source of the events"`
+	Mode               string   `yaml:"mode" json:"mode" env:"OUTBOX_MODE" usage:"outbox mode, event or aggregate"`
+	AggregateMaxEvents int      `yaml:"aggregateMaxEvents" json:"aggregateMaxEvents" env:"OUTBOX_AGGREGATE_MAX_EVENTS" usage:"events kept in an outbox document in the aggregate mode"`
+	ItemExcludedFields []string `yaml:"itemExcludedFields" json:"itemExcludedFields" env:"OUTBOX_ITEM_EXCLUDED_FIELDS" usage:"comma separated item fields left out of the events"`
+}
+
+// Default returns the configuration the other layers are applied on.
+func Default() Config {
+	return Config{
+		Store:  StoreCouchbase,
+		Events: "-",
+		HTTP: HTTP{
+			Port: 8080,
+		},
+		Couchbase: Couchbase{
+			Durability:          "none",
+			SecretsPollInterval: Duration(10 * time.Second),
+		},
+		Outbox: Outbox{
+			Format:             outbox.FormatCloudEvents,
+			Source:             "/kafka-couchbase-connector-poc/api",
+			Mode:               repository.OutboxModeEvent,
+			AggregateMaxEvents: 100,
+		},
+	}
+}
+
+var durabilityLevels = map[string]gocb.DurabilityLevel{
+	"none":                       gocb.DurabilityLevelNone,
+	"majority":                   gocb.DurabilityLevelMajority,
+	"majorityAndPersistOnMaster": gocb.DurabilityLevelMajorityAndPersistOnMaster,
+	"persistToMajority":          gocb.DurabilityLevelPersistToMajority,
+}
+
+// DurabilityLevel is the gocb level of the durability, the configuration must
+// be valid.
+func (c Couchbase) DurabilityLevel() gocb.DurabilityLevel {
+	return durabilityLevels[c.Durability]
+}
+
+// Duration is a time.Duration written like 1m30s in the file, the envs and
+// the flags.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Error lists every problem found in the configuration.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate returns an *Error listing all invalid values, nil when there are
+// none.
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Store {
+	case StoreCouchbase:
+		required := map[string]string{
+			"couchbase.host":                  c.Couchbase.Host,
+			"couchbase.bucket":                c.Couchbase.Bucket,
+			"couchbase.scope":                 c.Couchbase.Scope,
+			"couchbase.collection":            c.Couchbase.Collection,
+			"couchbase.outboxCollection":      c.Couchbase.OutboxCollection,
+			"couchbase.idempotencyCollection": c.Couchbase.IdempotencyCollection,
+			"couchbase.counterCollection":     c.Couchbase.CounterCollection,
+		}
+		for _, key := range sortedKeys(required) {
+			if required[key] == "" {
+				invalid("%s is required, set it with %s", key, describe(&c, key))
+			}
+		}
+
+		c.Couchbase.validateCredentials(invalid)
+	case StoreMemory:
+	default:
+		invalid("store must be %s or %s", StoreCouchbase, StoreMemory)
+	}
+
+	c.validateTLS(invalid)
+
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		invalid("http.port must be between 1 and 65535")
+	}
+	if c.HTTP.AdminPort < 0 || c.HTTP.AdminPort > 65535 {
+		invalid("http.adminPort must be between 0 and 65535")
+	}
+	if c.HTTP.AdminPort != 0 && c.HTTP.AdminPort == c.HTTP.Port {
+		invalid("http.adminPort must differ from http.port")
+	}
+
+	if _, found := durabilityLevels[c.Couchbase.Durability]; !found {
+		invalid("couchbase.durability must be one of %s", strings.Join(sortedKeys(durabilityLevels), ", "))
+	}
+
+	durations := map[string]Duration{
+		"http.readTimeout":                         c.HTTP.ReadTimeout,
+		"http.writeTimeout":                        c.HTTP.WriteTimeout,
+		"http.idleTimeout":                         c.HTTP.IdleTimeout,
+		"couchbase.timeouts.connect":               c.Couchbase.Timeouts.Connect,
+		"couchbase.timeouts.kv":                    c.Couchbase.Timeouts.KV,
+		"couchbase.timeouts.kvDurable":             c.Couchbase.Timeouts.KVDurable,
+		"couchbase.timeouts.query":                 c.Couchbase.Timeouts.Query,
+		"couchbase.timeouts.management":            c.Couchbase.Timeouts.Management,
+		"couchbase.timeouts.transaction":           c.Couchbase.Timeouts.Transaction,
+		"couchbase.pool.idleHttpConnectionTimeout": c.Couchbase.Pool.IdleHTTPConnectionTimeout,
+	}
+	if c.Couchbase.SecretsPollInterval <= 0 {
+		invalid("couchbase.secretsPollInterval must be positive")
+	}
+	for _, key := range sortedKeys(durations) {
+		if durations[key] < 0 {
+			invalid("%s must not be negative", key)
+		}
+	}
+
+	sizes := map[string]int{
+		"couchbase.pool.kvConnections":                 c.Couchbase.Pool.KVConnections,
+		"couchbase.pool.kvQueueSize":                   c.Couchbase.Pool.KVQueueSize,
+		"couchbase.pool.maxIdleHttpConnections":        c.Couchbase.Pool.MaxIdleHTTPConnections,
+		"couchbase.pool.maxIdleHttpConnectionsPerHost": c.Couchbase.Pool.MaxIdleHTTPConnsPerHost,
+	}
+	for _, key := range sortedKeys(sizes) {
+		if sizes[key] < 0 {
+			invalid("%s must not be negative", key)
+		}
+	}
+
+	if c.Outbox.Format != outbox.FormatCloudEvents && c.Outbox.Format != outbox.FormatDebezium {
+		invalid("outbox.format must be %s or %s", outbox.FormatCloudEvents, outbox.FormatDebezium)
+	}
+	if c.Outbox.Mode != repository.OutboxModeEvent && c.Outbox.Mode != repository.OutboxModeAggregate {
+		invalid("outbox.mode must be %s or %s", repository.OutboxModeEvent, repository.OutboxModeAggregate)
+	}
+	if c.Outbox.AggregateMaxEvents < 1 {
+		invalid("outbox.aggregateMaxEvents must be a positive number")
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// validateCredentials adds the problems of the username and the password,
+// which are left out with certificate authentication.
+func (c Couchbase) validateCredentials(invalid func(format string, args ...interface{})) {
+	credential := func(key string, value string, file string) {
+		switch {
+		case c.CertificateAuth() && (value != "" || file != ""):
+			invalid("%s must not be set with couchbase.tls.certFile", key)
+		case c.CertificateAuth():
+		case value == "" && file == "":
+			invalid("%s is required, set it with %s or %s", key, describe(&Config{}, key), describe(&Config{}, key+"File"))
+		case value != "" && file != "":
+			invalid("%s and %sFile must not both be set", key, key)
+		}
+	}
+	credential("couchbase.username", c.Username, c.UsernameFile)
+	credential("couchbase.password", c.Password, c.PasswordFile)
+}
+
+// Redacted returns a copy of the configuration safe to show, with the set
+// secrets replaced.
+func (c Config) Redacted() Config {
+	for _, s := range settings(&c) {
+		if s.secret && s.value.String() != "" {
+			s.value.SetString(redacted)
+		}
+	}
+	return c
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/couchbase/gocbcore/v10"
+)
+
+// CouchbaseEnv reads the couchbase settings of the api from their envs alone,
+// for the tests that are configured by envs. The credentials are read
+// from their files when those are set, along with the certificates, so
+// missing or broken files are reported right away.
+func CouchbaseEnv() (Couchbase, error) {
+	cfg := Config{Store: StoreCouchbase, Couchbase: Default().Couchbase}
+
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, s := range settings(&cfg) {
+		raw, set := os.LookupEnv(s.env)
+		if s.env == "" || !set || !strings.HasPrefix(s.key, "couchbase.") {
+			continue
+		}
+		if err := s.set(raw); err != nil {
+			invalid("%s env %s", s.env, err)
+		}
+	}
+
+	if cfg.Couchbase.Host == "" {
+		invalid("COUCHBASE_HOST env is required")
+	}
+	cfg.Couchbase.validateCredentials(invalid)
+	cfg.Couchbase.validateTLS(invalid)
+	if len(problems) > 0 {
+		return cfg.Couchbase, &Error{Problems: problems}
+	}
+
+	if problems = cfg.Couchbase.readCredentials(); len(problems) > 0 {
+		return cfg.Couchbase, &Error{Problems: problems}
+	}
+	if problems = cfg.Couchbase.loadTLS(); len(problems) > 0 {
+		return cfg.Couchbase, &Error{Problems: problems}
+	}
+	return cfg.Couchbase, nil
+}
+
+// ConnectionString adds the pool settings gocb only takes as options of the
+// connection string to the host.
+func (c Couchbase) ConnectionString() string {
+	options := url.Values{}
+	setOption := func(name string, value string, set bool) {
+		if set {
+			options.Set(name, value)
+		}
+	}
+	setOption("kv_pool_size", strconv.Itoa(c.Pool.KVConnections), c.Pool.KVConnections > 0)
+	setOption("max_queue_size", strconv.Itoa(c.Pool.KVQueueSize), c.Pool.KVQueueSize > 0)
+	setOption("max_idle_http_connections", strconv.Itoa(c.Pool.MaxIdleHTTPConnections), c.Pool.MaxIdleHTTPConnections > 0)
+	setOption("max_perhost_idle_http_connections", strconv.Itoa(c.Pool.MaxIdleHTTPConnsPerHost), c.Pool.MaxIdleHTTPConnsPerHost > 0)
+	setOption("idle_http_connection_timeout", time.Duration(c.Pool.IdleHTTPConnectionTimeout).String(), c.Pool.IdleHTTPConnectionTimeout > 0)
+
+	if len(options) == 0 {
+		return c.Host
+	}
+	if strings.Contains(c.Host, "?") {
+		return c.Host + "&" + options.Encode()
+	}
+	return c.Host + "?" + options.Encode()
+}
+
+// ClusterOptions returns the options gocb connects to the cluster with, the
+// credentials are left out with certificate authentication.
+func (c Couchbase) ClusterOptions(username string, password string) (gocb.ClusterOptions, error) {
+	authenticator, err := c.Authenticator(username, password)
+	if err != nil {
+		return gocb.ClusterOptions{}, err
+	}
+	return c.clusterOptions(authenticator)
+}
+
+func (c Couchbase) clusterOptions(authenticator gocb.Authenticator) (gocb.ClusterOptions, error) {
+	security, err := c.SecurityConfig()
+	if err != nil {
+		return gocb.ClusterOptions{}, err
+	}
+
+	return gocb.ClusterOptions{
+		Authenticator:  authenticator,
+		SecurityConfig: security,
+		TimeoutsConfig: gocb.TimeoutsConfig{
+			ConnectTimeout:    time.Duration(c.Timeouts.Connect),
+			KVTimeout:         time.Duration(c.Timeouts.KV),
+			KVDurableTimeout:  time.Duration(c.Timeouts.KVDurable),
+			QueryTimeout:      time.Duration(c.Timeouts.Query),
+			ManagementTimeout: time.Duration(c.Timeouts.Management),
+		},
+		TransactionsConfig: gocb.TransactionsConfig{
+			DurabilityLevel: c.DurabilityLevel(),
+			Timeout:         time.Duration(c.Timeouts.Transaction),
+		},
+	}, nil
+}
+
+// Connect connects to the cluster with the credentials.
+func (c Couchbase) Connect(username string, password string) (*gocb.Cluster, error) {
+	options, err := c.ClusterOptions(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return gocb.Connect(c.ConnectionString(), options)
+}
+
+// dcpSecurityConfig returns the TLS settings and the authentication of a
+// gocbcore DCP agent, the counterpart of ClusterOptions for the relay.
+func (c Couchbase) dcpSecurityConfig(username string, password string) (gocbcore.SecurityConfig, error) {
+	security, err := c.SecurityConfig()
+	if err != nil {
+		return gocbcore.SecurityConfig{}, err
+	}
+
+	config := gocbcore.SecurityConfig{
+		UseTLS: c.Secure(),
+		Auth:   gocbcore.PasswordAuthProvider{Username: username, Password: password},
+	}
+	if config.UseTLS {
+		// gocbcore skips the verification when the provider returns nil.
+		config.TLSRootCAProvider = func() *x509.CertPool {
+			if security.TLSSkipVerify {
+				return nil
+			}
+			return security.TLSRootCAs
+		}
+	}
+
+	if c.CertificateAuth() {
+		certificate, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return gocbcore.SecurityConfig{}, err
+		}
+		config.Auth = certificateAuthProvider{certificate: &certificate}
+	}
+
+	return config, nil
+}
+
+// certificateAuthProvider authenticates a gocbcore agent with a client
+// certificate, like gocb.CertificateAuthenticator does for gocb.
+type certificateAuthProvider struct {
+	certificate *tls.Certificate
+}
+
+func (p certificateAuthProvider) SupportsTLS() bool {
+	return true
+}
+
+func (p certificateAuthProvider) SupportsNonTLS() bool {
+	return false
+}
+
+func (p certificateAuthProvider) Certificate(gocbcore.AuthCertRequest) (*tls.Certificate, error) {
+	return p.certificate, nil
+}
+
+func (p certificateAuthProvider) Credentials(gocbcore.AuthCredsRequest) ([]gocbcore.UserPassPair, error) {
+	return []gocbcore.UserPassPair{{}}, nil
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gocbcore/v10"
+)
+
+func TestCouchbaseEnv(t *testing.T) {
+	isolateEnv(t)
+	t.Setenv("COUCHBASE_HOST", "couchbases://localhost")
+	t.Setenv("COUCHBASE_USERNAME", "admin")
+	t.Setenv("COUCHBASE_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+	t.Setenv("COUCHBASE_TLS_SKIP_VERIFY", "true")
+	t.Setenv("COUCHBASE_KV_POOL_SIZE", "2")
+	t.Setenv("API_PORT", "eighty")
+
+	cb, err := CouchbaseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb.Username != "admin" || cb.Password != "s3cret" {
+		t.Fatalf("credentials are %q and %q, expected admin and the content of the file", cb.Username, cb.Password)
+	}
+	if connStr := cb.ConnectionString(); connStr != "couchbases://localhost?kv_pool_size=2" {
+		t.Fatalf("connection string is %s", connStr)
+	}
+
+	security, err := cb.RotatingCredentials().DCPSecurityConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !security.UseTLS || security.TLSRootCAProvider == nil || security.TLSRootCAProvider() != nil {
+		t.Fatal("the DCP connection does not skip the verification over TLS")
+	}
+	if creds, err := security.Auth.Credentials(gocbcore.AuthCredsRequest{}); err != nil || creds[0].Password != "s3cret" {
+		t.Fatalf("the DCP connection authenticates with %v, %v", creds, err)
+	}
+}
+
+func TestCouchbaseEnvVerifiesAgainstTheSystemRoots(t *testing.T) {
+	isolateEnv(t)
+	t.Setenv("COUCHBASE_HOST", "couchbases://localhost")
+	t.Setenv("COUCHBASE_USERNAME", "admin")
+	t.Setenv("COUCHBASE_PASSWORD", "s3cret")
+
+	cb, err := CouchbaseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := cb.ClusterOptions(cb.Username, cb.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.SecurityConfig.TLSSkipVerify || options.SecurityConfig.TLSRootCAs == nil {
+		t.Fatal("the cluster certificate is not verified against the system roots")
+	}
+
+	security, err := cb.RotatingCredentials().DCPSecurityConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if security.TLSRootCAProvider() == nil {
+		t.Fatal("the DCP connection skips the verification")
+	}
+}
+
+func TestCouchbaseEnvReportsEveryProblem(t *testing.T) {
+	isolateEnv(t)
+	t.Setenv("COUCHBASE_HOST", "couchbase://localhost")
+	t.Setenv("COUCHBASE_CA_FILE", "ca.pem")
+	t.Setenv("COUCHBASE_KV_TIMEOUT", "soon")
+
+	_, err := CouchbaseEnv()
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("reading returned %v, expected an *Error", err)
+	}
+
+	for _, expected := range []string{
+		"COUCHBASE_KV_TIMEOUT env",
+		"couchbase.username is required",
+		"couchbase.password is required",
+		"couchbase.tls needs a couchbases:// couchbase.host",
+	} {
+		found := false
+		for _, problem := range invalid.Problems {
+			found = found || strings.Contains(problem, expected)
+		}
+		if !found {
+			t.Errorf("no problem mentions %q in %q", expected, invalid.Problems)
+		}
+	}
+}
+
+func TestRotatingCredentialsFollowTheSecretFiles(t *testing.T) {
+	isolateEnv(t)
+	password := writeFile(t, "password", "s3cret\n")
+	t.Setenv("COUCHBASE_HOST", "couchbase://localhost")
+	t.Setenv("COUCHBASE_USERNAME", "admin")
+	t.Setenv("COUCHBASE_PASSWORD_FILE", password)
+	t.Setenv("COUCHBASE_SECRETS_POLL_INTERVAL", "10ms")
+
+	cb, err := CouchbaseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := cb.RotatingCredentials()
+	security, err := credentials.DCPSecurityConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go credentials.Watch(ctx)
+
+	if err = os.WriteFile(password, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		creds, err := security.Auth.Credentials(gocbcore.AuthCredsRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds[0].Username == "admin" && creds[0].Password == "rotated" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the DCP connection still authenticates with %v", creds)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
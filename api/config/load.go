@@ -0,0 +1,257 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the configuration file when the -config flag is not given.
+const FileEnv = "API_CONFIG_FILE"
+
+// setting is a leaf field of a configuration, addressed by the dotted path of
+// its keys. The flag is named after the key unless a flag tag names it.
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+// settings walks the leaf fields of the configuration target points at.
+func settings(target interface{}) []setting {
+	var found []setting
+
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			key := prefix + field.Tag.Get("yaml")
+
+			if _, text := v.Field(i).Addr().Interface().(encoding.TextUnmarshaler); !text && field.Type.Kind() == reflect.Struct {
+				walk(key+".", v.Field(i))
+				continue
+			}
+
+			name := field.Tag.Get("flag")
+			if name == "" {
+				name = key
+			}
+			found = append(found, setting{
+				key:    key,
+				env:    field.Tag.Get("env"),
+				flag:   name,
+				usage:  field.Tag.Get("usage"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk("", reflect.ValueOf(target).Elem())
+
+	return found
+}
+
+// set parses raw into the setting, lists are comma separated.
+func (s setting) set(raw string) error {
+	if text, ok := s.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return text.UnmarshalText([]byte(raw))
+	}
+
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(raw)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		s.value.SetInt(int64(parsed))
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		s.value.SetBool(parsed)
+	case reflect.Slice:
+		var list []string
+		for _, element := range strings.Split(raw, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
+		s.value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+	return nil
+}
+
+// Load builds the configuration from the defaults, the file given with
+// -config or FileEnv, the envs and the args, in that order, and reads the
+// credentials and certificates from their files. It returns an *Error listing every invalid
+// value, or flag.ErrHelp when help was asked for.
+func Load(name string, args []string) (Config, error) {
+	cfg := Default()
+	problems, err := load(name, args, FileEnv, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, err.(*Error).Problems...)
+	} else if cfg.Store == StoreCouchbase {
+		problems = append(problems, cfg.Couchbase.readCredentials()...)
+	}
+	if len(problems) == 0 {
+		problems = cfg.loadTLS()
+	}
+	if len(problems) > 0 {
+		return cfg, &Error{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// load applies the file given with -config or fileEnv, the envs and the args
+// over the configuration target points at, and returns the values it could
+// not apply. It only fails when the args cannot be parsed.
+func load(name string, args []string, fileEnv string, target interface{}) ([]string, error) {
+	all := settings(target)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := flags.String("config", "", "YAML or JSON configuration file, defaults to the "+fileEnv+" env")
+	flagged := map[string]*flagValue{}
+	for _, s := range all {
+		usage := s.usage
+		if s.env != "" {
+			usage = strings.TrimPrefix(usage+", env "+s.env, ", ")
+		}
+		flagged[s.key] = &flagValue{boolean: s.value.Kind() == reflect.Bool}
+		flags.Var(flagged[s.key], s.flag, usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+
+	path := *file
+	if path == "" {
+		path = os.Getenv(fileEnv)
+	}
+	if path != "" {
+		if err := loadFile(path, target); err != nil {
+			problems = append(problems, fmt.Sprintf("could not read config file %s: %s", path, err))
+		}
+	}
+
+	for _, s := range all {
+		raw, set := os.LookupEnv(s.env)
+		if s.env == "" || !set {
+			continue
+		}
+		if err := s.set(raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s env %s", s.env, err))
+		}
+	}
+
+	setFlags := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	for _, s := range all {
+		if !setFlags[s.flag] {
+			continue
+		}
+		if err := s.set(flagged[s.key].raw); err != nil {
+			problems = append(problems, fmt.Sprintf("-%s flag %s", s.flag, err))
+		}
+	}
+
+	return problems, nil
+}
+
+// flagValue keeps the raw value of a flag until the file and the envs are
+// applied. Bool flags may be given without a value, like those of the flag
+// package.
+type flagValue struct {
+	raw     string
+	boolean bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *flagValue) Set(raw string) error {
+	f.raw = raw
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// loadFile applies the file over the configuration target points at. Files
+// ending in .json are read as JSON, all others as YAML, and unknown keys are
+// rejected by both.
+func loadFile(path string, target interface{}) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(target)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(target); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// describe names where the setting with the key of the configuration target
+// points at can be set.
+func describe(target interface{}, key string) string {
+	for _, s := range settings(target) {
+		if s.key != key {
+			continue
+		}
+		if s.env != "" {
+			return s.env + " or -" + s.flag
+		}
+		return "-" + s.flag
+	}
+	return "-" + key
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
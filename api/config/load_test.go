@@ -0,0 +1,305 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateEnv unsets every env the configuration is read from for the test.
+func isolateEnv(t *testing.T) {
+	t.Helper()
+
+	names := []string{FileEnv, RelayFileEnv, PurgeFileEnv}
+	for _, target := range []interface{}{&Config{}, &Relay{}, &Purge{}} {
+		for _, s := range settings(target) {
+			if s.env != "" {
+				names = append(names, s.env)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if value, set := os.LookupEnv(name); set {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, value) })
+		}
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setCouchbaseEnvs sets the settings the couchbase store requires.
+func setCouchbaseEnvs(t *testing.T) {
+	t.Helper()
+
+	for name, value := range map[string]string{
+		"COUCHBASE_HOST":                   "couchbase://localhost",
+		"COUCHBASE_USERNAME":               "admin",
+		"COUCHBASE_BUCKET":                 "demo",
+		"COUCHBASE_SCOPE":                  "demo",
+		"COUCHBASE_COLLECTION":             "item",
+		"COUCHBASE_OUTBOX_COLLECTION":      "item_outbox_event",
+		"COUCHBASE_IDEMPOTENCY_COLLECTION": "idempotency_key",
+		"COUCHBASE_COUNTER_COLLECTION":     "counter",
+	} {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadAppliesFileEnvsAndFlagsInOrder(t *testing.T) {
+	isolateEnv(t)
+
+	file := writeFile(t, "api.yaml", `
+store: memory
+http:
+  port: 8081
+  adminPort: 9000
+outbox:
+  mode: aggregate
+  format: cloudevents
+`)
+	t.Setenv(FileEnv, file)
+	t.Setenv("API_PORT", "8082")
+	t.Setenv("OUTBOX_EVENT_FORMAT", "debezium")
+	t.Setenv("API_READ_TIMEOUT", "5s")
+	t.Setenv("OUTBOX_ITEM_EXCLUDED_FIELDS", "description, price,,")
+
+	cfg, err := Load("api", []string{"-http.port", "8083"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Default()
+	expected.Store = StoreMemory
+	expected.HTTP.Port = 8083
+	expected.HTTP.AdminPort = 9000
+	expected.HTTP.ReadTimeout = Duration(5 * time.Second)
+	expected.Outbox.Mode = "aggregate"
+	expected.Outbox.Format = "debezium"
+	expected.Outbox.ItemExcludedFields = []string{"description", "price"}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("loaded %+v, expected %+v", cfg, expected)
+	}
+}
+
+func TestLoadPrefersTheConfigFlagOverTheFileEnv(t *testing.T) {
+	isolateEnv(t)
+
+	t.Setenv(FileEnv, writeFile(t, "env.yaml", "store: memory\nhttp:\n  port: 8081\n"))
+	flagged := writeFile(t, "flag.json", `{"store": "memory", "http": {"port": 8084}}`)
+
+	cfg, err := Load("api", []string{"-config", flagged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTP.Port != 8084 {
+		t.Fatalf("port is %d, expected the 8084 of the -config file", cfg.HTTP.Port)
+	}
+}
+
+func TestLoadRejectsUnknownFileKeys(t *testing.T) {
+	for name, content := range map[string]string{
+		"api.yaml": "store: memory\nhttp:\n  prot: 8081\n",
+		"api.json": `{"store": "memory", "htp": {}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			isolateEnv(t)
+
+			_, err := Load("api", []string{"-config", writeFile(t, name, content)})
+			var invalid *Error
+			if !errors.As(err, &invalid) || !strings.Contains(err.Error(), "could not read config file") {
+				t.Fatalf("loading returned %v, expected the file to be rejected", err)
+			}
+		})
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	isolateEnv(t)
+
+	t.Setenv("API_PORT", "eighty")
+	t.Setenv("API_ADMIN_PORT", "8080")
+	t.Setenv("COUCHBASE_DURABILITY", "sometimes")
+	t.Setenv("OUTBOX_MODE", "batch")
+
+	_, err := Load("api", []string{"-couchbase.timeouts.kv", "soon"})
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("loading returned %v, expected an *Error", err)
+	}
+
+	for _, expected := range []string{
+		"API_PORT env must be a number",
+		"-couchbase.timeouts.kv flag",
+		"couchbase.host is required, set it with COUCHBASE_HOST or -couchbase.host",
+		"couchbase.password is required",
+		"http.adminPort must differ from http.port",
+		"couchbase.durability must be one of",
+		"outbox.mode must be event or aggregate",
+	} {
+		found := false
+		for _, problem := range invalid.Problems {
+			found = found || strings.Contains(problem, expected)
+		}
+		if !found {
+			t.Errorf("no problem mentions %q in %q", expected, invalid.Problems)
+		}
+	}
+}
+
+func TestLoadReadsCredentialsFromFiles(t *testing.T) {
+	isolateEnv(t)
+	setCouchbaseEnvs(t)
+	t.Setenv("COUCHBASE_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+
+	cfg, err := Load("api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Couchbase.Username != "admin" || cfg.Couchbase.Password != "s3cret" {
+		t.Fatalf("credentials are %q and %q, expected admin and the content of the file", cfg.Couchbase.Username, cfg.Couchbase.Password)
+	}
+
+	shown := cfg.Redacted()
+	if shown.Couchbase.Password != redacted || cfg.Couchbase.Password != "s3cret" {
+		t.Fatalf("redacted password is %q and the original %q", shown.Couchbase.Password, cfg.Couchbase.Password)
+	}
+
+	t.Setenv("COUCHBASE_PASSWORD", "inline")
+	if _, err = Load("api", nil); err == nil || !strings.Contains(err.Error(), "couchbase.password and couchbase.passwordFile must not both be set") {
+		t.Fatalf("loading returned %v, expected the password to be set twice", err)
+	}
+}
+
+func TestLoadRelayReportsEveryProblem(t *testing.T) {
+	isolateEnv(t)
+
+	t.Setenv("RELAY_WORKERS", "-1")
+
+	_, err := LoadRelay("relay", []string{"-mode", "stream"})
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("loading returned %v, expected an *Error", err)
+	}
+
+	for _, expected := range []string{
+		"couchbase.host is required, set it with COUCHBASE_HOST or -couchbase.host",
+		"couchbase.outboxCollection is required",
+		"couchbase.password is required",
+		"kafka.brokers is required, set it with KAFKA_BROKERS or -kafka.brokers",
+		"kafka.topic is required",
+		"mode must be dcp or poll",
+		"workers must not be negative",
+	} {
+		found := false
+		for _, problem := range invalid.Problems {
+			found = found || strings.Contains(problem, expected)
+		}
+		if !found {
+			t.Errorf("no problem mentions %q in %q", expected, invalid.Problems)
+		}
+	}
+}
+
+func TestLoadRelayRequiresCheckpointsInTheDCPMode(t *testing.T) {
+	isolateEnv(t)
+	setCouchbaseEnvs(t)
+	t.Setenv("COUCHBASE_PASSWORD", "password")
+	t.Setenv("KAFKA_BROKERS", "kafka-1:9092, kafka-2:9092")
+	t.Setenv("KAFKA_TOPIC", "item-outbox")
+
+	if _, err := LoadRelay("relay", nil); err == nil || !strings.Contains(err.Error(), "checkpointCollection is required, set it with COUCHBASE_CHECKPOINT_COLLECTION") {
+		t.Fatalf("loading returned %v, expected the checkpoint collection to be required", err)
+	}
+
+	cfg, err := LoadRelay("relay", []string{"-mode", "poll", "-deletePublished", "-pollInterval", "2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != RelayModePoll || !cfg.DeletePublished || cfg.PollInterval != Duration(2*time.Second) || cfg.Name != "item-outbox-relay" {
+		t.Fatalf("loaded %+v, expected the poll mode deleting the published documents every 2s", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Kafka.Brokers, []string{"kafka-1:9092", "kafka-2:9092"}) {
+		t.Fatalf("brokers are %q", cfg.Kafka.Brokers)
+	}
+}
+
+func TestLoadRelayGuardsTheAdminEndpointsBeyondLocalhost(t *testing.T) {
+	isolateEnv(t)
+	setCouchbaseEnvs(t)
+	t.Setenv("COUCHBASE_PASSWORD", "password")
+	t.Setenv("KAFKA_BROKERS", "kafka:9092")
+	t.Setenv("KAFKA_TOPIC", "item-outbox")
+	t.Setenv("RELAY_MODE", "poll")
+	t.Setenv("RELAY_ADMIN_PORT", "8081")
+
+	cfg, err := LoadRelay("relay", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Admin.Address != "127.0.0.1" || !cfg.Admin.Loopback() || cfg.Admin.Token != "" {
+		t.Fatalf("admin is %+v, expected localhost without a token", cfg.Admin)
+	}
+
+	t.Setenv("RELAY_ADMIN_ADDRESS", "0.0.0.0")
+	if _, err = LoadRelay("relay", nil); err == nil || !strings.Contains(err.Error(), "admin.token is required when admin.address is not a loopback address") {
+		t.Fatalf("loading returned %v, expected the token to be required", err)
+	}
+
+	t.Setenv("RELAY_ADMIN_TOKEN_FILE", writeFile(t, "token", "s3cret\n"))
+	if cfg, err = LoadRelay("relay", nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Admin.Token != "s3cret" {
+		t.Fatalf("token is %q, expected the content of the file", cfg.Admin.Token)
+	}
+
+	t.Setenv("RELAY_ADMIN_TOKEN", "other")
+	t.Setenv("RELAY_ADMIN_TLS_CERT_FILE", "admin.pem")
+	_, err = LoadRelay("relay", nil)
+	for _, expected := range []string{"admin.token and admin.tokenFile must not both be set", "admin.tls.certFile and admin.tls.keyFile must be set together"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("loading returned %v, expected %q", err, expected)
+		}
+	}
+}
+
+func TestLoadPurgeKeepsTheFlagsOfTheCommand(t *testing.T) {
+	isolateEnv(t)
+	setCouchbaseEnvs(t)
+	t.Setenv("COUCHBASE_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+
+	cfg, err := LoadPurge("purge", []string{"-days", "30", "-archive-dir", "./archive", "-dry-run", "-require-published=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DefaultPurge()
+	expected.Days = 30
+	expected.ArchiveDir = "./archive"
+	expected.DryRun = true
+	expected.RequirePublished = false
+	if cfg.Days != expected.Days || cfg.ArchiveDir != expected.ArchiveDir || cfg.DryRun != expected.DryRun || cfg.RequirePublished != expected.RequirePublished || cfg.RelayName != expected.RelayName {
+		t.Fatalf("loaded %+v, expected %+v", cfg, expected)
+	}
+	if cfg.Couchbase.Password != "s3cret" {
+		t.Fatalf("password is %q, expected the content of the file", cfg.Couchbase.Password)
+	}
+
+	if _, err = LoadPurge("purge", []string{"-days", "0"}); err == nil || !strings.Contains(err.Error(), "-days must be a positive number") {
+		t.Fatalf("loading returned %v, expected -days to be rejected", err)
+	}
+}
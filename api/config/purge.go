@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+// PurgeFileEnv names the configuration file of the purge when the -config
+// flag is not given.
+const PurgeFileEnv = "PURGE_CONFIG_FILE"
+
+// Purge is the effective configuration of the purge command, read like the
+// one of the api. Its own settings keep the flag names of the command.
+type Purge struct {
+	Days                 int    `yaml:"days" json:"days" usage:"purge the events older than this many days"`
+	ArchiveDir           string `yaml:"archiveDir" json:"archiveDir" flag:"archive-dir" usage:"archive the purged events to this directory first"`
+	BatchSize            int    `yaml:"batchSize" json:"batchSize" flag:"batch-size" usage:"number of documents purged at a time"`
+	DryRun               bool   `yaml:"dryRun" json:"dryRun" flag:"dry-run" usage:"archive and count the events without removing them"`
+	RequirePublished     bool   `yaml:"requirePublished" json:"requirePublished" flag:"require-published" usage:"only purge the events the relay has published"`
+	RelayName            string `yaml:"relayName" json:"relayName" flag:"relay-name" usage:"name of the DCP relay whose checkpoints confirm publishing"`
+	Format               string `yaml:"format" json:"format" usage:"envelope format of the outbox events"`
+	CheckpointCollection string `yaml:"checkpointCollection" json:"checkpointCollection" env:"COUCHBASE_CHECKPOINT_COLLECTION" usage:"collection of the relay checkpoints, without it only the events marked by the poll mode count as published"`
+
+	Couchbase Couchbase `yaml:"couchbase" json:"couchbase"`
+}
+
+// DefaultPurge returns the purge configuration the other layers are applied
+// on.
+func DefaultPurge() Purge {
+	return Purge{
+		Days:             7,
+		RequirePublished: true,
+		RelayName:        "item-outbox-relay",
+		Format:           outbox.FormatCloudEvents,
+		Couchbase:        Default().Couchbase,
+	}
+}
+
+// LoadPurge builds the purge configuration from the defaults, the file given
+// with -config or PurgeFileEnv, the envs and the args, like Load.
+func LoadPurge(name string, args []string) (Purge, error) {
+	cfg := DefaultPurge()
+	problems, err := load(name, args, PurgeFileEnv, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, err.(*Error).Problems...)
+	} else {
+		problems = append(problems, cfg.Couchbase.readCredentials()...)
+	}
+	if len(problems) == 0 {
+		problems = cfg.Couchbase.loadTLS()
+	}
+	if len(problems) > 0 {
+		return cfg, &Error{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Validate returns an *Error listing all invalid values, nil when there are
+// none.
+func (c Purge) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	c.Couchbase.validateOutbox(invalid)
+
+	if c.Days < 1 {
+		invalid("-days must be a positive number")
+	}
+	if c.BatchSize < 0 {
+		invalid("-batch-size must not be negative")
+	}
+	if c.RelayName == "" {
+		invalid("-relay-name is required")
+	}
+	if c.Format != outbox.FormatCloudEvents && c.Format != outbox.FormatDebezium {
+		invalid("-format must be %s or %s", outbox.FormatCloudEvents, outbox.FormatDebezium)
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
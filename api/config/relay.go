@@ -0,0 +1,246 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+// RelayFileEnv names the configuration file of the relay when the -config
+// flag is not given.
+const RelayFileEnv = "RELAY_CONFIG_FILE"
+
+const (
+	RelayModeDCP  = "dcp"
+	RelayModePoll = "poll"
+)
+
+// Relay is the effective configuration of the relay command, read like the
+// one of the api. Zero counts and durations leave the relay defaults.
+type Relay struct {
+	Name                 string   `yaml:"name" json:"name" env:"RELAY_NAME" usage:"name of the relay, its checkpoints and its group"`
+	Mode                 string   `yaml:"mode" json:"mode" env:"RELAY_MODE" usage:"how the outbox is read, dcp or poll"`
+	InstanceID           string   `yaml:"instanceId" json:"instanceId" env:"RELAY_INSTANCE_ID" usage:"id of the instance in its group, defaults to the hostname and the pid"`
+	Format               string   `yaml:"format" json:"format" env:"OUTBOX_EVENT_FORMAT" usage:"envelope format of the outbox events, cloudevents or debezium"`
+	CheckpointCollection string   `yaml:"checkpointCollection" json:"checkpointCollection" env:"COUCHBASE_CHECKPOINT_COLLECTION" usage:"collection of the checkpoints, required in the dcp mode"`
+	DeadLetterCollection string   `yaml:"deadLetterCollection" json:"deadLetterCollection" env:"COUCHBASE_DLQ_COLLECTION" usage:"collection of the dead letters, without it publishing is retried forever"`
+	MaxAttempts          int      `yaml:"maxAttempts" json:"maxAttempts" env:"RELAY_MAX_ATTEMPTS" usage:"attempts before a rejected document is dead lettered"`
+	Workers              int      `yaml:"workers" json:"workers" env:"RELAY_WORKERS" usage:"number of processing and publishing lanes in the dcp mode"`
+	BatchSize            int      `yaml:"batchSize" json:"batchSize" env:"RELAY_BATCH_SIZE" usage:"documents published at a time"`
+	MaxInFlight          int      `yaml:"maxInFlight" json:"maxInFlight" env:"RELAY_MAX_IN_FLIGHT" usage:"batches published at the same time in the poll mode"`
+	HeartbeatInterval    Duration `yaml:"heartbeatInterval" json:"heartbeatInterval" env:"RELAY_HEARTBEAT_INTERVAL" usage:"how often the instance renews its membership"`
+	LeaseTimeout         Duration `yaml:"leaseTimeout" json:"leaseTimeout" env:"RELAY_LEASE_TIMEOUT" usage:"how long a membership lasts without a heartbeat"`
+	Reorder              bool     `yaml:"reorder" json:"reorder" env:"RELAY_REORDER" usage:"publish the events of an aggregate in sequence order in the dcp mode"`
+	GapTimeout           Duration `yaml:"gapTimeout" json:"gapTimeout" env:"RELAY_GAP_TIMEOUT" usage:"how long the reordering waits for a missing sequence"`
+	PollInterval         Duration `yaml:"pollInterval" json:"pollInterval" env:"RELAY_POLL_INTERVAL" usage:"how often the outbox is polled"`
+	ClaimTimeout         Duration `yaml:"claimTimeout" json:"claimTimeout" env:"RELAY_CLAIM_TIMEOUT" usage:"how long a polled document stays claimed"`
+	DeletePublished      bool     `yaml:"deletePublished" json:"deletePublished" env:"RELAY_DELETE_PUBLISHED" usage:"remove the published documents instead of marking them in the poll mode"`
+
+	Admin     RelayAdmin `yaml:"admin" json:"admin"`
+	Kafka     Kafka      `yaml:"kafka" json:"kafka"`
+	Couchbase Couchbase  `yaml:"couchbase" json:"couchbase"`
+}
+
+// RelayAdmin configures the dead letter endpoints. They listen on localhost
+// unless a token guards them.
+type RelayAdmin struct {
+	Port      int    `yaml:"port" json:"port" env:"RELAY_ADMIN_PORT" usage:"port of the dead letter endpoints, 0 disables them"`
+	Address   string `yaml:"address" json:"address" env:"RELAY_ADMIN_ADDRESS" usage:"address the dead letter endpoints listen on, any but a loopback address needs a token"`
+	Token     string `yaml:"token" json:"token" env:"RELAY_ADMIN_TOKEN" secret:"true" usage:"bearer token the dead letter endpoints require"`
+	TokenFile string `yaml:"tokenFile" json:"tokenFile" env:"RELAY_ADMIN_TOKEN_FILE" usage:"file the token is read from instead"`
+
+	TLS RelayAdminTLS `yaml:"tls" json:"tls"`
+}
+
+type RelayAdminTLS struct {
+	CertFile string `yaml:"certFile" json:"certFile" env:"RELAY_ADMIN_TLS_CERT_FILE" usage:"PEM certificate to serve the dead letter endpoints over https with"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile" env:"RELAY_ADMIN_TLS_KEY_FILE" usage:"PEM key of the certificate"`
+}
+
+// Enabled tells whether the dead letter endpoints are served over https.
+func (t RelayAdminTLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Loopback tells whether the endpoints are reachable from this host only.
+func (a RelayAdmin) Loopback() bool {
+	if a.Address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(a.Address)
+	return ip != nil && ip.IsLoopback()
+}
+
+type Kafka struct {
+	Brokers []string `yaml:"brokers" json:"brokers" env:"KAFKA_BROKERS" usage:"comma separated addresses of the brokers"`
+	Topic   string   `yaml:"topic" json:"topic" env:"KAFKA_TOPIC" usage:"topic the outbox is published to"`
+}
+
+// DefaultRelay returns the relay configuration the other layers are applied
+// on.
+func DefaultRelay() Relay {
+	return Relay{
+		Name:      "item-outbox-relay",
+		Mode:      RelayModeDCP,
+		Format:    outbox.FormatCloudEvents,
+		Admin:     RelayAdmin{Address: "127.0.0.1"},
+		Couchbase: Default().Couchbase,
+	}
+}
+
+// LoadRelay builds the relay configuration from the defaults, the file given
+// with -config or RelayFileEnv, the envs and the args, like Load.
+func LoadRelay(name string, args []string) (Relay, error) {
+	cfg := DefaultRelay()
+	problems, err := load(name, args, RelayFileEnv, &cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, err.(*Error).Problems...)
+	} else {
+		problems = append(problems, cfg.Couchbase.readCredentials()...)
+		problems = append(problems, cfg.Admin.readToken()...)
+	}
+	if len(problems) == 0 {
+		problems = append(cfg.Couchbase.loadTLS(), cfg.Admin.loadTLS()...)
+	}
+	if len(problems) > 0 {
+		return cfg, &Error{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Validate returns an *Error listing all invalid values, nil when there are
+// none.
+func (c Relay) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	c.Couchbase.validateOutbox(invalid)
+
+	required := map[string]string{
+		"kafka.topic": c.Kafka.Topic,
+	}
+	if len(c.Kafka.Brokers) == 0 {
+		required["kafka.brokers"] = ""
+	}
+	switch c.Mode {
+	case RelayModeDCP:
+		required["checkpointCollection"] = c.CheckpointCollection
+	case RelayModePoll:
+	default:
+		invalid("mode must be %s or %s", RelayModeDCP, RelayModePoll)
+	}
+	for _, key := range sortedKeys(required) {
+		if required[key] == "" {
+			invalid("%s is required, set it with %s", key, describe(&c, key))
+		}
+	}
+
+	if c.Format != outbox.FormatCloudEvents && c.Format != outbox.FormatDebezium {
+		invalid("format must be %s or %s", outbox.FormatCloudEvents, outbox.FormatDebezium)
+	}
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		invalid("admin.port must be between 0 and 65535")
+	}
+	c.Admin.validate(invalid)
+
+	counts := map[string]int{
+		"maxAttempts": c.MaxAttempts,
+		"workers":     c.Workers,
+		"batchSize":   c.BatchSize,
+		"maxInFlight": c.MaxInFlight,
+	}
+	for _, key := range sortedKeys(counts) {
+		if counts[key] < 0 {
+			invalid("%s must not be negative", key)
+		}
+	}
+
+	durations := map[string]Duration{
+		"heartbeatInterval": c.HeartbeatInterval,
+		"leaseTimeout":      c.LeaseTimeout,
+		"gapTimeout":        c.GapTimeout,
+		"pollInterval":      c.PollInterval,
+		"claimTimeout":      c.ClaimTimeout,
+	}
+	for _, key := range sortedKeys(durations) {
+		if durations[key] < 0 {
+			invalid("%s must not be negative", key)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// validate adds the problems of the admin settings. Beyond localhost the dead
+// letters can be read and requeued by anyone reaching the port without a
+// token.
+func (a RelayAdmin) validate(invalid func(format string, args ...interface{})) {
+	if a.Token != "" && a.TokenFile != "" {
+		invalid("admin.token and admin.tokenFile must not both be set")
+	}
+	if a.Port != 0 && !a.Loopback() && a.Token == "" && a.TokenFile == "" {
+		invalid("admin.token is required when admin.address is not a loopback address, set it with %s or %s",
+			describe(&Relay{}, "admin.token"), describe(&Relay{}, "admin.tokenFile"))
+	}
+	if (a.TLS.CertFile == "") != (a.TLS.KeyFile == "") {
+		invalid("admin.tls.certFile and admin.tls.keyFile must be set together")
+	}
+}
+
+// readToken replaces the token with the one read from its file.
+func (a *RelayAdmin) readToken() []string {
+	if a.TokenFile == "" {
+		return nil
+	}
+	token, err := ReadSecretFile(a.TokenFile)
+	if err != nil {
+		return []string{fmt.Sprintf("could not read the admin token: %s", err)}
+	}
+	a.Token = token
+	return nil
+}
+
+// loadTLS reads the certificate of the admin endpoints.
+func (a RelayAdmin) loadTLS() []string {
+	if !a.TLS.Enabled() {
+		return nil
+	}
+	if _, err := tls.LoadX509KeyPair(a.TLS.CertFile, a.TLS.KeyFile); err != nil {
+		return []string{fmt.Sprintf("could not load the admin certificate: %s", err)}
+	}
+	return nil
+}
+
+// validateOutbox adds the problems of the settings the commands reading the
+// outbox need to reach it.
+func (c Couchbase) validateOutbox(invalid func(format string, args ...interface{})) {
+	required := map[string]string{
+		"couchbase.host":             c.Host,
+		"couchbase.bucket":           c.Bucket,
+		"couchbase.scope":            c.Scope,
+		"couchbase.outboxCollection": c.OutboxCollection,
+	}
+	for _, key := range sortedKeys(required) {
+		if required[key] == "" {
+			invalid("%s is required, set it with %s", key, describe(&Config{}, key))
+		}
+	}
+
+	c.validateCredentials(invalid)
+	c.validateTLS(invalid)
+
+	if c.SecretsPollInterval <= 0 {
+		invalid("couchbase.secretsPollInterval must be positive")
+	}
+}
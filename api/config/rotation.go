@@ -0,0 +1,140 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/couchbase/gocbcore/v10"
+)
+
+// RotatingCredentials hands out the latest credentials of the secret files.
+// The connections authenticated with it ask for them on every new socket and
+// http request, so they pick up a rotation without reconnecting.
+type RotatingCredentials struct {
+	cfg Couchbase
+
+	mu       sync.RWMutex
+	username string
+	password string
+}
+
+// RotatingCredentials starts with the credentials read by Load or
+// CouchbaseEnv.
+func (c Couchbase) RotatingCredentials() *RotatingCredentials {
+	return &RotatingCredentials{cfg: c, username: c.Username, password: c.Password}
+}
+
+// Credentials returns the latest username and password.
+func (r *RotatingCredentials) Credentials() (string, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.username, r.password
+}
+
+// Watch polls the secret files until ctx is done. A file that cannot be read
+// keeps the current credentials until the next poll.
+func (r *RotatingCredentials) Watch(ctx context.Context) {
+	if !r.cfg.HasSecretFiles() || r.cfg.CertificateAuth() {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(r.cfg.SecretsPollInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		username, password, err := r.cfg.Credentials()
+		if err != nil {
+			log.Printf("could not read the couchbase credentials: %s", err)
+			continue
+		}
+
+		r.mu.Lock()
+		changed := username != r.username || password != r.password
+		r.username, r.password = username, password
+		r.mu.Unlock()
+
+		if changed {
+			log.Printf("rotated the couchbase credentials of user %s", username)
+		}
+	}
+}
+
+// Connect connects to the cluster with the latest credentials.
+func (r *RotatingCredentials) Connect() (*gocb.Cluster, error) {
+	if r.cfg.CertificateAuth() {
+		return r.cfg.Connect("", "")
+	}
+
+	options, err := r.cfg.clusterOptions(rotatingAuthenticator{credentials: r})
+	if err != nil {
+		return nil, err
+	}
+	return gocb.Connect(r.cfg.ConnectionString(), options)
+}
+
+// DCPSecurityConfig returns the TLS settings of a gocbcore DCP agent that
+// authenticates with the latest credentials.
+func (r *RotatingCredentials) DCPSecurityConfig() (gocbcore.SecurityConfig, error) {
+	security, err := r.cfg.dcpSecurityConfig("", "")
+	if err != nil {
+		return gocbcore.SecurityConfig{}, err
+	}
+
+	if !r.cfg.CertificateAuth() {
+		security.Auth = rotatingAuthProvider{credentials: r}
+	}
+	return security, nil
+}
+
+type rotatingAuthenticator struct {
+	credentials *RotatingCredentials
+}
+
+func (a rotatingAuthenticator) SupportsTLS() bool {
+	return true
+}
+
+func (a rotatingAuthenticator) SupportsNonTLS() bool {
+	return true
+}
+
+func (a rotatingAuthenticator) Certificate(gocb.AuthCertRequest) (*tls.Certificate, error) {
+	return nil, nil
+}
+
+func (a rotatingAuthenticator) Credentials(gocb.AuthCredsRequest) ([]gocb.UserPassPair, error) {
+	username, password := a.credentials.Credentials()
+	return []gocb.UserPassPair{{Username: username, Password: password}}, nil
+}
+
+type rotatingAuthProvider struct {
+	credentials *RotatingCredentials
+}
+
+func (p rotatingAuthProvider) SupportsTLS() bool {
+	return true
+}
+
+func (p rotatingAuthProvider) SupportsNonTLS() bool {
+	return true
+}
+
+func (p rotatingAuthProvider) Certificate(gocbcore.AuthCertRequest) (*tls.Certificate, error) {
+	return nil, nil
+}
+
+func (p rotatingAuthProvider) Credentials(gocbcore.AuthCredsRequest) ([]gocbcore.UserPassPair, error) {
+	username, password := p.credentials.Credentials()
+	return []gocbcore.UserPassPair{{Username: username, Password: password}}, nil
+}
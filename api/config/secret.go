@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadSecretFile returns the content of a mounted secret file without the
+// trailing newline editors and orchestrators tend to leave behind.
+func ReadSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimRight(string(content), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// HasSecretFiles tells whether any credential is read from a file, which is
+// what makes them rotatable.
+func (c Couchbase) HasSecretFiles() bool {
+	return c.UsernameFile != "" || c.PasswordFile != ""
+}
+
+// Credentials returns the username and the password, read from their files
+// when those are configured.
+func (c Couchbase) Credentials() (string, string, error) {
+	username, password := c.Username, c.Password
+
+	var err error
+	if c.UsernameFile != "" {
+		if username, err = ReadSecretFile(c.UsernameFile); err != nil {
+			return "", "", err
+		}
+	}
+	if c.PasswordFile != "" {
+		if password, err = ReadSecretFile(c.PasswordFile); err != nil {
+			return "", "", err
+		}
+	}
+
+	return username, password, nil
+}
+
+// readCredentials replaces the credentials with the ones read from their
+// files, so missing or empty files are reported along with the other
+// problems.
+func (c *Couchbase) readCredentials() []string {
+	username, password, err := c.Credentials()
+	if err != nil {
+		return []string{fmt.Sprintf("could not read the couchbase credentials: %s", err)}
+	}
+	c.Username, c.Password = username, password
+	return nil
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+const secureScheme = "couchbases://"
+
+type CouchbaseTLS struct {
+	CAFile     string `yaml:"caFile" json:"caFile" env:"COUCHBASE_CA_FILE" usage:"PEM bundle of the CAs the cluster certificate is verified against, defaults to the system roots"`
+	SkipVerify bool   `yaml:"skipVerify" json:"skipVerify" env:"COUCHBASE_TLS_SKIP_VERIFY" usage:"accept any cluster certificate, for development only"`
+	CertFile   string `yaml:"certFile" json:"certFile" env:"COUCHBASE_CERT_FILE" usage:"PEM client certificate to authenticate with instead of a username and password"`
+	KeyFile    string `yaml:"keyFile" json:"keyFile" env:"COUCHBASE_KEY_FILE" usage:"PEM key of the client certificate"`
+}
+
+type HTTPTLS struct {
+	CertFile string `yaml:"certFile" json:"certFile" env:"API_TLS_CERT_FILE" usage:"PEM certificate to serve the api over https with"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile" env:"API_TLS_KEY_FILE" usage:"PEM key of the certificate"`
+}
+
+// Enabled tells whether the api is served over https.
+func (t HTTPTLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Secure tells whether the connection string asks for TLS.
+func (c Couchbase) Secure() bool {
+	return strings.HasPrefix(c.Host, secureScheme)
+}
+
+// CertificateAuth tells whether the cluster is authenticated with a client
+// certificate rather than a username and password.
+func (c Couchbase) CertificateAuth() bool {
+	return c.TLS.CertFile != ""
+}
+
+// SecurityConfig returns the TLS settings of the cluster connection.
+func (c Couchbase) SecurityConfig() (gocb.SecurityConfig, error) {
+	security := gocb.SecurityConfig{TLSSkipVerify: c.TLS.SkipVerify}
+	if c.TLS.CAFile == "" {
+		// gocb verifies against an empty pool rather than the system roots
+		// when none are given.
+		if !security.TLSSkipVerify {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				return security, err
+			}
+			security.TLSRootCAs = pool
+		}
+		return security, nil
+	}
+
+	bundle, err := os.ReadFile(c.TLS.CAFile)
+	if err != nil {
+		return security, err
+	}
+
+	security.TLSRootCAs = x509.NewCertPool()
+	if !security.TLSRootCAs.AppendCertsFromPEM(bundle) {
+		return security, fmt.Errorf("no PEM certificates found in %s", c.TLS.CAFile)
+	}
+	return security, nil
+}
+
+// Authenticator returns the client certificate authenticator when one is
+// configured, a password authenticator of the credentials otherwise.
+func (c Couchbase) Authenticator(username string, password string) (gocb.Authenticator, error) {
+	if !c.CertificateAuth() {
+		return gocb.PasswordAuthenticator{Username: username, Password: password}, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return gocb.CertificateAuthenticator{ClientCertificate: &certificate}, nil
+}
+
+// validateTLS adds the problems of the TLS settings.
+func (c Config) validateTLS(invalid func(format string, args ...interface{})) {
+	if (c.HTTP.TLS.CertFile == "") != (c.HTTP.TLS.KeyFile == "") {
+		invalid("http.tls.certFile and http.tls.keyFile must be set together")
+	}
+
+	if c.Store == StoreCouchbase {
+		c.Couchbase.validateTLS(invalid)
+	}
+}
+
+// validateTLS adds the problems of the TLS settings of the cluster
+// connection.
+func (c Couchbase) validateTLS(invalid func(format string, args ...interface{})) {
+	tlsSet := c.TLS != CouchbaseTLS{}
+	if tlsSet && !c.Secure() {
+		invalid("couchbase.tls needs a %s couchbase.host", secureScheme)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		invalid("couchbase.tls.certFile and couchbase.tls.keyFile must be set together")
+	}
+}
+
+// loadTLS reads the certificates and keys, so broken files are reported along
+// with the other problems instead of when connecting.
+func (c Config) loadTLS() []string {
+	var problems []string
+
+	if c.HTTP.TLS.Enabled() {
+		if _, err := tls.LoadX509KeyPair(c.HTTP.TLS.CertFile, c.HTTP.TLS.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("could not load the http certificate: %s", err))
+		}
+	}
+
+	if c.Store == StoreCouchbase {
+		problems = append(problems, c.Couchbase.loadTLS()...)
+	}
+
+	return problems
+}
+
+// loadTLS reads the CA bundle and the client certificate of the cluster
+// connection.
+func (c Couchbase) loadTLS() []string {
+	var problems []string
+	if _, err := c.SecurityConfig(); err != nil {
+		problems = append(problems, fmt.Sprintf("could not load the couchbase CA bundle: %s", err))
+	}
+	if _, err := c.Authenticator(c.Username, c.Password); err != nil {
+		problems = append(problems, fmt.Sprintf("could not load the couchbase client certificate: %s", err))
+	}
+	return problems
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+const consistencyTokenHeader = "X-Consistency-Token"
+
+// setConsistencyToken hands the client a token for the write it just made so a
+// following list query can wait for the indexes to catch up with it.
+//
+// Repositories that are always consistent hand out no token.
+func setConsistencyToken(w http.ResponseWriter, id string) {
+	token, err := items.MutationToken(id)
+	if err != nil {
+		log.Printf("could not obtain mutation token for item %s: %s", id, err)
+		return
+	}
+
+	if token == nil {
+		return
+	}
+
+	raw, err := json.Marshal(gocb.NewMutationState(*token))
+	if err != nil {
+		log.Printf("could not encode mutation token for item %s: %s", id, err)
+		return
+	}
+
+	w.Header().Set(consistencyTokenHeader, base64.RawURLEncoding.EncodeToString(raw))
+}
+
+// consistencyState merges the consistency tokens sent by the client, either as
+// X-Consistency-Token headers or consistencyToken query parameters. It returns
+// nil when none were sent.
+func consistencyState(req *http.Request) (*gocb.MutationState, error) {
+	values := append(req.Header.Values(consistencyTokenHeader), req.URL.Query()["consistencyToken"]...)
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	type partition struct {
+		bucket string
+		vbID   uint64
+	}
+	latest := map[partition]gocb.MutationToken{}
+
+	for _, value := range values {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+
+		var state gocb.MutationState
+		if err = json.Unmarshal(raw, &state); err != nil {
+			return nil, err
+		}
+
+		// MutationState keeps only the last token per vBucket when it is sent
+		// to the query service, so keep the highest seqno ourselves.
+		for _, token := range state.Internal().Tokens() {
+			key := partition{bucket: token.BucketName(), vbID: token.PartitionID()}
+			if current, ok := latest[key]; !ok || token.SequenceNumber() > current.SequenceNumber() {
+				latest[key] = token
+			}
+		}
+	}
+
+	tokens := make([]gocb.MutationToken, 0, len(latest))
+	for _, token := range latest {
+		tokens = append(tokens, token)
+	}
+
+	return gocb.NewMutationState(tokens...), nil
+}
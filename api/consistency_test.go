@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+	"github.com/couchbase/gocb/v2"
+	"github.com/couchbase/gocbcore/v10"
+)
+
+// tokenRepository hands out the same mutation token for every item.
+type tokenRepository struct {
+	repository.ItemRepository
+	token *gocb.MutationToken
+}
+
+func (r tokenRepository) MutationToken(string) (*gocb.MutationToken, error) {
+	return r.token, nil
+}
+
+func mutationToken(bucket string, vbID uint16, vbUUID uint64, seqNo uint64) gocb.MutationToken {
+	state := gocb.NewMutationState()
+	state.Internal().Add(bucket, gocbcore.MutationToken{VbID: vbID, VbUUID: gocbcore.VbUUID(vbUUID), SeqNo: gocbcore.SeqNo(seqNo)})
+	return state.Internal().Tokens()[0]
+}
+
+// encodedToken encodes the tokens the way setConsistencyToken does.
+func encodedToken(t *testing.T, tokens ...gocb.MutationToken) string {
+	t.Helper()
+
+	raw, err := json.Marshal(gocb.NewMutationState(tokens...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func sortedTokens(state *gocb.MutationState) []gocb.MutationToken {
+	tokens := state.Internal().Tokens()
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].BucketName() != tokens[j].BucketName() {
+			return tokens[i].BucketName() < tokens[j].BucketName()
+		}
+		return tokens[i].PartitionID() < tokens[j].PartitionID()
+	})
+	return tokens
+}
+
+func TestConsistencyTokenRoundTrip(t *testing.T) {
+	defer func(previous repository.ItemRepository) { items = previous }(items)
+	token := mutationToken("demo", 17, 0xcafe, 42)
+	items = tokenRepository{token: &token}
+
+	response := httptest.NewRecorder()
+	setConsistencyToken(response, "item")
+	header := response.Header().Get(consistencyTokenHeader)
+	if header == "" {
+		t.Fatal("no consistency token was set")
+	}
+
+	req := httptest.NewRequest("GET", "/items", nil)
+	req.Header.Set(consistencyTokenHeader, header)
+	state, err := consistencyState(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := state.Internal().Tokens(); len(tokens) != 1 || tokens[0] != token {
+		t.Fatalf("decoded %+v, expected %+v", tokens, token)
+	}
+
+	// an always consistent repository hands out no token.
+	items = tokenRepository{}
+	response = httptest.NewRecorder()
+	setConsistencyToken(response, "item")
+	if header = response.Header().Get(consistencyTokenHeader); header != "" {
+		t.Fatalf("set the consistency token %q without a mutation token", header)
+	}
+}
+
+func TestConsistencyStateKeepsTheHighestSeqnoPerVbucket(t *testing.T) {
+	req := httptest.NewRequest("GET", "/items?consistencyToken="+encodedToken(t, mutationToken("demo", 1, 7, 30), mutationToken("other", 1, 7, 5)), nil)
+	req.Header.Add(consistencyTokenHeader, encodedToken(t, mutationToken("demo", 1, 7, 10), mutationToken("demo", 2, 8, 3)))
+	req.Header.Add(consistencyTokenHeader, encodedToken(t, mutationToken("demo", 1, 7, 20)))
+
+	state, err := consistencyState(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []gocb.MutationToken{
+		mutationToken("demo", 1, 7, 30),
+		mutationToken("demo", 2, 8, 3),
+		mutationToken("other", 1, 7, 5),
+	}
+	tokens := sortedTokens(state)
+	if len(tokens) != len(expected) {
+		t.Fatalf("merged %+v, expected %+v", tokens, expected)
+	}
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Fatalf("merged %+v, expected %+v", tokens, expected)
+		}
+	}
+}
+
+func TestConsistencyStateRejectsInvalidTokens(t *testing.T) {
+	for _, token := range []string{"not base64!", base64.RawURLEncoding.EncodeToString([]byte("{"))} {
+		req := httptest.NewRequest("GET", "/items", nil)
+		req.Header.Set(consistencyTokenHeader, token)
+		if _, err := consistencyState(req); err == nil {
+			t.Fatalf("decoded the invalid token %q", token)
+		}
+	}
+
+	state, err := consistencyState(httptest.NewRequest("GET", "/items", nil))
+	if state != nil || err != nil {
+		t.Fatalf("decoded %v, %v without a token, expected nothing", state, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+)
+
+// couchbaseReadyTimeout bounds how long a new connection may take to prove
+// its credentials.
+const couchbaseReadyTimeout = 30 * time.Second
+
+// connectCouchbase connects with the latest credentials and builds the item
+// repository, the outbox and the idempotency records on the connection.
+func connectCouchbase(cfg config.Couchbase, outboxCfg config.Outbox, envelope outbox.Envelope, credentials *config.RotatingCredentials) (*repository.CouchbaseItemRepository, *repository.CouchbaseOutbox, couchbaseIdempotencyStore, error) {
+	var idempotency couchbaseIdempotencyStore
+
+	cluster, err := credentials.Connect()
+	if err != nil {
+		return nil, nil, idempotency, err
+	}
+
+	bucket := cluster.Bucket(cfg.Bucket)
+	if err = bucket.WaitUntilReady(couchbaseReadyTimeout, nil); err != nil {
+		cluster.Close(nil)
+		return nil, nil, idempotency, err
+	}
+
+	itemScope := bucket.Scope(cfg.Scope)
+	items, err := repository.NewCouchbaseItemRepository(cluster, itemScope.Collection(cfg.Collection))
+	if err != nil {
+		cluster.Close(nil)
+		return nil, nil, idempotency, err
+	}
+
+	itemOutbox, err := repository.NewCouchbaseOutbox(repository.CouchbaseOutboxOptions{
+		Collection:         itemScope.Collection(cfg.OutboxCollection),
+		Counters:           itemScope.Collection(cfg.CounterCollection),
+		Envelope:           envelope,
+		Format:             outboxCfg.Format,
+		Mode:               outboxCfg.Mode,
+		AggregateMaxEvents: outboxCfg.AggregateMaxEvents,
+	})
+	if err != nil {
+		cluster.Close(nil)
+		return nil, nil, idempotency, err
+	}
+
+	idempotency = couchbaseIdempotencyStore{collection: itemScope.Collection(cfg.IdempotencyCollection)}
+	return items, itemOutbox, idempotency, nil
+}
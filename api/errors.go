@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+const problemContentType = "application/problem+json"
+
+// retryAfterSeconds is how long clients are asked to wait before retrying a
+// request that timed out or whose outcome is unknown.
+const retryAfterSeconds = 1
+
+// problem is an RFC 7807 problem details document. Code is the machine
+// readable identifier clients are expected to switch on.
+type problem struct {
+	Type           string   `json:"type"`
+	Title          string   `json:"title"`
+	Status         int      `json:"status"`
+	Code           string   `json:"code"`
+	Detail         string   `json:"detail,omitempty"`
+	Errors         []string `json:"errors,omitempty"`
+	CurrentVersion *int     `json:"currentVersion,omitempty"`
+
+	// RetryAfter is sent as the Retry-After header when it is not zero.
+	RetryAfter int `json:"-"`
+}
+
+// apiError is an error raised by the API itself rather than by Couchbase.
+type apiError struct {
+	status int
+	code   string
+	detail string
+}
+
+func (e *apiError) Error() string {
+	return e.detail
+}
+
+func newAPIError(status int, code string, detail string) error {
+	return &apiError{status: status, code: code, detail: detail}
+}
+
+// problemFor maps an error to the problem document sent to the client.
+// Errors returned from a transaction lambda arrive wrapped in a
+// TransactionFailedError, so the API's own errors are looked for first.
+func problemFor(err error) problem {
+	var api *apiError
+	var conflict *versionConflictError
+	var invalid *validationError
+	var inapplicable *patchError
+	var expired *gocb.TransactionExpiredError
+	var ambiguous *gocb.TransactionCommitAmbiguousError
+	var failed *gocb.TransactionFailedError
+
+	switch {
+	case errors.As(err, &api):
+		return newProblem(api.status, api.code, api.detail)
+	case errors.As(err, &conflict) && conflict.precondition:
+		p := newProblem(http.StatusPreconditionFailed, "precondition_failed", conflict.Error())
+		p.CurrentVersion = &conflict.currentVersion
+		return p
+	case errors.As(err, &conflict):
+		p := newProblem(http.StatusConflict, "version_conflict", conflict.Error())
+		p.CurrentVersion = &conflict.currentVersion
+		return p
+	case errors.As(err, &invalid):
+		p := newProblem(http.StatusBadRequest, "validation_failed", "the request is invalid")
+		p.Errors = invalid.errs
+		return p
+	case errors.As(err, &inapplicable):
+		return newProblem(http.StatusUnprocessableEntity, "patch_not_applicable", inapplicable.Error())
+	case errors.Is(err, gocb.ErrDocumentNotFound):
+		return newProblem(http.StatusNotFound, "document_not_found", "the document does not exist")
+	case errors.Is(err, gocb.ErrDocumentExists):
+		return newProblem(http.StatusConflict, "document_exists", "the document already exists")
+	case errors.Is(err, gocb.ErrCasMismatch):
+		return newProblem(http.StatusConflict, "cas_mismatch", "the document has been modified concurrently")
+	case errors.As(err, &expired):
+		return newUnavailableProblem("transaction_expired", err.Error())
+	case errors.Is(err, gocb.ErrTimeout):
+		return newUnavailableProblem("timeout", err.Error())
+	case errors.As(err, &ambiguous):
+		// the commit may or may not have happened, the client has to check
+		// before retrying.
+		return newUnavailableProblem("transaction_commit_ambiguous", err.Error())
+	case errors.As(err, &failed):
+		return newProblem(http.StatusInternalServerError, "transaction_failed", err.Error())
+	default:
+		return newProblem(http.StatusInternalServerError, "internal_error", err.Error())
+	}
+}
+
+func newProblem(status int, code string, detail string) problem {
+	return problem{
+		Type:   "/problems/" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// newUnavailableProblem is the problem of a request that may succeed when it
+// is retried later.
+func newUnavailableProblem(code string, detail string) problem {
+	p := newProblem(http.StatusServiceUnavailable, code, detail)
+	p.RetryAfter = retryAfterSeconds
+	return p
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeProblem(w, problemFor(err))
+}
+
+func writeProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	if p.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(p.RetryAfter))
+	}
+	w.WriteHeader(p.Status)
+	body, _ := json.Marshal(p)
+	w.Write(body)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "the method is not supported by this endpoint"))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+func TestProblemFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{"api error", newAPIError(http.StatusNotFound, "not_found", "no such resource"), http.StatusNotFound, "not_found", ""},
+		{"version conflict", &versionConflictError{currentVersion: 3}, http.StatusConflict, "version_conflict", ""},
+		{"failed precondition", &versionConflictError{currentVersion: 3, precondition: true}, http.StatusPreconditionFailed, "precondition_failed", ""},
+		{"validation error", &validationError{errs: []string{"name is required"}}, http.StatusBadRequest, "validation_failed", ""},
+		{"inapplicable patch", &patchError{msg: "test of /name failed"}, http.StatusUnprocessableEntity, "patch_not_applicable", ""},
+		{"error of a transaction lambda", fmt.Errorf("transaction failed: %w", &versionConflictError{currentVersion: 3}), http.StatusConflict, "version_conflict", ""},
+		{"document not found", gocb.ErrDocumentNotFound, http.StatusNotFound, "document_not_found", ""},
+		{"document exists", fmt.Errorf("transaction failed: %w", gocb.ErrDocumentExists), http.StatusConflict, "document_exists", ""},
+		{"cas mismatch", gocb.ErrCasMismatch, http.StatusConflict, "cas_mismatch", ""},
+		{"expired transaction", &gocb.TransactionExpiredError{}, http.StatusServiceUnavailable, "transaction_expired", "1"},
+		{"ambiguous timeout", gocb.ErrAmbiguousTimeout, http.StatusServiceUnavailable, "timeout", "1"},
+		{"unambiguous timeout", gocb.ErrUnambiguousTimeout, http.StatusServiceUnavailable, "timeout", "1"},
+		{"ambiguous commit", &gocb.TransactionCommitAmbiguousError{}, http.StatusServiceUnavailable, "transaction_commit_ambiguous", "1"},
+		{"failed transaction", &gocb.TransactionFailedError{}, http.StatusInternalServerError, "transaction_failed", ""},
+		{"anything else", errors.New("boom"), http.StatusInternalServerError, "internal_error", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			writeError(response, test.err)
+
+			var p problem
+			if err := json.Unmarshal(response.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if response.Code != test.status || p.Status != test.status || p.Code != test.code || p.Type != "/problems/"+test.code {
+				t.Fatalf("responded %d with %+v, expected %d with the code %s", response.Code, p, test.status, test.code)
+			}
+			if contentType := response.Header().Get("Content-Type"); contentType != problemContentType {
+				t.Fatalf("content type is %s, expected %s", contentType, problemContentType)
+			}
+			if retryAfter := response.Header().Get("Retry-After"); retryAfter != test.retryAfter {
+				t.Fatalf("Retry-After is %q, expected %q", retryAfter, test.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// casETag renders the document CAS as a strong entity tag.
+func casETag(cas gocb.Cas) string {
+	return `"` + strconv.FormatUint(uint64(cas), 10) + `"`
+}
+
+// etagMatches reports whether the If-Match / If-None-Match header value
+// contains the given entity tag. Weak tags are compared by their opaque value.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
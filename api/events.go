@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+	"github.com/google/uuid"
+)
+
+const (
+	itemAggregateType      = "item"
+	itemEventSchemaVersion = 1
+)
+
+var itemAggregateConfig outbox.AggregateConfig
+var itemOutbox repository.Outbox
+
+// newItemEvent describes the change of an item from before to after. Before
+// is nil for a created and after is nil for a deleted item.
+func newItemEvent(eventType string, before *Item, after *Item) (outbox.Event, error) {
+	current := after
+	if current == nil {
+		current = before
+	}
+
+	event := outbox.Event{
+		ID:             uuid.NewString(),
+		AggregateType:  itemAggregateType,
+		AggregateID:    current.ID,
+		Type:           eventType,
+		Version:        current.Version,
+		SchemaVersion:  itemEventSchemaVersion,
+		OccurrenceTime: time.Now().UTC(),
+		Sequence:       current.Sequence,
+	}
+	if after == nil {
+		// a deleted item is not written back, so its sequence only advances
+		// in the event.
+		event.Sequence = before.Sequence + 1
+	}
+
+	var err error
+	if before != nil {
+		if event.Before, err = itemAggregateConfig.Snapshot(before); err != nil {
+			return event, err
+		}
+	}
+
+	if after != nil {
+		if event.After, err = itemAggregateConfig.Snapshot(after); err != nil {
+			return event, err
+		}
+	}
+
+	if before != nil && after != nil {
+		event.ChangedPaths, err = outbox.ChangedPaths(before, after)
+	}
+
+	return event, err
+}
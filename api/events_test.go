@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+func TestNewItemEvent(t *testing.T) {
+	defer func(config outbox.AggregateConfig) { itemAggregateConfig = config }(itemAggregateConfig)
+
+	occurred := time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC)
+	before := Item{ID: "item-1", Version: 1, Sequence: 1, Name: "ciko", Price: 4.5, Description: "a cat", OccurrenceTime: occurred}
+	after := before
+	after.Version, after.Sequence, after.Price, after.Description = 2, 2, 5, "a grey cat"
+
+	snapshot := func(item Item, excluded ...string) map[string]interface{} {
+		s := map[string]interface{}{
+			"id":             item.ID,
+			"version":        float64(item.Version),
+			"sequence":       float64(item.Sequence),
+			"name":           item.Name,
+			"price":          item.Price,
+			"description":    item.Description,
+			"active":         item.Active,
+			"occurrenceTime": outbox.FormatTime(item.OccurrenceTime),
+		}
+		for _, field := range excluded {
+			delete(s, field)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name         string
+		eventType    string
+		before       *Item
+		after        *Item
+		excluded     []string
+		version      int
+		sequence     int64
+		snapBefore   map[string]interface{}
+		snapAfter    map[string]interface{}
+		changedPaths []string
+	}{
+		{
+			name:      "created",
+			eventType: outbox.EventTypeCreated,
+			after:     &before,
+			version:   1,
+			sequence:  1,
+			snapAfter: snapshot(before),
+		},
+		{
+			name:         "updated",
+			eventType:    outbox.EventTypeUpdated,
+			before:       &before,
+			after:        &after,
+			version:      2,
+			sequence:     2,
+			snapBefore:   snapshot(before),
+			snapAfter:    snapshot(after),
+			changedPaths: []string{"/description", "/price", "/sequence", "/version"},
+		},
+		{
+			name:       "deleted",
+			eventType:  outbox.EventTypeDeleted,
+			before:     &after,
+			version:    2,
+			sequence:   3,
+			snapBefore: snapshot(after),
+		},
+		{
+			name:         "updated with excluded fields",
+			eventType:    outbox.EventTypeUpdated,
+			before:       &before,
+			after:        &after,
+			excluded:     []string{"description", "price"},
+			version:      2,
+			sequence:     2,
+			snapBefore:   snapshot(before, "description", "price"),
+			snapAfter:    snapshot(after, "description", "price"),
+			changedPaths: []string{"/description", "/price", "/sequence", "/version"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			itemAggregateConfig = outbox.AggregateConfig{ExcludedFields: test.excluded}
+
+			event, err := newItemEvent(test.eventType, test.before, test.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if event.ID == "" || event.AggregateType != itemAggregateType || event.AggregateID != "item-1" || event.Type != test.eventType || event.SchemaVersion != itemEventSchemaVersion {
+				t.Fatalf("event %+v, expected a %s event of item item-1", event, test.eventType)
+			}
+			if event.Version != test.version || event.Sequence != test.sequence {
+				t.Fatalf("event has version %d and sequence %d, expected %d and %d", event.Version, event.Sequence, test.version, test.sequence)
+			}
+			if !reflect.DeepEqual(event.Before, test.snapBefore) {
+				t.Fatalf("before is %v, expected %v", event.Before, test.snapBefore)
+			}
+			if !reflect.DeepEqual(event.After, test.snapAfter) {
+				t.Fatalf("after is %v, expected %v", event.After, test.snapAfter)
+			}
+			if !reflect.DeepEqual(event.ChangedPaths, test.changedPaths) {
+				t.Fatalf("changed paths are %v, expected %v", event.ChangedPaths, test.changedPaths)
+			}
+		})
+	}
+}
@@ -4,10 +4,14 @@ go 1.18
 
 require (
 	github.com/couchbase/gocb/v2 v2.4.1
+	github.com/couchbase/gocbcore/v10 v10.1.1
 	github.com/google/uuid v1.3.0
+	github.com/segmentio/kafka-go v0.4.47
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/couchbase/gocbcore/v10 v10.1.1 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 )
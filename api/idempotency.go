@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyKeyExpiry      = 24 * time.Hour
+	defaultIdempotencyLease   = time.Minute
+	maxIdempotencyKeyLen      = 200
+	idempotencyStatePending   = "PENDING"
+	idempotencyStateCompleted = "COMPLETED"
+)
+
+// replayedHeaders are the response headers stored with an idempotency record
+// and sent again when the request is replayed.
+var replayedHeaders = []string{"Content-Type", "ETag", consistencyTokenHeader}
+
+// idempotencyLease is how long a PENDING record holds its key, the write
+// timeout of the api when it has one. A request that dies before completing
+// its record frees the key for a retry once the lease ran out.
+var idempotencyLease = defaultIdempotencyLease
+
+// idempotencyRecord is the document stored in the idempotency collection
+// under the endpoint path and the client supplied key.
+type idempotencyRecord struct {
+	State       string            `json:"state"`
+	RequestHash string            `json:"requestHash"`
+	Status      int               `json:"status,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// idempotencyStore keeps the idempotency records until they expire. The
+// records are written with CAS so a request only completes the record it
+// created itself.
+type idempotencyStore interface {
+	// insert fails with gocb.ErrDocumentExists when the key is taken.
+	insert(key string, record idempotencyRecord) (gocb.Cas, error)
+	get(key string) (idempotencyRecord, error)
+	replace(key string, record idempotencyRecord, cas gocb.Cas) error
+	remove(key string, cas gocb.Cas) error
+}
+
+var idempotencyRecords idempotencyStore
+
+// expiry is how long the record is kept, the lease of the request while it is
+// pending and a day once it holds the response.
+func (r idempotencyRecord) expiry() time.Duration {
+	if r.State == idempotencyStatePending {
+		return idempotencyLease
+	}
+	return idempotencyKeyExpiry
+}
+
+// couchbaseIdempotencyStore keeps the records in the idempotency collection,
+// they expire with the document expiry.
+type couchbaseIdempotencyStore struct {
+	collection *gocb.Collection
+}
+
+func (s couchbaseIdempotencyStore) insert(key string, record idempotencyRecord) (gocb.Cas, error) {
+	result, err := s.collection.Insert(key, record, &gocb.InsertOptions{Expiry: record.expiry()})
+	if err != nil {
+		return 0, err
+	}
+	return result.Cas(), nil
+}
+
+func (s couchbaseIdempotencyStore) get(key string) (idempotencyRecord, error) {
+	var record idempotencyRecord
+
+	result, err := s.collection.Get(key, &gocb.GetOptions{})
+	if err != nil {
+		return record, err
+	}
+
+	err = result.Content(&record)
+	return record, err
+}
+
+func (s couchbaseIdempotencyStore) replace(key string, record idempotencyRecord, cas gocb.Cas) error {
+	_, err := s.collection.Replace(key, record, &gocb.ReplaceOptions{
+		Cas:    cas,
+		Expiry: record.expiry(),
+	})
+	return err
+}
+
+func (s couchbaseIdempotencyStore) remove(key string, cas gocb.Cas) error {
+	_, err := s.collection.Remove(key, &gocb.RemoveOptions{Cas: cas})
+	return err
+}
+
+// memoryIdempotencyStore keeps the records in memory, expired ones are
+// dropped when their key is used again.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]memoryIdempotencyRecord
+	lastCas gocb.Cas
+}
+
+type memoryIdempotencyRecord struct {
+	record    idempotencyRecord
+	cas       gocb.Cas
+	expiresAt time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[string]memoryIdempotencyRecord{}}
+}
+
+// lookup returns the live record of the key, mu must be held.
+func (s *memoryIdempotencyStore) lookup(key string) (memoryIdempotencyRecord, bool) {
+	stored, found := s.records[key]
+	if found && time.Now().After(stored.expiresAt) {
+		delete(s.records, key)
+		return stored, false
+	}
+	return stored, found
+}
+
+func (s *memoryIdempotencyStore) store(key string, record idempotencyRecord) gocb.Cas {
+	s.lastCas++
+	s.records[key] = memoryIdempotencyRecord{record: record, cas: s.lastCas, expiresAt: time.Now().Add(record.expiry())}
+	return s.lastCas
+}
+
+func (s *memoryIdempotencyStore) insert(key string, record idempotencyRecord) (gocb.Cas, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.lookup(key); found {
+		return 0, gocb.ErrDocumentExists
+	}
+	return s.store(key, record), nil
+}
+
+func (s *memoryIdempotencyStore) get(key string) (idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.lookup(key)
+	if !found {
+		return idempotencyRecord{}, gocb.ErrDocumentNotFound
+	}
+	return stored.record, nil
+}
+
+func (s *memoryIdempotencyStore) replace(key string, record idempotencyRecord, cas gocb.Cas) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.lookup(key)
+	if !found {
+		return gocb.ErrDocumentNotFound
+	}
+	if stored.cas != cas {
+		return gocb.ErrCasMismatch
+	}
+	s.store(key, record)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) remove(key string, cas gocb.Cas) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.lookup(key)
+	if !found {
+		return gocb.ErrDocumentNotFound
+	}
+	if stored.cas != cas {
+		return gocb.ErrCasMismatch
+	}
+	delete(s.records, key)
+	return nil
+}
+
+// idempotencyRecorder passes the response through while keeping a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent makes POST requests carrying an Idempotency-Key header safe to
+// retry. The first request with a key runs the handler and stores its
+// response, later requests with the same key and body get that response
+// replayed. Server errors are not stored so the client can retry them.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+		if req.Method != "POST" || key == "" {
+			handler(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(w, &validationError{errs: []string{"Idempotency-Key must be at most 200 characters"}})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxItemRequestBodySize))
+		if err != nil {
+			writeError(w, &validationError{errs: []string{"invalid request body: " + err.Error()}})
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		io.WriteString(hash, req.Method+" "+req.URL.RequestURI()+"\n")
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		docID := req.URL.Path + "::" + key
+		pending := idempotencyRecord{
+			State:       idempotencyStatePending,
+			RequestHash: requestHash,
+			CreatedAt:   time.Now().UTC(),
+		}
+
+		cas, err := idempotencyRecords.insert(docID, pending)
+		if errors.Is(err, gocb.ErrDocumentExists) {
+			replayIdempotentResponse(w, docID, requestHash)
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		recorder := &idempotencyRecorder{ResponseWriter: w}
+		handler(recorder, req)
+
+		if recorder.status >= http.StatusInternalServerError {
+			if err = idempotencyRecords.remove(docID, cas); err != nil {
+				log.Printf("could not release idempotency key %s: %s", docID, err)
+			}
+			return
+		}
+
+		completed := pending
+		completed.State = idempotencyStateCompleted
+		completed.Status = recorder.status
+		completed.Body = recorder.body.Bytes()
+		completed.Headers = map[string]string{}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				completed.Headers[name] = value
+			}
+		}
+
+		if err = idempotencyRecords.replace(docID, completed, cas); err != nil {
+			log.Printf("could not store response for idempotency key %s: %s", docID, err)
+		}
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, docID string, requestHash string) {
+	record, err := idempotencyRecords.get(docID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if record.RequestHash != requestHash {
+		writeError(w, newAPIError(http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key has already been used with a different request"))
+		return
+	}
+
+	if record.State != idempotencyStateCompleted {
+		writeError(w, newAPIError(http.StatusConflict, "idempotency_key_in_progress", "a request with this Idempotency-Key is still in progress"))
+		return
+	}
+
+	for name, value := range record.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
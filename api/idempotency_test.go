@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+func TestMemoryIdempotencyStoreLeasesPendingRecords(t *testing.T) {
+	defer func(lease time.Duration) { idempotencyLease = lease }(idempotencyLease)
+	idempotencyLease = 20 * time.Millisecond
+
+	store := newMemoryIdempotencyStore()
+	pending := idempotencyRecord{State: idempotencyStatePending, RequestHash: "hash"}
+
+	if _, err := store.insert("abandoned", pending); err != nil {
+		t.Fatal(err)
+	}
+	cas, err := store.insert("completed", pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.insert("abandoned", pending); !errors.Is(err, gocb.ErrDocumentExists) {
+		t.Fatalf("inserting a held key returned %v, expected gocb.ErrDocumentExists", err)
+	}
+
+	completed := pending
+	completed.State = idempotencyStateCompleted
+	if err = store.replace("completed", completed, cas); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * idempotencyLease)
+
+	// the key of a request that never completed frees up after its lease.
+	if _, err = store.insert("abandoned", pending); err != nil {
+		t.Fatalf("inserting an abandoned key returned %v", err)
+	}
+	if record, err := store.get("completed"); err != nil || record.State != idempotencyStateCompleted {
+		t.Fatalf("completed record is %+v, %v after the lease", record, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+)
+
+const (
+	maxItemNameLength        = 100
+	maxItemDescriptionLength = 1000
+	maxItemRequestBodySize   = 1 << 20
+)
+
+// Item is the document stored in the item collection.
+type Item = repository.Item
+
+// ItemRequest is the body accepted by the create and update endpoints.
+type ItemRequest struct {
+	Name        string  `json:"name"`
+	Price       float64 `json:"price"`
+	Description string  `json:"description"`
+	Active      bool    `json:"active"`
+
+	// ExpectedVersion, when set, makes an update fail with a conflict unless
+	// the stored item is still at this version.
+	ExpectedVersion *int `json:"expectedVersion,omitempty"`
+}
+
+// versionConflictError is returned from a transaction when the stored item is
+// not at the version the client based its change on. A version taken from an
+// If-Match header fails the precondition rather than conflicting.
+type versionConflictError struct {
+	currentVersion int
+	precondition   bool
+}
+
+func (e *versionConflictError) Error() string {
+	return fmt.Sprintf("item has been modified, current version is %d", e.currentVersion)
+}
+
+// validationError is returned from a transaction when the change it was asked
+// to make would leave the item invalid.
+type validationError struct {
+	errs []string
+}
+
+func (e *validationError) Error() string {
+	return strings.Join(e.errs, "; ")
+}
+
+// readOnlyItemPaths are maintained by the API and cannot be patched.
+var readOnlyItemPaths = []string{"/id", "/version", "/sequence", "/occurrenceTime"}
+
+// patchedItem converts the JSON form of a patched item back into an Item and
+// validates it the same way a full update would be.
+func patchedItem(patched interface{}, paths []string) (Item, error) {
+	var item Item
+	var errs []string
+
+	for _, path := range paths {
+		for _, readOnly := range readOnlyItemPaths {
+			if path == readOnly || strings.HasPrefix(path, readOnly+"/") {
+				errs = append(errs, path+" is read-only")
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return item, &validationError{errs: errs}
+	}
+
+	raw, err := json.Marshal(patched)
+	if err != nil {
+		return item, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&item); err != nil {
+		return item, &validationError{errs: []string{"invalid item: " + err.Error()}}
+	}
+
+	itemReq := ItemRequest{
+		Name:        item.Name,
+		Price:       item.Price,
+		Description: item.Description,
+		Active:      item.Active,
+	}
+	if errs = itemReq.Validate(); len(errs) > 0 {
+		return item, &validationError{errs: errs}
+	}
+
+	return item, nil
+}
+
+// Validate returns every problem found in the request, not just the first one.
+func (r ItemRequest) Validate() []string {
+	var errs []string
+
+	if r.Name == "" {
+		errs = append(errs, "name is required")
+	} else if utf8.RuneCountInString(r.Name) > maxItemNameLength {
+		errs = append(errs, fmt.Sprintf("name must be at most %d characters", maxItemNameLength))
+	}
+
+	if r.Price < 0 {
+		errs = append(errs, "price must not be negative")
+	}
+
+	if utf8.RuneCountInString(r.Description) > maxItemDescriptionLength {
+		errs = append(errs, fmt.Sprintf("description must be at most %d characters", maxItemDescriptionLength))
+	}
+
+	return errs
+}
+
+// Apply copies the client supplied fields onto the item.
+func (r ItemRequest) Apply(item *Item) {
+	item.Name = r.Name
+	item.Price = r.Price
+	item.Description = r.Description
+	item.Active = r.Active
+}
+
+// itemDocument returns the JSON form of the item as it is stored, the form
+// patches apply to.
+func itemDocument(item Item) (map[string]interface{}, error) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(raw, &doc)
+	return doc, err
+}
+
+// decodeItemRequest reads and validates the request body. When it returns false
+// the 400 response has already been written.
+func decodeItemRequest(w http.ResponseWriter, req *http.Request) (ItemRequest, bool) {
+	var itemReq ItemRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxItemRequestBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&itemReq); err != nil {
+		writeError(w, &validationError{errs: []string{"invalid request body: " + err.Error()}})
+		return itemReq, false
+	}
+
+	if errs := itemReq.Validate(); len(errs) > 0 {
+		writeError(w, &validationError{errs: errs})
+		return itemReq, false
+	}
+
+	return itemReq, true
+}
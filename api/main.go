@@ -1,120 +1,236 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/couchbase/gocb/v2"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+	"flag"
+	"fmt"
 	"github.com/google/uuid"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var cluster *gocb.Cluster
-var itemCollection *gocb.Collection
-var itemOutboxEventCollection *gocb.Collection
+var items repository.ItemRepository
 
 func main() {
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	envelope := initOutbox(cfg.Outbox)
+
+	switch cfg.Store {
+	case config.StoreCouchbase:
+		initCouchbase(cfg.Couchbase, cfg.Outbox, envelope)
+	case config.StoreMemory:
+		initMemory(envelope, cfg.Events)
+	}
 
-	initCouchbase()
+	initAdminServer(cfg)
 
-	initHttpServer()
+	initHttpServer(cfg.HTTP)
 }
 
-func initCouchbase() {
-	host, set := os.LookupEnv("COUCHBASE_HOST")
-	if !set {
-		panic("COUCHBASE_HOST env is required")
-	}
+// initCouchbase connects the item repository, the outbox and the idempotency
+// records to Couchbase. Credentials read from files are watched, every new
+// socket and request authenticates with the latest ones.
+func initCouchbase(cfg config.Couchbase, outboxCfg config.Outbox, envelope outbox.Envelope) {
+	credentials := cfg.RotatingCredentials()
+	go credentials.Watch(context.Background())
 
-	user, set := os.LookupEnv("COUCHBASE_USERNAME")
-	if !set {
-		panic("COUCHBASE_USERNAME env is required")
+	couchbaseItems, couchbaseOutbox, couchbaseIdempotency, err := connectCouchbase(cfg, outboxCfg, envelope, credentials)
+	if err != nil {
+		panic(err)
 	}
 
-	pass, set := os.LookupEnv("COUCHBASE_PASSWORD")
-	if !set {
-		panic("COUCHBASE_PASSWORD env is required")
+	items, itemOutbox, idempotencyRecords = couchbaseItems, couchbaseOutbox, couchbaseIdempotency
+}
+
+// initMemory keeps everything in process for local development. The events
+// are published as soon as their transaction commits, there is no relay.
+func initMemory(envelope outbox.Envelope, eventsPath string) {
+	var sink io.Writer = os.Stdout
+	if eventsPath != "-" {
+		file, err := os.OpenFile(eventsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			panic(err)
+		}
+		sink = file
 	}
 
-	var err error
-	cluster, err = gocb.Connect(
-		host,
-		gocb.ClusterOptions{
-			Username: user,
-			Password: pass,
-			TransactionsConfig: gocb.TransactionsConfig{
-				DurabilityLevel: gocb.DurabilityLevelNone,
-			},
-		})
+	items = repository.NewMemoryItemRepository()
+	itemOutbox = repository.NewMemoryOutbox(envelope, sink)
+	idempotencyRecords = newMemoryIdempotencyStore()
+}
+
+// initOutbox configures the events written to the outbox and returns their
+// envelope.
+func initOutbox(cfg config.Outbox) outbox.Envelope {
+	envelope, err := outbox.NewEnvelope(cfg.Format, cfg.Source)
 	if err != nil {
 		panic(err)
 	}
 
-	bucketName, set := os.LookupEnv("COUCHBASE_BUCKET")
-	if !set {
-		panic("COUCHBASE_BUCKET env is required")
-	}
+	itemAggregateConfig.ExcludedFields = append(itemAggregateConfig.ExcludedFields, cfg.ItemExcludedFields...)
 
-	scopeName, set := os.LookupEnv("COUCHBASE_SCOPE")
-	if !set {
-		panic("COUCHBASE_SCOPE env is required")
-	}
+	return envelope
+}
 
-	collectionName, set := os.LookupEnv("COUCHBASE_COLLECTION")
-	if !set {
-		panic("COUCHBASE_COLLECTION env is required")
+// initAdminServer serves the effective configuration, with the secrets
+// redacted, on the admin port when there is one.
+func initAdminServer(cfg config.Config) {
+	if cfg.HTTP.AdminPort == 0 {
+		return
 	}
 
-	itemCollection = cluster.Bucket(bucketName).Scope(scopeName).Collection(collectionName)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			body, _ := json.Marshal(cfg.Redacted())
+			w.Write(body)
+		default:
+			writeMethodNotAllowed(w)
+		}
+	})
 
-	outboxCollectionName, set := os.LookupEnv("COUCHBASE_OUTBOX_COLLECTION")
-	if !set {
-		panic("COUCHBASE_OUTBOX_COLLECTION env is required")
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.HTTP.AdminPort),
+		Handler: mux,
 	}
-	itemOutboxEventCollection = cluster.Bucket(bucketName).Scope(scopeName).Collection(outboxCollectionName)
+	go func() {
+		err := listenAndServe(server, cfg.HTTP.TLS)
+		if err != nil {
+			panic(err)
+		}
+	}()
 }
 
-func initHttpServer() {
-	port, set := os.LookupEnv("API_PORT")
-	if !set {
-		panic("API_PORT env is required")
+func initHttpServer(cfg config.HTTP) {
+	if cfg.WriteTimeout > 0 {
+		idempotencyLease = time.Duration(cfg.WriteTimeout)
 	}
 
-	http.HandleFunc("/create-item", createItem)
-	http.HandleFunc("/update-item", updateItem)
-	err := http.ListenAndServe(":"+port, nil)
+	routes(http.DefaultServeMux)
+
+	server := &http.Server{
+		Addr:         ":" + strconv.Itoa(cfg.Port),
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+	err := listenAndServe(server, cfg.TLS)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// routes registers the endpoints of the api on the mux.
+func routes(mux *http.ServeMux) {
+	mux.HandleFunc("/get-item", getItem)
+	mux.HandleFunc("/create-item", idempotent(createItem))
+	mux.HandleFunc("/update-item", idempotent(updateItem))
+	mux.HandleFunc("/delete-item", deleteItem)
+	mux.HandleFunc("/items", listItems)
+	mux.HandleFunc("/items/", itemResource)
+}
+
+// listenAndServe serves over https when a certificate is configured.
+func listenAndServe(server *http.Server, cfg config.HTTPTLS) error {
+	if cfg.Enabled() {
+		return server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+	}
+	return server.ListenAndServe()
+}
+
+func getItem(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD":
+		id := req.URL.Query().Get("id")
+		w.Header().Set("Content-Type", "application/json")
+
+		item, cas, err := items.Get(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		etag := casETag(cas)
+		w.Header().Set("ETag", etag)
+
+		if match := req.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(item)
+		w.Write(body)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
 func createItem(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "POST":
 		w.Header().Set("Content-Type", "application/json")
 
-		id := uuid.NewString()
-		data := map[string]interface{}{
-			"id":             id,
-			"version":        1,
-			"name":           "ciko",
-			"price":          13.75,
-			"description":    "Lorem ipsum dolor sit amet, consectetur adipiscing elit.",
-			"active":         true,
-			"occurrenceTime": time.Now().UTC(),
-		}
-		if _, err := itemCollection.Insert(id, data, &gocb.InsertOptions{}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, `{"err":`+err.Error()+`}`)
+		itemReq, ok := decodeItemRequest(w, req)
+		if !ok {
+			return
+		}
+
+		item := Item{
+			ID:             uuid.NewString(),
+			Version:        1,
+			Sequence:       1,
+			OccurrenceTime: time.Now().UTC(),
+		}
+		itemReq.Apply(&item)
+
+		err := items.Transact(func(tx repository.Tx) error {
+			if err := tx.Insert(item); err != nil {
+				return err
+			}
+
+			event, err := newItemEvent(outbox.EventTypeCreated, nil, &item)
+			if err != nil {
+				return err
+			}
+
+			if err = itemOutbox.Append(tx, event); err != nil {
+				return err
+			}
+
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
+		setConsistencyToken(w, item.ID)
 		w.WriteHeader(http.StatusCreated)
-		body, _ := json.Marshal(data)
+		body, _ := json.Marshal(item)
 		w.Write(body)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 	}
 }
 
@@ -124,52 +240,227 @@ func updateItem(w http.ResponseWriter, req *http.Request) {
 		id := req.URL.Query().Get("id")
 		w.Header().Set("Content-Type", "application/json")
 
-		response := map[string]interface{}{}
+		itemReq, ok := decodeItemRequest(w, req)
+		if !ok {
+			return
+		}
+
+		expectedVersion, ok := ifMatchVersion(w, req, id, itemReq.ExpectedVersion)
+		if !ok {
+			return
+		}
+
+		var item Item
+
+		err := items.Transact(func(tx repository.Tx) error {
+			var err error
+			if item, err = tx.Get(id); err != nil {
+				return err
+			}
+
+			if expectedVersion != nil && item.Version != *expectedVersion {
+				return &versionConflictError{currentVersion: item.Version, precondition: itemReq.ExpectedVersion == nil}
+			}
+
+			previous := item
+			itemReq.Apply(&item)
+			item.Version++
+			item.Sequence++
+			item.OccurrenceTime = time.Now().UTC()
+
+			if err = tx.Replace(item); err != nil {
+				return err
+			}
 
-		_, err := cluster.Transactions().Run(func(ctx *gocb.TransactionAttemptContext) error {
-			getResult, err := ctx.Get(itemCollection, id)
+			event, err := newItemEvent(outbox.EventTypeUpdated, &previous, &item)
 			if err != nil {
 				return err
 			}
 
-			if err = getResult.Content(&response); err != nil {
+			if err = itemOutbox.Append(tx, event); err != nil {
 				return err
 			}
 
-			version := response["version"]
-			response["version"] = version.(float64) + 1
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		setConsistencyToken(w, item.ID)
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(item)
+		w.Write(body)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// ifMatchVersion resolves an If-Match header to the item version it belongs to.
+// The transaction cannot see the CAS, so the returned version is what gets
+// compared inside it, the read here only maps the ETag to that version and
+// rejects a stale one early. When the request also carries an expected version
+// that one is compared instead. When it returns false the response has
+// already been written.
+func ifMatchVersion(w http.ResponseWriter, req *http.Request, id string, expectedVersion *int) (*int, bool) {
+	match := req.Header.Get("If-Match")
+	if match == "" {
+		return expectedVersion, true
+	}
+
+	current, cas, err := items.Get(id)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+
+	if !etagMatches(match, casETag(cas)) {
+		writeError(w, &versionConflictError{currentVersion: current.Version, precondition: true})
+		return nil, false
+	}
+
+	if expectedVersion == nil {
+		expectedVersion = &current.Version
+	}
+
+	return expectedVersion, true
+}
+
+func itemResource(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/items/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, newAPIError(http.StatusNotFound, "not_found", "no such resource"))
+		return
+	}
+
+	switch req.Method {
+	case "PATCH":
+		patchItem(w, req, id)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+func patchItem(w http.ResponseWriter, req *http.Request, id string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType {
+		w.Header().Set("Accept-Patch", mergePatchContentType+", "+jsonPatchContentType)
+		writeError(w, newAPIError(http.StatusUnsupportedMediaType, "unsupported_media_type", "the patch must be a JSON merge patch or a JSON patch"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxItemRequestBodySize))
+	if err != nil {
+		writeError(w, &validationError{errs: []string{"invalid request body: " + err.Error()}})
+		return
+	}
+
+	patch, err := parseItemPatch(contentType, body)
+	if err != nil {
+		writeError(w, &validationError{errs: []string{"invalid patch: " + err.Error()}})
+		return
+	}
+
+	expectedVersion, ok := ifMatchVersion(w, req, id, nil)
+	if !ok {
+		return
+	}
 
-			_, err = ctx.Replace(getResult, response)
+	var item Item
+
+	err = items.Transact(func(tx repository.Tx) error {
+		var err error
+		if item, err = tx.Get(id); err != nil {
+			return err
+		}
+
+		if expectedVersion != nil && item.Version != *expectedVersion {
+			return &versionConflictError{currentVersion: item.Version, precondition: true}
+		}
+
+		doc, err := itemDocument(item)
+		if err != nil {
+			return err
+		}
+
+		patched, err := patch.apply(deepCopyJSON(doc))
+		if err != nil {
+			return err
+		}
+
+		previous := item
+		if item, err = patchedItem(patched, outbox.DiffPaths(doc, patched)); err != nil {
+			return err
+		}
+
+		item.Version++
+		item.Sequence++
+		item.OccurrenceTime = time.Now().UTC()
+
+		if err = tx.Replace(item); err != nil {
+			return err
+		}
+
+		event, err := newItemEvent(outbox.EventTypeUpdated, &previous, &item)
+		if err != nil {
+			return err
+		}
+
+		if err = itemOutbox.Append(tx, event); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	setConsistencyToken(w, item.ID)
+	w.WriteHeader(http.StatusOK)
+	body, _ = json.Marshal(item)
+	w.Write(body)
+}
+
+func deleteItem(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "DELETE":
+		id := req.URL.Query().Get("id")
+		w.Header().Set("Content-Type", "application/json")
+
+		err := items.Transact(func(tx repository.Tx) error {
+			item, err := tx.Get(id)
 			if err != nil {
 				return err
 			}
 
-			event := map[string]interface{}{
-				"id":             response["id"],
-				"version":        response["version"],
-				"type":           "UPDATED",
-				"occurrenceTime": time.Now().UTC(),
+			if err = tx.Remove(id); err != nil {
+				return err
 			}
 
-			_, err = ctx.Insert(itemOutboxEventCollection, uuid.NewString(), event)
+			event, err := newItemEvent(outbox.EventTypeDeleted, &item, nil)
 			if err != nil {
 				return err
 			}
 
+			if err = itemOutbox.Append(tx, event); err != nil {
+				return err
+			}
+
 			return nil
-		}, nil)
+		})
 		if err != nil {
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				io.WriteString(w, `{"err":`+err.Error()+`}`)
-				return
-			}
+			writeError(w, err)
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		body, _ := json.Marshal(response)
-		w.Write(body)
+		setConsistencyToken(w, id)
+		w.WriteHeader(http.StatusNoContent)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 	}
 }
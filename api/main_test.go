@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+)
+
+// useMemoryStore points the handlers at a fresh memory store for the test and
+// returns its outbox.
+func useMemoryStore(t *testing.T) *repository.MemoryOutbox {
+	t.Helper()
+
+	previousItems, previousOutbox, previousRecords := items, itemOutbox, idempotencyRecords
+	t.Cleanup(func() {
+		items, itemOutbox, idempotencyRecords = previousItems, previousOutbox, previousRecords
+	})
+
+	envelope, err := outbox.NewEnvelope(outbox.FormatCloudEvents, "/api/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryOutbox := repository.NewMemoryOutbox(envelope, nil)
+	items, itemOutbox, idempotencyRecords = repository.NewMemoryItemRepository(), memoryOutbox, newMemoryIdempotencyStore()
+
+	return memoryOutbox
+}
+
+// serve runs the handler on the request and returns the response.
+func serve(handler http.HandlerFunc, method string, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder
+}
+
+// expectStatus fails the test unless the response has the status, and
+// decodes its JSON body into v when v is not nil.
+func expectStatus(t *testing.T, response *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+
+	if response.Code != status {
+		t.Fatalf("status is %d, expected %d: %s", response.Code, status, response.Body)
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid response body %s: %s", response.Body, err)
+	}
+}
+
+// createTestItem creates an item through the handler.
+func createTestItem(t *testing.T, body string) Item {
+	t.Helper()
+
+	var created Item
+	expectStatus(t, serve(createItem, "POST", "/create-item", body, nil), http.StatusCreated, &created)
+	return created
+}
+
+// expectEvents fails the test unless the outbox holds events of the given
+// types for the item, in sequence order.
+func expectEvents(t *testing.T, memoryOutbox *repository.MemoryOutbox, id string, types ...string) []outbox.Event {
+	t.Helper()
+
+	events, err := memoryOutbox.Events(itemAggregateType, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(types) {
+		t.Fatalf("outbox holds %d events of item %s, expected %v", len(events), id, types)
+	}
+	for i, event := range events {
+		if event.Type != types[i] || event.Sequence != int64(i+1) {
+			t.Fatalf("event %d is %s with sequence %d, expected %s with sequence %d", i, event.Type, event.Sequence, types[i], i+1)
+		}
+	}
+	return events
+}
+
+func TestCreateItemAppendsACreatedEvent(t *testing.T) {
+	memoryOutbox := useMemoryStore(t)
+
+	created := createTestItem(t, `{"name": "ciko", "price": 4.5, "description": "a cat", "active": true}`)
+	if created.ID == "" || created.Version != 1 || created.Sequence != 1 || created.Name != "ciko" || created.Price != 4.5 || !created.Active {
+		t.Fatalf("created %+v, expected version 1 of the item in the body", created)
+	}
+
+	stored, _, err := items.Get(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "ciko" || stored.Version != 1 {
+		t.Fatalf("stored %+v, expected the created item", stored)
+	}
+
+	events := expectEvents(t, memoryOutbox, created.ID, outbox.EventTypeCreated)
+	if events[0].Version != 1 || events[0].Before != nil || events[0].After["name"] != "ciko" {
+		t.Fatalf("created event %+v, expected version 1 with the item after", events[0])
+	}
+}
+
+func TestItemHandlersRejectInvalidBodies(t *testing.T) {
+	memoryOutbox := useMemoryStore(t)
+	created := createTestItem(t, `{"name": "ciko", "price": 4.5}`)
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		target   string
+		body     string
+		expected []string
+	}{
+		{
+			name:     "create without a name and a negative price",
+			handler:  createItem,
+			target:   "/create-item",
+			body:     `{"price": -1}`,
+			expected: []string{"name is required", "price must not be negative"},
+		},
+		{
+			name:     "create with an unknown field",
+			handler:  createItem,
+			target:   "/create-item",
+			body:     `{"name": "ciko", "colour": "grey"}`,
+			expected: []string{`invalid request body: json: unknown field "colour"`},
+		},
+		{
+			name:     "update with a name too long",
+			handler:  updateItem,
+			target:   "/update-item?id=" + created.ID,
+			body:     `{"name": "` + strings.Repeat("x", maxItemNameLength+1) + `"}`,
+			expected: []string{"name must be at most 100 characters"},
+		},
+		{
+			name:     "update with malformed JSON",
+			handler:  updateItem,
+			target:   "/update-item?id=" + created.ID,
+			body:     `{"name": `,
+			expected: []string{"invalid request body: unexpected EOF"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			expectStatus(t, serve(test.handler, "POST", test.target, test.body, nil), http.StatusBadRequest, &p)
+			if p.Code != "validation_failed" || strings.Join(p.Errors, "; ") != strings.Join(test.expected, "; ") {
+				t.Fatalf("problem %+v, expected the errors %q", p, test.expected)
+			}
+		})
+	}
+
+	// nothing but the creation made it to the outbox.
+	expectEvents(t, memoryOutbox, created.ID, outbox.EventTypeCreated)
+}
+
+func TestUpdateItemWritesTheBodyAndAppendsAnUpdatedEvent(t *testing.T) {
+	memoryOutbox := useMemoryStore(t)
+	created := createTestItem(t, `{"name": "ciko", "price": 4.5}`)
+
+	var updated Item
+	expectStatus(t, serve(updateItem, "POST", "/update-item?id="+created.ID, `{"name": "ciko", "price": 5, "active": true}`, nil), http.StatusOK, &updated)
+	if updated.Version != 2 || updated.Sequence != 2 || updated.Price != 5 || !updated.Active {
+		t.Fatalf("updated %+v, expected version 2 with the price and the active flag of the body", updated)
+	}
+
+	events := expectEvents(t, memoryOutbox, created.ID, outbox.EventTypeCreated, outbox.EventTypeUpdated)
+	if events[1].Before["price"] != 4.5 || events[1].After["price"] != 5.0 || strings.Join(events[1].ChangedPaths, ",") != "/active,/occurrenceTime,/price,/sequence,/version" {
+		t.Fatalf("updated event %+v, expected the price, the active flag and the bookkeeping to change", events[1])
+	}
+}
+
+func TestDeleteItemAppendsADeletedEvent(t *testing.T) {
+	memoryOutbox := useMemoryStore(t)
+	created := createTestItem(t, `{"name": "ciko", "price": 4.5}`)
+
+	expectStatus(t, serve(deleteItem, "DELETE", "/delete-item?id="+created.ID, "", nil), http.StatusNoContent, nil)
+
+	if _, _, err := items.Get(created.ID); err != repository.ErrNotFound {
+		t.Fatalf("getting the deleted item returned %v, expected repository.ErrNotFound", err)
+	}
+
+	events := expectEvents(t, memoryOutbox, created.ID, outbox.EventTypeCreated, outbox.EventTypeDeleted)
+	if events[1].Version != 1 || events[1].After != nil || events[1].Before["name"] != "ciko" {
+		t.Fatalf("deleted event %+v, expected the last version of the item before", events[1])
+	}
+}
+
+func TestDeleteItemReportsAMissingItem(t *testing.T) {
+	memoryOutbox := useMemoryStore(t)
+
+	var p problem
+	expectStatus(t, serve(deleteItem, "DELETE", "/delete-item?id=missing", "", nil), http.StatusNotFound, &p)
+	if p.Code != "document_not_found" {
+		t.Fatalf("problem %+v, expected document_not_found", p)
+	}
+	expectEvents(t, memoryOutbox, "missing")
+}
+
+func TestGetItemHonoursIfNoneMatch(t *testing.T) {
+	useMemoryStore(t)
+	created := createTestItem(t, `{"name": "ciko", "price": 4.5}`)
+
+	response := serve(getItem, "GET", "/get-item?id="+created.ID, "", nil)
+	var got Item
+	expectStatus(t, response, http.StatusOK, &got)
+	etag := response.Header().Get("ETag")
+	if got.ID != created.ID || got.Name != "ciko" || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("got %+v with the ETag %s, expected the created item with a strong ETag", got, etag)
+	}
+
+	response = serve(getItem, "GET", "/get-item?id="+created.ID, "", map[string]string{"If-None-Match": `"0", W/` + etag})
+	expectStatus(t, response, http.StatusNotModified, nil)
+	if response.Body.Len() != 0 || response.Header().Get("ETag") != etag {
+		t.Fatalf("not modified response has the body %q and the ETag %s", response.Body, response.Header().Get("ETag"))
+	}
+
+	// every write changes the CAS and with it the ETag.
+	expectStatus(t, serve(updateItem, "POST", "/update-item?id="+created.ID, `{"name": "ciko", "price": 5}`, nil), http.StatusOK, nil)
+	response = serve(getItem, "GET", "/get-item?id="+created.ID, "", map[string]string{"If-None-Match": etag})
+	expectStatus(t, response, http.StatusOK, &got)
+	if got.Price != 5 || response.Header().Get("ETag") == etag {
+		t.Fatalf("got %+v with the ETag %s after the update, expected a new ETag", got, response.Header().Get("ETag"))
+	}
+
+	expectStatus(t, serve(getItem, "GET", "/get-item?id=missing", "", nil), http.StatusNotFound, nil)
+}
+
+func TestUpdateItemRejectsStaleVersions(t *testing.T) {
+	memoryOutbox := useMemoryStore(t)
+	created := createTestItem(t, `{"name": "ciko", "price": 4.5}`)
+	staleETag := serve(getItem, "GET", "/get-item?id="+created.ID, "", nil).Header().Get("ETag")
+	expectStatus(t, serve(updateItem, "POST", "/update-item?id="+created.ID, `{"name": "ciko", "price": 5}`, nil), http.StatusOK, nil)
+	currentETag := serve(getItem, "GET", "/get-item?id="+created.ID, "", nil).Header().Get("ETag")
+
+	tests := []struct {
+		name    string
+		target  string
+		body    string
+		headers map[string]string
+		status  int
+		code    string
+	}{
+		{
+			name:    "stale If-Match",
+			body:    `{"name": "ciko", "price": 6}`,
+			headers: map[string]string{"If-Match": staleETag},
+			status:  http.StatusPreconditionFailed,
+			code:    "precondition_failed",
+		},
+		{
+			name:   "stale expectedVersion",
+			body:   `{"name": "ciko", "price": 6, "expectedVersion": 1}`,
+			status: http.StatusConflict,
+			code:   "version_conflict",
+		},
+		{
+			name:    "stale expectedVersion with a current If-Match",
+			body:    `{"name": "ciko", "price": 6, "expectedVersion": 1}`,
+			headers: map[string]string{"If-Match": currentETag},
+			status:  http.StatusConflict,
+			code:    "version_conflict",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			expectStatus(t, serve(updateItem, "POST", "/update-item?id="+created.ID, test.body, test.headers), test.status, &p)
+			if p.Code != test.code || p.CurrentVersion == nil || *p.CurrentVersion != 2 {
+				t.Fatalf("problem %+v, expected %s with the current version 2", p, test.code)
+			}
+		})
+	}
+
+	var p problem
+	expectStatus(t, serve(itemResource, "PATCH", "/items/"+created.ID, `{"price": 6}`, map[string]string{"Content-Type": mergePatchContentType, "If-Match": staleETag}), http.StatusPreconditionFailed, &p)
+
+	var updated Item
+	expectStatus(t, serve(updateItem, "POST", "/update-item?id="+created.ID, `{"name": "ciko", "price": 6, "expectedVersion": 2}`, map[string]string{"If-Match": currentETag}), http.StatusOK, &updated)
+	if updated.Version != 3 || updated.Price != 6 {
+		t.Fatalf("updated %+v, expected version 3", updated)
+	}
+	expectEvents(t, memoryOutbox, created.ID, outbox.EventTypeCreated, outbox.EventTypeUpdated, outbox.EventTypeUpdated)
+}
+
+// TestMemoryModeServesTheItems starts the api the way -store=memory does and
+// creates, gets and lists an item over http.
+func TestMemoryModeServesTheItems(t *testing.T) {
+	useMemoryStore(t)
+	defer func(config outbox.AggregateConfig) { itemAggregateConfig = config }(itemAggregateConfig)
+
+	eventsPath := filepath.Join(t.TempDir(), "events.jsonl")
+	cfg, err := config.Load("api", []string{"-store", "memory", "-events", eventsPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initMemory(initOutbox(cfg.Outbox), cfg.Events)
+
+	mux := http.NewServeMux()
+	routes(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method string, path string, body string, status int, v interface{}) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s answered %d, expected %d", method, path, resp.StatusCode, status)
+		}
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s answered an invalid body: %s", method, path, err)
+		}
+	}
+
+	var created, got Item
+	request("POST", "/create-item", `{"name": "ciko", "price": 4.5, "active": true}`, http.StatusCreated, &created)
+	request("GET", "/get-item?id="+created.ID, "", http.StatusOK, &got)
+	if got.ID != created.ID || got.Name != "ciko" || got.Version != 1 {
+		t.Fatalf("got %+v, expected the created item %s", got, created.ID)
+	}
+
+	var page listItemsResponse
+	request("GET", "/items?active=true", "", http.StatusOK, &page)
+	if len(page.Items) != 1 || page.Items[0].ID != created.ID {
+		t.Fatalf("listed %+v, expected the created item %s", page.Items, created.ID)
+	}
+
+	published, err := os.ReadFile(eventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(published)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], created.ID) {
+		t.Fatalf("published %q, expected the created event of %s", published, created.ID)
+	}
+}
@@ -0,0 +1,267 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCloudEvents = "cloudevents"
+	FormatDebezium    = "debezium"
+)
+
+// timeLayout uses a fixed number of fractional digits so the rendered times
+// sort chronologically as strings.
+const timeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// occurrenceTimeFields are the N1QL paths of the occurrence time in the
+// outbox documents of each format.
+var occurrenceTimeFields = map[string]string{
+	FormatCloudEvents: "`time`",
+	FormatDebezium:    "`source`.`occurrenceTime`",
+}
+
+// aggregateIDFields are the N1QL paths of the aggregate id in the outbox
+// documents of each format.
+var aggregateIDFields = map[string]string{
+	FormatCloudEvents: "`subject`",
+	FormatDebezium:    "`source`.`aggregateId`",
+}
+
+// FormatTime renders t the way the envelopes render the occurrence time, so
+// it can be compared with stored occurrence times as a string.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// OccurrenceTimeField returns the N1QL path of the occurrence time in outbox
+// documents of the given format, relative to the document.
+func OccurrenceTimeField(format string) (string, error) {
+	field, ok := occurrenceTimeFields[format]
+	if !ok {
+		return "", fmt.Errorf("unknown outbox event format %q, expected %s or %s", format, FormatCloudEvents, FormatDebezium)
+	}
+	return field, nil
+}
+
+// AggregateIDField returns the N1QL path of the aggregate id in outbox
+// documents of the given format, relative to the document.
+func AggregateIDField(format string) (string, error) {
+	field, ok := aggregateIDFields[format]
+	if !ok {
+		return "", fmt.Errorf("unknown outbox event format %q, expected %s or %s", format, FormatCloudEvents, FormatDebezium)
+	}
+	return field, nil
+}
+
+// Envelope renders an Event as the JSON document stored in the outbox
+// collection, the connector publishes that document to Kafka as is. Unwrap
+// reverses Wrap for consumers of the published events.
+type Envelope interface {
+	Wrap(event Event) (interface{}, error)
+	Unwrap(raw []byte) (Event, error)
+}
+
+// NewEnvelope returns the envelope for the given format. Source identifies the
+// producing service, e.g. the CloudEvents source attribute.
+func NewEnvelope(format string, source string) (Envelope, error) {
+	switch format {
+	case FormatCloudEvents:
+		return CloudEventsEnvelope{Source: source}, nil
+	case FormatDebezium:
+		return DebeziumEnvelope{Source: source}, nil
+	default:
+		return nil, fmt.Errorf("unknown outbox event format %q, expected %s or %s", format, FormatCloudEvents, FormatDebezium)
+	}
+}
+
+// CloudEventsEnvelope renders events in the CloudEvents 1.0 structured JSON format.
+type CloudEventsEnvelope struct {
+	Source string
+}
+
+type cloudEvent struct {
+	SpecVersion     string         `json:"specversion"`
+	ID              string         `json:"id"`
+	Source          string         `json:"source"`
+	Type            string         `json:"type"`
+	Subject         string         `json:"subject"`
+	Time            string         `json:"time"`
+	DataContentType string         `json:"datacontenttype"`
+	SchemaVersion   string         `json:"schemaversion"`
+	Data            cloudEventData `json:"data"`
+}
+
+type cloudEventData struct {
+	EventID        string                 `json:"eventId"`
+	ID             string                 `json:"id"`
+	Type           string                 `json:"type"`
+	Version        int                    `json:"version"`
+	Sequence       int64                  `json:"sequence"`
+	GlobalSequence uint64                 `json:"globalSequence"`
+	OccurrenceTime string                 `json:"occurrenceTime"`
+	Before         map[string]interface{} `json:"before,omitempty"`
+	After          map[string]interface{} `json:"after,omitempty"`
+	ChangedPaths   []string               `json:"changedPaths,omitempty"`
+}
+
+func (e CloudEventsEnvelope) Wrap(event Event) (interface{}, error) {
+	occurrenceTime := FormatTime(event.OccurrenceTime)
+
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              event.ID,
+		Source:          e.Source,
+		Type:            event.AggregateType + "." + strings.ToLower(event.Type),
+		Subject:         event.AggregateID,
+		Time:            occurrenceTime,
+		DataContentType: "application/json",
+		SchemaVersion:   strconv.Itoa(event.SchemaVersion),
+		Data: cloudEventData{
+			EventID:        event.ID,
+			ID:             event.AggregateID,
+			Type:           event.Type,
+			Version:        event.Version,
+			Sequence:       event.Sequence,
+			GlobalSequence: event.GlobalSequence,
+			OccurrenceTime: occurrenceTime,
+			Before:         event.Before,
+			After:          event.After,
+			ChangedPaths:   event.ChangedPaths,
+		},
+	}, nil
+}
+
+func (e CloudEventsEnvelope) Unwrap(raw []byte) (Event, error) {
+	var ce cloudEvent
+	if err := json.Unmarshal(raw, &ce); err != nil {
+		return Event{}, err
+	}
+	if ce.SpecVersion != "1.0" || ce.ID == "" {
+		return Event{}, fmt.Errorf("not a CloudEvents 1.0 outbox event")
+	}
+
+	occurrenceTime, err := time.Parse(time.RFC3339Nano, ce.Time)
+	if err != nil {
+		return Event{}, err
+	}
+
+	schemaVersion, err := strconv.Atoi(ce.SchemaVersion)
+	if err != nil {
+		return Event{}, err
+	}
+
+	aggregateType := ce.Type
+	if i := strings.LastIndex(aggregateType, "."); i >= 0 {
+		aggregateType = aggregateType[:i]
+	}
+
+	return Event{
+		ID:             ce.ID,
+		AggregateType:  aggregateType,
+		AggregateID:    ce.Subject,
+		Type:           ce.Data.Type,
+		Version:        ce.Data.Version,
+		SchemaVersion:  schemaVersion,
+		OccurrenceTime: occurrenceTime,
+		Sequence:       ce.Data.Sequence,
+		GlobalSequence: ce.Data.GlobalSequence,
+		Before:         ce.Data.Before,
+		After:          ce.Data.After,
+		ChangedPaths:   ce.Data.ChangedPaths,
+	}, nil
+}
+
+// DebeziumEnvelope renders events in a Debezium like change event format with
+// before/after images, an operation code and a source block.
+type DebeziumEnvelope struct {
+	Source string
+}
+
+type debeziumEvent struct {
+	EventID string                 `json:"eventId"`
+	Before  map[string]interface{} `json:"before"`
+	After   map[string]interface{} `json:"after"`
+	Op      string                 `json:"op"`
+	TsMs    int64                  `json:"ts_ms"`
+	Source  debeziumSource         `json:"source"`
+}
+
+type debeziumSource struct {
+	Name           string   `json:"name"`
+	AggregateType  string   `json:"aggregateType"`
+	AggregateID    string   `json:"aggregateId"`
+	EventType      string   `json:"eventType"`
+	Version        int      `json:"version"`
+	SchemaVersion  int      `json:"schemaVersion"`
+	Sequence       int64    `json:"sequence"`
+	GlobalSequence uint64   `json:"globalSequence"`
+	OccurrenceTime string   `json:"occurrenceTime"`
+	ChangedPaths   []string `json:"changedPaths,omitempty"`
+}
+
+var debeziumOps = map[string]string{
+	EventTypeCreated: "c",
+	EventTypeUpdated: "u",
+	EventTypeDeleted: "d",
+}
+
+func (e DebeziumEnvelope) Wrap(event Event) (interface{}, error) {
+	op, ok := debeziumOps[event.Type]
+	if !ok {
+		return nil, fmt.Errorf("event type %q has no debezium operation", event.Type)
+	}
+
+	return debeziumEvent{
+		EventID: event.ID,
+		Before:  event.Before,
+		After:   event.After,
+		Op:      op,
+		TsMs:    event.OccurrenceTime.UnixMilli(),
+		Source: debeziumSource{
+			Name:           e.Source,
+			AggregateType:  event.AggregateType,
+			AggregateID:    event.AggregateID,
+			EventType:      event.Type,
+			Version:        event.Version,
+			SchemaVersion:  event.SchemaVersion,
+			Sequence:       event.Sequence,
+			GlobalSequence: event.GlobalSequence,
+			OccurrenceTime: FormatTime(event.OccurrenceTime),
+			ChangedPaths:   event.ChangedPaths,
+		},
+	}, nil
+}
+
+func (e DebeziumEnvelope) Unwrap(raw []byte) (Event, error) {
+	var dbzEvent debeziumEvent
+	if err := json.Unmarshal(raw, &dbzEvent); err != nil {
+		return Event{}, err
+	}
+	if dbzEvent.EventID == "" || dbzEvent.Op == "" {
+		return Event{}, fmt.Errorf("not a debezium outbox event")
+	}
+
+	occurrenceTime, err := time.Parse(time.RFC3339Nano, dbzEvent.Source.OccurrenceTime)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:             dbzEvent.EventID,
+		AggregateType:  dbzEvent.Source.AggregateType,
+		AggregateID:    dbzEvent.Source.AggregateID,
+		Type:           dbzEvent.Source.EventType,
+		Version:        dbzEvent.Source.Version,
+		SchemaVersion:  dbzEvent.Source.SchemaVersion,
+		OccurrenceTime: occurrenceTime,
+		Sequence:       dbzEvent.Source.Sequence,
+		GlobalSequence: dbzEvent.Source.GlobalSequence,
+		Before:         dbzEvent.Before,
+		After:          dbzEvent.After,
+		ChangedPaths:   dbzEvent.Source.ChangedPaths,
+	}, nil
+}
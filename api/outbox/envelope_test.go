@@ -0,0 +1,139 @@
+package outbox
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testEvent(eventType string, before map[string]interface{}, after map[string]interface{}, changedPaths []string) Event {
+	return Event{
+		ID:             "event-1",
+		AggregateType:  "item",
+		AggregateID:    "item-1",
+		Type:           eventType,
+		Version:        2,
+		SchemaVersion:  1,
+		OccurrenceTime: time.Date(2026, 10, 17, 8, 30, 0, 120000000, time.UTC),
+		Sequence:       3,
+		GlobalSequence: 42,
+		Before:         before,
+		After:          after,
+		ChangedPaths:   changedPaths,
+	}
+}
+
+func TestEnvelopesRoundTrip(t *testing.T) {
+	snapshot := func(price float64) map[string]interface{} {
+		return map[string]interface{}{"id": "item-1", "name": "ciko", "price": price}
+	}
+	events := map[string]Event{
+		"created": testEvent(EventTypeCreated, nil, snapshot(4.5), nil),
+		"updated": testEvent(EventTypeUpdated, snapshot(4.5), snapshot(5), []string{"/price"}),
+		"deleted": testEvent(EventTypeDeleted, snapshot(5), nil, nil),
+	}
+
+	for _, format := range []string{FormatCloudEvents, FormatDebezium} {
+		envelope, err := NewEnvelope(format, "/api/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, event := range events {
+			t.Run(format+" "+name, func(t *testing.T) {
+				wrapped, err := envelope.Wrap(event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, err := json.Marshal(wrapped)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				unwrapped, err := envelope.Unwrap(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(unwrapped, event) {
+					t.Fatalf("unwrapped %+v, expected %+v", unwrapped, event)
+				}
+
+				// the relay decodes whatever the api wrote the same way.
+				decoded, err := DecodeRecord(envelope, raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(decoded) != 1 || !reflect.DeepEqual(decoded[0], event) {
+					t.Fatalf("decoded %+v, expected the event", decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestEnvelopesRenderTheirFormat(t *testing.T) {
+	event := testEvent(EventTypeUpdated, map[string]interface{}{"price": 4.5}, map[string]interface{}{"price": 5.0}, []string{"/price"})
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: FormatCloudEvents,
+			expected: `{"specversion":"1.0","id":"event-1","source":"/api/test","type":"item.updated","subject":"item-1",` +
+				`"time":"2026-10-17T08:30:00.120000000Z","datacontenttype":"application/json","schemaversion":"1",` +
+				`"data":{"eventId":"event-1","id":"item-1","type":"UPDATED","version":2,"sequence":3,"globalSequence":42,` +
+				`"occurrenceTime":"2026-10-17T08:30:00.120000000Z","before":{"price":4.5},"after":{"price":5},"changedPaths":["/price"]}}`,
+		},
+		{
+			format: FormatDebezium,
+			expected: `{"eventId":"event-1","before":{"price":4.5},"after":{"price":5},"op":"u","ts_ms":1792225800120,` +
+				`"source":{"name":"/api/test","aggregateType":"item","aggregateId":"item-1","eventType":"UPDATED","version":2,` +
+				`"schemaVersion":1,"sequence":3,"globalSequence":42,"occurrenceTime":"2026-10-17T08:30:00.120000000Z","changedPaths":["/price"]}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			envelope, err := NewEnvelope(test.format, "/api/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wrapped, err := envelope.Wrap(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := json.Marshal(wrapped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != test.expected {
+				t.Fatalf("rendered %s, expected %s", raw, test.expected)
+			}
+		})
+	}
+}
+
+func TestEnvelopesRejectOtherFormats(t *testing.T) {
+	event := testEvent(EventTypeCreated, nil, map[string]interface{}{"id": "item-1"}, nil)
+	cloudEvents, _ := NewEnvelope(FormatCloudEvents, "")
+	debezium, _ := NewEnvelope(FormatDebezium, "")
+
+	wrapped, _ := cloudEvents.Wrap(event)
+	cloudEvent, _ := json.Marshal(wrapped)
+	wrapped, _ = debezium.Wrap(event)
+	debeziumEvent, _ := json.Marshal(wrapped)
+
+	if _, err := debezium.Unwrap(cloudEvent); err == nil {
+		t.Fatal("the debezium envelope unwrapped a CloudEvent")
+	}
+	if _, err := cloudEvents.Unwrap(debeziumEvent); err == nil {
+		t.Fatal("the CloudEvents envelope unwrapped a debezium event")
+	}
+	if _, err := debezium.Wrap(testEvent("ARCHIVED", nil, nil, nil)); err == nil {
+		t.Fatal("the debezium envelope wrapped an event type without an operation")
+	}
+	if _, err := NewEnvelope("avro", ""); err == nil {
+		t.Fatal("created an envelope of an unknown format")
+	}
+}
@@ -0,0 +1,41 @@
+// Package outbox describes the events written to the outbox collection and
+// the envelopes they are published in.
+package outbox
+
+import "time"
+
+const (
+	EventTypeCreated = "CREATED"
+	EventTypeUpdated = "UPDATED"
+	EventTypeDeleted = "DELETED"
+)
+
+// Event is the format independent description of a change to an aggregate.
+// An Envelope turns it into the document stored in the outbox collection.
+type Event struct {
+	// ID is the key of the outbox document, it is repeated inside the
+	// payload as eventId.
+	ID             string
+	AggregateType  string
+	AggregateID    string
+	Type           string
+	Version        int
+	SchemaVersion  int
+	OccurrenceTime time.Time
+
+	// Sequence numbers every event of an aggregate, starting at 1 without
+	// gaps. Unlike Version it also advances on create and delete.
+	Sequence int64
+	// GlobalSequence is allocated from a counter shared by all aggregates.
+	// It increases with every event but may have gaps, since a value taken
+	// by an aborted transaction is never reused.
+	GlobalSequence uint64
+
+	// Before and After are the snapshots of the aggregate around the change,
+	// Before is nil for created and After is nil for deleted aggregates.
+	Before map[string]interface{}
+	After  map[string]interface{}
+
+	// ChangedPaths lists the JSON pointers that differ between the two.
+	ChangedPaths []string
+}
@@ -0,0 +1,36 @@
+package outbox
+
+import "encoding/json"
+
+// AggregateDocument is the outbox document of the aggregate mode, holding the
+// latest events of one aggregate in the order they happened.
+type AggregateDocument struct {
+	AggregateType string            `json:"aggregateType"`
+	AggregateID   string            `json:"aggregateId"`
+	Events        []json.RawMessage `json:"events"`
+}
+
+// DecodeRecord decodes an outbox document as published to Kafka. A document
+// of the event mode yields one event, an AggregateDocument yields all events
+// it holds, including the ones already published with earlier versions of it.
+func DecodeRecord(envelope Envelope, raw []byte) ([]Event, error) {
+	var aggregateDoc AggregateDocument
+	if err := json.Unmarshal(raw, &aggregateDoc); err == nil && aggregateDoc.Events != nil {
+		events := make([]Event, 0, len(aggregateDoc.Events))
+		for _, rawEvent := range aggregateDoc.Events {
+			event, err := envelope.Unwrap(rawEvent)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		return events, nil
+	}
+
+	event, err := envelope.Unwrap(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Event{event}, nil
+}
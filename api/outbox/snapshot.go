@@ -0,0 +1,94 @@
+package outbox
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// AggregateConfig controls how the state of one aggregate type is embedded in
+// its events.
+type AggregateConfig struct {
+	// ExcludedFields are top level fields left out of the before/after
+	// snapshots, e.g. large descriptions consumers can fetch on demand.
+	// Changes to them are still listed in ChangedPaths.
+	ExcludedFields []string
+}
+
+// Snapshot returns the JSON form of the aggregate without the excluded fields.
+func (c AggregateConfig) Snapshot(aggregate interface{}) (map[string]interface{}, error) {
+	snapshot, err := toJSONObject(aggregate)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range c.ExcludedFields {
+		delete(snapshot, field)
+	}
+
+	return snapshot, nil
+}
+
+// ChangedPaths returns the JSON pointers of every leaf that differs between
+// the JSON forms of before and after, sorted so events are stable.
+func ChangedPaths(before interface{}, after interface{}) ([]string, error) {
+	beforeObject, err := toJSONObject(before)
+	if err != nil {
+		return nil, err
+	}
+
+	afterObject, err := toJSONObject(after)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffPaths(beforeObject, afterObject), nil
+}
+
+// DiffPaths is ChangedPaths for values that already are decoded JSON.
+func DiffPaths(before interface{}, after interface{}) []string {
+	paths := []string{}
+	collectChangedPaths("", before, after, &paths)
+	sort.Strings(paths)
+	return paths
+}
+
+func collectChangedPaths(prefix string, before interface{}, after interface{}, paths *[]string) {
+	beforeObject, beforeIsObject := before.(map[string]interface{})
+	afterObject, afterIsObject := after.(map[string]interface{})
+	if !beforeIsObject || !afterIsObject {
+		if !reflect.DeepEqual(before, after) {
+			*paths = append(*paths, prefix)
+		}
+		return
+	}
+
+	for name, value := range beforeObject {
+		collectChangedPaths(prefix+"/"+escapePointerToken(name), value, afterObject[name], paths)
+	}
+	for name, value := range afterObject {
+		if _, ok := beforeObject[name]; !ok {
+			collectChangedPaths(prefix+"/"+escapePointerToken(name), nil, value, paths)
+		}
+	}
+}
+
+func escapePointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	err = json.Unmarshal(raw, &object)
+	return object, err
+}
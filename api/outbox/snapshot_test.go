@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotLeavesOutTheExcludedFields(t *testing.T) {
+	aggregate := struct {
+		ID          string `json:"id"`
+		Description string `json:"description"`
+		Price       float64
+	}{"item-1", "a cat", 4.5}
+
+	snapshot, err := AggregateConfig{ExcludedFields: []string{"description", "missing"}}.Snapshot(aggregate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"id": "item-1", "Price": 4.5}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Fatalf("snapshot is %v, expected %v", snapshot, expected)
+	}
+
+	if snapshot, err = (AggregateConfig{}).Snapshot(nil); err != nil || snapshot != nil {
+		t.Fatalf("snapshot of nothing is %v, %v", snapshot, err)
+	}
+}
+
+func TestDiffPaths(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after interface{}
+		expected      []string
+	}{
+		{"equal", map[string]interface{}{"a": 1.0}, map[string]interface{}{"a": 1.0}, []string{}},
+		{"changed leaf", map[string]interface{}{"a": 1.0, "b": "x"}, map[string]interface{}{"a": 2.0, "b": "x"}, []string{"/a"}},
+		{"added and removed", map[string]interface{}{"a": 1.0}, map[string]interface{}{"b": 1.0}, []string{"/a", "/b"}},
+		{"nested", map[string]interface{}{"a": map[string]interface{}{"b": 1.0, "c": 1.0}}, map[string]interface{}{"a": map[string]interface{}{"b": 2.0, "c": 1.0}}, []string{"/a/b"}},
+		{"object replaced by a value", map[string]interface{}{"a": map[string]interface{}{"b": 1.0}}, map[string]interface{}{"a": 1.0}, []string{"/a"}},
+		{"array", map[string]interface{}{"a": []interface{}{1.0}}, map[string]interface{}{"a": []interface{}{1.0, 2.0}}, []string{"/a"}},
+		{"escaped names", map[string]interface{}{"a/b": 1.0, "c~d": 1.0}, map[string]interface{}{"a/b": 2.0, "c~d": 2.0}, []string{"/a~1b", "/c~0d"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if paths := DiffPaths(test.before, test.after); !reflect.DeepEqual(paths, test.expected) {
+				t.Fatalf("changed paths are %v, expected %v", paths, test.expected)
+			}
+		})
+	}
+}
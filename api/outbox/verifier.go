@@ -0,0 +1,147 @@
+package outbox
+
+import (
+	"fmt"
+	"sort"
+)
+
+type FindingKind string
+
+const (
+	// FindingGap is a sequence number that has not been seen while later
+	// ones of the same aggregate have.
+	FindingGap FindingKind = "GAP"
+	// FindingReordered is an event that arrived after a later event of the
+	// same aggregate.
+	FindingReordered FindingKind = "REORDERED"
+	// FindingDuplicate is an event with a sequence number that was already seen.
+	FindingDuplicate FindingKind = "DUPLICATE"
+	// FindingGlobalReordered is an event whose global sequence is lower than
+	// the one of an earlier event of the same aggregate.
+	FindingGlobalReordered FindingKind = "GLOBAL_REORDERED"
+)
+
+// Finding is an anomaly detected by the Verifier.
+type Finding struct {
+	Kind          FindingKind `json:"kind"`
+	AggregateType string      `json:"aggregateType"`
+	AggregateID   string      `json:"aggregateId"`
+	EventID       string      `json:"eventId,omitempty"`
+	Sequence      int64       `json:"sequence"`
+	// Expected is the sequence number the aggregate was waiting for.
+	Expected int64 `json:"expected,omitempty"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s/%s sequence %d (expected %d) event %s", f.Kind, f.AggregateType, f.AggregateID, f.Sequence, f.Expected, f.EventID)
+}
+
+type aggregateKey struct {
+	aggregateType string
+	aggregateID   string
+}
+
+type aggregateProgress struct {
+	lastSequence       int64
+	lastGlobalSequence uint64
+	missing            map[int64]bool
+}
+
+// Verifier checks a stream of events for gaps and reorderings of the per
+// aggregate sequence numbers, without relying on the item version.
+//
+// The first event of an aggregate sets its baseline unless FromStart is set,
+// in which case every aggregate is expected to start at sequence 1. Events are
+// only compared with events of the same aggregate, Kafka gives no order
+// across keys.
+type Verifier struct {
+	FromStart bool
+
+	aggregates map[aggregateKey]*aggregateProgress
+}
+
+func NewVerifier(fromStart bool) *Verifier {
+	return &Verifier{
+		FromStart:  fromStart,
+		aggregates: map[aggregateKey]*aggregateProgress{},
+	}
+}
+
+// Observe records the event and returns what is wrong with it, if anything.
+// Gaps are not reported here since a missing event may still arrive late, see
+// Gaps.
+func (v *Verifier) Observe(event Event) []Finding {
+	key := aggregateKey{aggregateType: event.AggregateType, aggregateID: event.AggregateID}
+	progress, ok := v.aggregates[key]
+	if !ok {
+		progress = &aggregateProgress{missing: map[int64]bool{}}
+		if !v.FromStart {
+			progress.lastSequence = event.Sequence - 1
+		}
+		v.aggregates[key] = progress
+	}
+
+	finding := Finding{
+		AggregateType: event.AggregateType,
+		AggregateID:   event.AggregateID,
+		EventID:       event.ID,
+		Sequence:      event.Sequence,
+		Expected:      progress.lastSequence + 1,
+	}
+
+	var findings []Finding
+	switch {
+	case event.Sequence > progress.lastSequence:
+		for missing := progress.lastSequence + 1; missing < event.Sequence; missing++ {
+			progress.missing[missing] = true
+		}
+		progress.lastSequence = event.Sequence
+	case progress.missing[event.Sequence]:
+		delete(progress.missing, event.Sequence)
+		finding.Kind = FindingReordered
+		findings = append(findings, finding)
+	default:
+		// a duplicate says nothing about the global order, it has been
+		// checked when the event was first seen.
+		finding.Kind = FindingDuplicate
+		return append(findings, finding)
+	}
+
+	if event.GlobalSequence < progress.lastGlobalSequence {
+		finding.Kind = FindingGlobalReordered
+		findings = append(findings, finding)
+	} else {
+		progress.lastGlobalSequence = event.GlobalSequence
+	}
+
+	return findings
+}
+
+// Gaps returns the sequence numbers that are still missing, ordered by
+// aggregate and sequence.
+func (v *Verifier) Gaps() []Finding {
+	var gaps []Finding
+	for key, progress := range v.aggregates {
+		for sequence := range progress.missing {
+			gaps = append(gaps, Finding{
+				Kind:          FindingGap,
+				AggregateType: key.aggregateType,
+				AggregateID:   key.aggregateID,
+				Sequence:      sequence,
+				Expected:      sequence,
+			})
+		}
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		if gaps[i].AggregateType != gaps[j].AggregateType {
+			return gaps[i].AggregateType < gaps[j].AggregateType
+		}
+		if gaps[i].AggregateID != gaps[j].AggregateID {
+			return gaps[i].AggregateID < gaps[j].AggregateID
+		}
+		return gaps[i].Sequence < gaps[j].Sequence
+	})
+
+	return gaps
+}
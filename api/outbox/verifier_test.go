@@ -0,0 +1,96 @@
+package outbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+type observed struct {
+	aggregateID    string
+	sequence       int64
+	globalSequence uint64
+}
+
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		name      string
+		fromStart bool
+		events    []observed
+		// findings lists the kinds Observe returned for each event.
+		findings [][]FindingKind
+		gaps     []int64
+	}{
+		{
+			name:     "in order",
+			events:   []observed{{"a", 1, 1}, {"a", 2, 2}, {"b", 1, 3}, {"a", 3, 4}},
+			findings: [][]FindingKind{nil, nil, nil, nil},
+		},
+		{
+			name:     "first event sets the baseline",
+			events:   []observed{{"a", 5, 1}, {"a", 6, 2}},
+			findings: [][]FindingKind{nil, nil},
+		},
+		{
+			name:      "from start every aggregate starts at 1",
+			fromStart: true,
+			events:    []observed{{"a", 3, 1}},
+			findings:  [][]FindingKind{nil},
+			gaps:      []int64{1, 2},
+		},
+		{
+			name:     "gap that is never filled",
+			events:   []observed{{"a", 1, 1}, {"a", 3, 3}},
+			findings: [][]FindingKind{nil, nil},
+			gaps:     []int64{2},
+		},
+		{
+			name:     "late event closes the gap",
+			events:   []observed{{"a", 1, 1}, {"a", 3, 3}, {"a", 2, 2}},
+			findings: [][]FindingKind{nil, nil, {FindingReordered, FindingGlobalReordered}},
+		},
+		{
+			name:     "duplicate",
+			events:   []observed{{"a", 1, 1}, {"a", 2, 2}, {"a", 2, 2}},
+			findings: [][]FindingKind{nil, nil, {FindingDuplicate}},
+		},
+		{
+			name:     "global sequence going back",
+			events:   []observed{{"a", 1, 5}, {"a", 2, 4}},
+			findings: [][]FindingKind{nil, {FindingGlobalReordered}},
+		},
+		{
+			name:     "global sequences are only compared within an aggregate",
+			events:   []observed{{"a", 1, 5}, {"b", 1, 4}},
+			findings: [][]FindingKind{nil, nil},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := NewVerifier(test.fromStart)
+
+			for i, e := range test.events {
+				event := Event{ID: "event", AggregateType: "item", AggregateID: e.aggregateID, Sequence: e.sequence, GlobalSequence: e.globalSequence}
+
+				var kinds []FindingKind
+				for _, finding := range verifier.Observe(event) {
+					kinds = append(kinds, finding.Kind)
+				}
+				if !reflect.DeepEqual(kinds, test.findings[i]) {
+					t.Fatalf("event %d found %v, expected %v", i, kinds, test.findings[i])
+				}
+			}
+
+			var gaps []int64
+			for _, gap := range verifier.Gaps() {
+				if gap.Kind != FindingGap {
+					t.Fatalf("gap of kind %s", gap.Kind)
+				}
+				gaps = append(gaps, gap.Sequence)
+			}
+			if !reflect.DeepEqual(gaps, test.gaps) {
+				t.Fatalf("gaps %v, expected %v", gaps, test.gaps)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// itemPatch is a parsed PATCH body that can be applied to the JSON form of an item.
+type itemPatch interface {
+	apply(doc interface{}) (interface{}, error)
+}
+
+// patchError is returned when a well formed patch cannot be applied to the
+// current document, e.g. a path does not exist or a test operation fails.
+type patchError struct {
+	msg string
+}
+
+func (e *patchError) Error() string {
+	return e.msg
+}
+
+func patchErrorf(format string, args ...interface{}) error {
+	return &patchError{msg: fmt.Sprintf(format, args...)}
+}
+
+func parseItemPatch(contentType string, body []byte) (itemPatch, error) {
+	switch contentType {
+	case mergePatchContentType:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, err
+		}
+		return mergePatch{patch: patch}, nil
+	case jsonPatchContentType:
+		var ops []jsonPatchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, err
+		}
+		for i, op := range ops {
+			if err := op.validate(); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+		}
+		return jsonPatch(ops), nil
+	default:
+		return nil, fmt.Errorf("unsupported patch content type %q", contentType)
+	}
+}
+
+// mergePatch implements RFC 7396 JSON Merge Patch.
+type mergePatch struct {
+	patch interface{}
+}
+
+func (p mergePatch) apply(doc interface{}) (interface{}, error) {
+	return applyMergePatch(doc, p.patch), nil
+}
+
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = applyMergePatch(targetObject[name], value)
+	}
+
+	return targetObject
+}
+
+// jsonPatch implements RFC 6902 JSON Patch.
+type jsonPatch []jsonPatchOperation
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (op jsonPatchOperation) validate() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("%s requires a value", op.Op)
+		}
+	case "remove":
+	case "move", "copy":
+		if _, err := parseJSONPointer(op.From); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+
+	_, err := parseJSONPointer(op.Path)
+	return err
+}
+
+func (p jsonPatch) apply(doc interface{}) (interface{}, error) {
+	var err error
+	for i, op := range p {
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, patchErrorf("operation %d (%s %s): %s", i, op.Op, op.Path, err.Error())
+		}
+	}
+
+	return doc, nil
+}
+
+func (op jsonPatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, _ := parseJSONPointer(op.Path)
+
+	switch op.Op {
+	case "add":
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move":
+		from, _ := parseJSONPointer(op.From)
+		if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+			return nil, fmt.Errorf("cannot move a value into one of its children")
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "copy":
+		from, _ := parseJSONPointer(op.From)
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopyJSON(value))
+	case "test":
+		var expected interface{}
+		if err := json.Unmarshal(op.Value, &expected); err != nil {
+			return nil, err
+		}
+		actual, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	}
+
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parseJSONPointer splits an RFC 6901 pointer into its unescaped reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func formatJSONPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path %s does not exist", formatJSONPointer(path))
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("path %s does not exist", formatJSONPointer(path))
+		}
+	}
+
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index := len(node)
+		if last != "-" {
+			if index, err = arrayIndex(last, len(node)); err != nil {
+				return nil, err
+			}
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return replaceParent(doc, path[:len(path)-1], node)
+	default:
+		return nil, fmt.Errorf("path %s does not exist", formatJSONPointer(path))
+	}
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %s does not exist", formatJSONPointer(path))
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = replaceParent(doc, path[:len(path)-1], node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("path %s does not exist", formatJSONPointer(path))
+	}
+}
+
+// replaceParent stores a resized array back at path, since appending may
+// have moved it.
+func replaceParent(doc interface{}, path []string, array []interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return array, nil
+	}
+
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = array
+	case []interface{}:
+		index, _ := arrayIndex(last, len(node)-1)
+		node[index] = array
+	}
+
+	return doc, nil
+}
+
+func arrayIndex(token string, upper int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > upper {
+		return 0, fmt.Errorf("array index %d out of bounds", index)
+	}
+	return index, nil
+}
+
+func deepCopyJSON(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(node))
+		for k, v := range node {
+			c[k] = deepCopyJSON(v)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(node))
+		for i, v := range node {
+			c[i] = deepCopyJSON(v)
+		}
+		return c
+	default:
+		return value
+	}
+}
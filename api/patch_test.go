@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+func decodeJSON(t *testing.T, raw string) interface{} {
+	t.Helper()
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("invalid test JSON %s: %s", raw, err)
+	}
+	return value
+}
+
+func TestMergePatch(t *testing.T) {
+	// the examples of RFC 7396 appendix A.
+	tests := []struct{ target, patch, expected string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		patch, err := parseItemPatch(mergePatchContentType, []byte(test.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := patch.apply(decodeJSON(t, test.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := decodeJSON(t, test.expected); !reflect.DeepEqual(patched, expected) {
+			t.Fatalf("%s patched with %s is %v, expected %v", test.target, test.patch, patched, expected)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		patch    string
+		expected string
+		// failure is part of the error when the patch cannot be applied.
+		failure string
+	}{
+		{
+			name:     "add a member",
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz","value":"qux"}]`,
+			expected: `{"foo":"bar","baz":"qux"}`,
+		},
+		{
+			name:     "add an array element",
+			doc:      `{"foo":["bar","baz"]}`,
+			patch:    `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			expected: `{"foo":["bar","qux","baz"]}`,
+		},
+		{
+			name:     "append to an array",
+			doc:      `{"foo":["bar"]}`,
+			patch:    `[{"op":"add","path":"/foo/-","value":["abc"]}]`,
+			expected: `{"foo":["bar",["abc"]]}`,
+		},
+		{
+			name:     "remove an array element",
+			doc:      `{"foo":["bar","qux","baz"]}`,
+			patch:    `[{"op":"remove","path":"/foo/1"}]`,
+			expected: `{"foo":["bar","baz"]}`,
+		},
+		{
+			name:     "replace a value",
+			doc:      `{"baz":"qux","foo":"bar"}`,
+			patch:    `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			expected: `{"baz":"boo","foo":"bar"}`,
+		},
+		{
+			name:     "move a value",
+			doc:      `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch:    `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{
+			name:     "move an array element",
+			doc:      `{"foo":["all","grass","cows","eat"]}`,
+			patch:    `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			expected: `{"foo":["all","cows","eat","grass"]}`,
+		},
+		{
+			name:     "copy a value",
+			doc:      `{"foo":{"bar":[1]}}`,
+			patch:    `[{"op":"copy","from":"/foo/bar","path":"/baz"},{"op":"add","path":"/baz/-","value":2}]`,
+			expected: `{"foo":{"bar":[1]},"baz":[1,2]}`,
+		},
+		{
+			name:     "test passes",
+			doc:      `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch:    `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			expected: `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{
+			name:     "escaped pointer",
+			doc:      `{"a/b":1,"m~n":2}`,
+			patch:    `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`,
+			expected: `{"a/b":3}`,
+		},
+		{
+			name:    "test fails",
+			doc:     `{"baz":"qux"}`,
+			patch:   `[{"op":"test","path":"/baz","value":"bar"}]`,
+			failure: "test failed",
+		},
+		{
+			name:    "remove a missing member",
+			doc:     `{"foo":"bar"}`,
+			patch:   `[{"op":"remove","path":"/baz"}]`,
+			failure: "path /baz does not exist",
+		},
+		{
+			name:    "add to a missing parent",
+			doc:     `{"foo":"bar"}`,
+			patch:   `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			failure: "path /baz does not exist",
+		},
+		{
+			name:    "array index out of bounds",
+			doc:     `{"foo":["bar"]}`,
+			patch:   `[{"op":"add","path":"/foo/2","value":"qux"}]`,
+			failure: "out of bounds",
+		},
+		{
+			name:    "leading zero array index",
+			doc:     `{"foo":["bar","baz"]}`,
+			patch:   `[{"op":"remove","path":"/foo/01"}]`,
+			failure: "invalid array index",
+		},
+		{
+			name:    "move into a child",
+			doc:     `{"foo":{"bar":1}}`,
+			patch:   `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`,
+			failure: "into one of its children",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := parseItemPatch(jsonPatchContentType, []byte(test.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			doc := decodeJSON(t, test.doc)
+			patched, err := patch.apply(doc)
+			if test.failure != "" {
+				var patchErr *patchError
+				if !errors.As(err, &patchErr) || !strings.Contains(err.Error(), test.failure) {
+					t.Fatalf("applying returned %v, expected a patch error with %q", err, test.failure)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := decodeJSON(t, test.expected); !reflect.DeepEqual(patched, expected) {
+				t.Fatalf("patched to %v, expected %v", patched, expected)
+			}
+		})
+	}
+}
+
+func TestParseItemPatchRejectsInvalidPatches(t *testing.T) {
+	tests := []struct{ contentType, body string }{
+		{mergePatchContentType, `{"name":`},
+		{jsonPatchContentType, `{"op":"add"}`},
+		{jsonPatchContentType, `[{"op":"append","path":"/name","value":"x"}]`},
+		{jsonPatchContentType, `[{"op":"add","path":"/name"}]`},
+		{jsonPatchContentType, `[{"op":"remove","path":"name"}]`},
+		{jsonPatchContentType, `[{"op":"copy","from":"name","path":"/name"}]`},
+		{"application/json", `{}`},
+	}
+
+	for _, test := range tests {
+		if _, err := parseItemPatch(test.contentType, []byte(test.body)); err == nil {
+			t.Fatalf("parsed %s %s, expected an error", test.contentType, test.body)
+		}
+	}
+}
+
+func TestPatchedItem(t *testing.T) {
+	item := Item{ID: "1", Version: 2, Sequence: 3, Name: "pen", Price: 10, Active: true, OccurrenceTime: time.Now().UTC()}
+	doc, err := itemDocument(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		patch   string
+		invalid string
+	}{
+		{name: "client fields", patch: `{"name":"pencil","price":5,"description":"grey"}`},
+		{name: "read-only field", patch: `{"version":7}`, invalid: "/version is read-only"},
+		{name: "unknown field", patch: `{"colour":"red"}`, invalid: "invalid item"},
+		{name: "invalid value", patch: `{"name":"","price":-1}`, invalid: "name is required; price must not be negative"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := parseItemPatch(mergePatchContentType, []byte(test.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.apply(deepCopyJSON(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patchedItem, err := patchedItem(patched, outbox.DiffPaths(doc, patched))
+			if test.invalid != "" {
+				var invalid *validationError
+				if !errors.As(err, &invalid) || !strings.Contains(err.Error(), test.invalid) {
+					t.Fatalf("returned %v, expected a validation error with %q", err, test.invalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patchedItem.Name != "pencil" || patchedItem.Price != 5 || patchedItem.Description != "grey" || patchedItem.Version != item.Version {
+				t.Fatalf("patched to %+v", patchedItem)
+			}
+		})
+	}
+
+	if doc["name"] != "pen" {
+		t.Fatal("patching changed the stored document")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// listSortFields are the accepted sort parameters.
+var listSortFields = map[string]bool{
+	"name":           true,
+	"price":          true,
+	"occurrenceTime": true,
+}
+
+// listCursor is the keyset position after the last item of a page.
+type listCursor struct {
+	Sort  string      `json:"s"`
+	Order string      `json:"o"`
+	Value interface{} `json:"v"`
+	ID    string      `json:"id"`
+}
+
+func (c listCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var cursor listCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+
+	err = json.Unmarshal(raw, &cursor)
+	return cursor, err
+}
+
+// listQuery is the repository query for one page of items.
+type listQuery struct {
+	query repository.ItemQuery
+	limit int
+	sort  string
+	order string
+}
+
+type listItemsResponse struct {
+	Items      []Item `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+func listItems(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		query, errs := buildListQuery(req)
+		if len(errs) > 0 {
+			writeError(w, &validationError{errs: errs})
+			return
+		}
+
+		consistentWith, err := consistencyState(req)
+		if err != nil {
+			writeError(w, &validationError{errs: []string{"consistency token is invalid"}})
+			return
+		}
+
+		query.query.ConsistentWith = consistentWith
+		listed, err := items.List(query.query)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		response := listItemsResponse{Items: listed}
+
+		// one extra row is fetched to learn whether there is another page.
+		if len(response.Items) > query.limit {
+			response.Items = response.Items[:query.limit]
+			last := response.Items[query.limit-1]
+			response.NextCursor = listCursor{
+				Sort:  query.sort,
+				Order: query.order,
+				Value: sortValue(last, query.sort),
+				ID:    last.ID,
+			}.encode()
+		}
+
+		w.WriteHeader(http.StatusOK)
+		body, _ := json.Marshal(response)
+		w.Write(body)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// buildListQuery turns the query string into a repository query.
+func buildListQuery(req *http.Request) (listQuery, []string) {
+	query := req.URL.Query()
+	var itemQuery repository.ItemQuery
+	var errs []string
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "occurrenceTime"
+	}
+	if !listSortFields[sort] {
+		errs = append(errs, "sort must be one of name, price, occurrenceTime")
+	}
+
+	order := strings.ToLower(query.Get("order"))
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		errs = append(errs, "order must be asc or desc")
+	}
+
+	limit := defaultListLimit
+	if s := query.Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 || l > maxListLimit {
+			errs = append(errs, "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+		}
+		limit = l
+	}
+
+	if s := query.Get("active"); s != "" {
+		active, err := strconv.ParseBool(s)
+		if err != nil {
+			errs = append(errs, "active must be true or false")
+		}
+		itemQuery.Active = &active
+	}
+
+	for _, bound := range []struct {
+		param string
+		value **float64
+	}{{"minPrice", &itemQuery.MinPrice}, {"maxPrice", &itemQuery.MaxPrice}} {
+		s := query.Get(bound.param)
+		if s == "" {
+			continue
+		}
+		price, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			errs = append(errs, bound.param+" must be a number")
+		}
+		*bound.value = &price
+	}
+
+	itemQuery.NamePrefix = query.Get("namePrefix")
+
+	if s := query.Get("cursor"); s != "" {
+		cursor, err := decodeListCursor(s)
+		if err != nil || cursor.ID == "" {
+			errs = append(errs, "cursor is invalid")
+		} else if cursor.Sort != sort || cursor.Order != order {
+			errs = append(errs, "cursor belongs to a different sort order")
+		}
+
+		itemQuery.After = &repository.ItemCursor{Value: cursor.Value, ID: cursor.ID}
+	}
+
+	if len(errs) > 0 {
+		return listQuery{}, errs
+	}
+
+	itemQuery.Sort = sort
+	itemQuery.Descending = order == "desc"
+	itemQuery.Limit = limit + 1
+
+	return listQuery{
+		query: itemQuery,
+		limit: limit,
+		sort:  sort,
+		order: order,
+	}, nil
+}
+
+func sortValue(item Item, sort string) interface{} {
+	switch sort {
+	case "name":
+		return item.Name
+	case "price":
+		return item.Price
+	default:
+		return outbox.FormatTime(item.OccurrenceTime)
+	}
+}
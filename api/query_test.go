@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// listPage lists the items of the query through the handler.
+func listPage(t *testing.T, query string) listItemsResponse {
+	t.Helper()
+
+	var page listItemsResponse
+	expectStatus(t, serve(listItems, "GET", "/items?"+query, "", nil), http.StatusOK, &page)
+	return page
+}
+
+func itemIDs(items []Item) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestListItemsPagesWithTheCursor(t *testing.T) {
+	useMemoryStore(t)
+
+	var expected []string
+	for _, price := range []float64{50, 40, 30, 20, 10} {
+		created := createTestItem(t, fmt.Sprintf(`{"name": "item %v", "price": %v, "active": true}`, price, price))
+		expected = append(expected, created.ID)
+	}
+	createTestItem(t, `{"name": "inactive", "price": 60}`)
+
+	var listed []string
+	query := "active=true&sort=price&order=desc&limit=2"
+	for pages := 1; ; pages++ {
+		page := listPage(t, query)
+		listed = append(listed, itemIDs(page.Items)...)
+		if page.NextCursor == "" {
+			if pages != 3 {
+				t.Fatalf("listed %d pages, expected 3", pages)
+			}
+			break
+		}
+
+		cursor, err := decodeListCursor(page.NextCursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := page.Items[len(page.Items)-1]
+		if cursor.Sort != "price" || cursor.Order != "desc" || cursor.Value != last.Price || cursor.ID != last.ID {
+			t.Fatalf("cursor %+v, expected the price and id of %+v", cursor, last)
+		}
+		query = "active=true&sort=price&order=desc&limit=2&cursor=" + url.QueryEscape(page.NextCursor)
+	}
+
+	if strings.Join(listed, ",") != strings.Join(expected, ",") {
+		t.Fatalf("listed %v, expected %v", listed, expected)
+	}
+}
+
+func TestListItemsBoundsTheLimit(t *testing.T) {
+	useMemoryStore(t)
+	for i := 0; i < defaultListLimit+1; i++ {
+		createTestItem(t, fmt.Sprintf(`{"name": "item %02d"}`, i))
+	}
+
+	if page := listPage(t, "sort=name"); len(page.Items) != defaultListLimit || page.NextCursor == "" {
+		t.Fatalf("listed %d items, expected the default limit of %d and a next page", len(page.Items), defaultListLimit)
+	}
+	if page := listPage(t, "sort=name&limit=1"); len(page.Items) != 1 || page.Items[0].Name != "item 00" {
+		t.Fatalf("listed %v, expected item 00 alone", page.Items)
+	}
+	if page := listPage(t, fmt.Sprintf("sort=name&limit=%d", maxListLimit)); len(page.Items) != defaultListLimit+1 || page.NextCursor != "" {
+		t.Fatalf("listed %d items, expected all %d without a next page", len(page.Items), defaultListLimit+1)
+	}
+
+	for _, limit := range []string{"0", "-1", fmt.Sprint(maxListLimit + 1), "ten"} {
+		var p problem
+		expectStatus(t, serve(listItems, "GET", "/items?limit="+limit, "", nil), http.StatusBadRequest, &p)
+		if len(p.Errors) != 1 || p.Errors[0] != "limit must be between 1 and 100" {
+			t.Fatalf("limit %s: problem %+v, expected the limit to be rejected", limit, p)
+		}
+	}
+}
+
+func TestListItemsRejectsInvalidCursors(t *testing.T) {
+	useMemoryStore(t)
+
+	tests := []struct {
+		name     string
+		cursor   string
+		expected string
+	}{
+		{"not base64", "%%%", "cursor is invalid"},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("{")), "cursor is invalid"},
+		{"without an id", listCursor{Sort: "occurrenceTime", Order: "asc", Value: "2026-10-17T00:00:00Z"}.encode(), "cursor is invalid"},
+		{"of another sort", listCursor{Sort: "name", Order: "asc", Value: "ciko", ID: "id"}.encode(), "cursor belongs to a different sort order"},
+		{"of another order", listCursor{Sort: "occurrenceTime", Order: "desc", Value: "2026-10-17T00:00:00Z", ID: "id"}.encode(), "cursor belongs to a different sort order"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p problem
+			expectStatus(t, serve(listItems, "GET", "/items?cursor="+url.QueryEscape(test.cursor), "", nil), http.StatusBadRequest, &p)
+			if len(p.Errors) != 1 || p.Errors[0] != test.expected {
+				t.Fatalf("problem %+v, expected %q", p, test.expected)
+			}
+		})
+	}
+}
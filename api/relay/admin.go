@@ -0,0 +1,193 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDeadLetterLimit = 50
+	maxDeadLetterLimit     = 500
+)
+
+// DeadLetterHandler serves the admin endpoints of the dead letters:
+//
+//	GET    /dlq?offset=0&limit=50  lists the dead letters without their documents
+//	GET    /dlq/{id}               returns the dead letter with its document
+//	POST   /dlq/{id}/requeue       publishes the document and removes the dead letter
+//	DELETE /dlq/{id}               discards the dead letter
+//
+// A requeued document is handed to the relay, which publishes it like the
+// documents it reads from the outbox.
+type DeadLetterHandler struct {
+	store DeadLetterStore
+	relay Requeuer
+}
+
+// Requeuer is a relay that publishes requeued dead letters. Requeue returns
+// once the document is published or dead lettered again, which updates the
+// dead letter, and ErrUndecodable when the relay cannot decode the document.
+type Requeuer interface {
+	Requeue(ctx context.Context, letter DeadLetter) error
+}
+
+// ErrUndecodable is returned for a requeued document that still cannot be
+// decoded.
+var ErrUndecodable = errors.New("the document cannot be decoded")
+
+type listDeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func NewDeadLetterHandler(store DeadLetterStore, relay Requeuer) *DeadLetterHandler {
+	return &DeadLetterHandler{store: store, relay: relay}
+}
+
+// RequireToken answers the requests without the token as their bearer token
+// with 401 instead of passing them to the handler.
+func RequireToken(token string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "a valid bearer token is required")
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func (h *DeadLetterHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/dlq"), "/")
+	segments := strings.Split(path, "/")
+
+	switch {
+	case path == "" && req.Method == "GET":
+		h.list(w, req)
+	case len(segments) == 1 && req.Method == "GET":
+		h.get(w, segments[0])
+	case len(segments) == 1 && req.Method == "DELETE":
+		h.discard(w, segments[0])
+	case len(segments) == 2 && segments[1] == "requeue" && req.Method == "POST":
+		h.requeue(w, req, segments[0])
+	case path == "" || len(segments) == 1 || (len(segments) == 2 && segments[1] == "requeue"):
+		writeAdminError(w, http.StatusMethodNotAllowed, "the method is not supported by this endpoint")
+	default:
+		writeAdminError(w, http.StatusNotFound, "no such resource")
+	}
+}
+
+func (h *DeadLetterHandler) list(w http.ResponseWriter, req *http.Request) {
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil || offset < 0 {
+		writeAdminError(w, http.StatusBadRequest, "offset must be a non negative number")
+		return
+	}
+	limit, err := queryInt(req, "limit", defaultDeadLetterLimit)
+	if err != nil || limit < 1 || limit > maxDeadLetterLimit {
+		writeAdminError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxDeadLetterLimit))
+		return
+	}
+
+	letters, err := h.store.List(offset, limit)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, listDeadLettersResponse{DeadLetters: letters})
+}
+
+func (h *DeadLetterHandler) get(w http.ResponseWriter, id string) {
+	letter, found := h.load(w, id)
+	if found {
+		writeAdminJSON(w, http.StatusOK, letter)
+	}
+}
+
+func (h *DeadLetterHandler) discard(w http.ResponseWriter, id string) {
+	if _, found := h.load(w, id); !found {
+		return
+	}
+
+	if err := h.store.Remove(id); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requeue hands the document to the relay. When the relay dead letters it
+// again the dead letter is kept with the new error and attempts.
+func (h *DeadLetterHandler) requeue(w http.ResponseWriter, req *http.Request, id string) {
+	letter, found := h.load(w, id)
+	if !found {
+		return
+	}
+
+	err := h.relay.Requeue(req.Context(), letter)
+	if errors.Is(err, ErrUndecodable) {
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusServiceUnavailable, "the relay did not publish the dead letter: "+err.Error())
+		return
+	}
+
+	failed, found, err := h.store.Load(id)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if found && failed.LastFailedAt.After(letter.LastFailedAt) {
+		writeAdminError(w, http.StatusBadGateway, "could not publish the dead letter: "+failed.Error)
+		return
+	}
+
+	if err := h.store.Remove(id); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "published the dead letter but could not remove it: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *DeadLetterHandler) load(w http.ResponseWriter, id string) (DeadLetter, bool) {
+	letter, found, err := h.store.Load(id)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return letter, false
+	}
+	if !found {
+		writeAdminError(w, http.StatusNotFound, "the dead letter does not exist")
+	}
+	return letter, found
+}
+
+func queryInt(req *http.Request, name string, fallback int) (int, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(v)
+	w.Write(body)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, adminError{Error: message})
+}
@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/segmentio/kafka-go"
+)
+
+func serveAdmin(handler http.Handler, method string, target string, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	return response
+}
+
+// testDeadLetter is a dead letter of an outbox document of aggregate a that
+// failed an hour ago.
+func testDeadLetter(t *testing.T, value []byte) DeadLetter {
+	t.Helper()
+
+	failedAt := time.Now().Add(-time.Hour).UTC()
+	letter := newDeadLetter("test-relay", Message{Key: []byte("a"), Value: value, DocumentKey: "event-7"}, &PermanentError{Err: kafka.MessageSizeTooLarge}, 10, failedAt)
+	letter.LastFailedAt = failedAt
+	return letter
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		authorization string
+		status        int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		response := serveAdmin(handler, "GET", "/dlq", test.authorization)
+		if response.Code != test.status {
+			t.Fatalf("authorization %q was answered with %d, expected %d", test.authorization, response.Code, test.status)
+		}
+		if test.status == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("authorization %q was answered without a bearer challenge", test.authorization)
+		}
+	}
+}
+
+func TestDCPRelayRequeuesOnTheLaneOfTheAggregate(t *testing.T) {
+	producer := NewFakeProducer()
+	relay := newTestDCPRelay(t, producer, newMemoryCheckpointStore(), 1)
+
+	store := &memoryDeadLetterStore{}
+	letter := testDeadLetter(t, outboxMutation(t, 7, "a", 3).Value)
+	store.Save(letter)
+
+	response := serveAdmin(NewDeadLetterHandler(store, relay), "POST", "/dlq/"+letter.ID+"/requeue", "")
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("requeue was answered with %d %s, expected 204", response.Code, response.Body)
+	}
+
+	messages := producer.Messages()
+	if len(messages) != 1 || messages[0].DocumentKey != "event-7" || string(messages[0].Key) != "a" {
+		t.Fatalf("published %v, expected event-7 keyed by its aggregate", messages)
+	}
+	if _, found, _ := store.Load(letter.ID); found {
+		t.Fatal("kept the published dead letter")
+	}
+}
+
+func TestPollRelayRequeueKeepsTheDeadLetterWhenRejectedAgain(t *testing.T) {
+	envelope, _ := outbox.NewEnvelope(outbox.FormatCloudEvents, "/relay/test")
+	producer := NewFakeProducer()
+	producer.Reject("event-7", &PermanentError{Err: kafka.MessageSizeTooLarge})
+	store := &memoryDeadLetterStore{}
+	relay := &PollRelay{
+		opts:        PollRelayOptions{Producer: producer, Envelope: envelope},
+		deadLetters: newDeadLetterer("test-relay", store, 1),
+	}
+
+	letter := testDeadLetter(t, outboxMutation(t, 7, "a", 3).Value)
+	store.Save(letter)
+
+	response := serveAdmin(NewDeadLetterHandler(store, relay), "POST", "/dlq/"+letter.ID+"/requeue", "")
+	if response.Code != http.StatusBadGateway {
+		t.Fatalf("requeue was answered with %d %s, expected 502", response.Code, response.Body)
+	}
+
+	if len(store.letters) != 1 {
+		t.Fatalf("dead letters are %+v, expected the requeued one alone", store.letters)
+	}
+	failed := store.letters[0]
+	if failed.ID != letter.ID || failed.Attempts != 11 || !failed.FirstFailedAt.Equal(letter.FirstFailedAt) || !failed.LastFailedAt.After(letter.LastFailedAt) {
+		t.Fatalf("dead letter is %+v, expected %s with 11 attempts failed again", failed, letter.ID)
+	}
+}
+
+func TestRequeueRejectsUndecodableDocuments(t *testing.T) {
+	producer := NewFakeProducer()
+	relay := newTestDCPRelay(t, producer, newMemoryCheckpointStore(), 1)
+
+	store := &memoryDeadLetterStore{}
+	letter := testDeadLetter(t, []byte("{not json"))
+	store.Save(letter)
+
+	response := serveAdmin(NewDeadLetterHandler(store, relay), "POST", "/dlq/"+letter.ID+"/requeue", "")
+	var body adminError
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if response.Code != http.StatusUnprocessableEntity || body.Error == "" {
+		t.Fatalf("requeue was answered with %d %s, expected 422", response.Code, response.Body)
+	}
+	if len(producer.Messages()) != 0 || len(store.letters) != 1 {
+		t.Fatalf("published %d messages and kept %d dead letters, expected none and the dead letter", len(producer.Messages()), len(store.letters))
+	}
+}
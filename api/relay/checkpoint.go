@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// Checkpoint is the position of the relay in the DCP stream of one vBucket.
+// Everything up to SeqNo has been published. VbUUID and the snapshot are
+// needed to resume the stream and to detect a rollback after a failover.
+type Checkpoint struct {
+	VbID      uint16    `json:"vbId"`
+	VbUUID    uint64    `json:"vbUuid"`
+	SeqNo     uint64    `json:"seqNo"`
+	SnapStart uint64    `json:"snapStart"`
+	SnapEnd   uint64    `json:"snapEnd"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CheckpointStore persists the checkpoints of a relay.
+type CheckpointStore interface {
+	// Load returns the checkpoint of the vBucket, false when there is none yet.
+	Load(vbID uint16) (Checkpoint, bool, error)
+	Save(checkpoint Checkpoint) error
+}
+
+// CouchbaseCheckpointStore keeps one document per vBucket, keyed by the relay
+// name and the vBucket id, e.g. "item-outbox-relay::42". As a SequenceStore
+// it keeps one document per aggregate, e.g.
+// "item-outbox-relay::sequence::item::<id>".
+type CouchbaseCheckpointStore struct {
+	collection *gocb.Collection
+	name       string
+}
+
+func NewCouchbaseCheckpointStore(collection *gocb.Collection, name string) *CouchbaseCheckpointStore {
+	return &CouchbaseCheckpointStore{collection: collection, name: name}
+}
+
+func (s *CouchbaseCheckpointStore) key(vbID uint16) string {
+	return s.name + "::" + strconv.Itoa(int(vbID))
+}
+
+func (s *CouchbaseCheckpointStore) Load(vbID uint16) (Checkpoint, bool, error) {
+	var checkpoint Checkpoint
+
+	result, err := s.collection.Get(s.key(vbID), nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return Checkpoint{VbID: vbID}, false, nil
+	}
+	if err != nil {
+		return checkpoint, false, err
+	}
+
+	err = result.Content(&checkpoint)
+	return checkpoint, err == nil, err
+}
+
+func (s *CouchbaseCheckpointStore) Save(checkpoint Checkpoint) error {
+	_, err := s.collection.Upsert(s.key(checkpoint.VbID), checkpoint, nil)
+	return err
+}
+
+type sequenceDocument struct {
+	Sequence  int64     `json:"sequence"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (s *CouchbaseCheckpointStore) sequenceKey(aggregateType string, aggregateID string) string {
+	return s.name + "::sequence::" + aggregateType + "::" + aggregateID
+}
+
+func (s *CouchbaseCheckpointStore) LoadSequence(aggregateType string, aggregateID string) (int64, error) {
+	var doc sequenceDocument
+
+	result, err := s.collection.Get(s.sequenceKey(aggregateType, aggregateID), nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = result.Content(&doc)
+	return doc.Sequence, err
+}
+
+// SaveSequence never lowers the stored sequence, instances of a relay group
+// may save the sequences of an aggregate out of order.
+func (s *CouchbaseCheckpointStore) SaveSequence(aggregateType string, aggregateID string, sequence int64) error {
+	key := s.sequenceKey(aggregateType, aggregateID)
+	doc := sequenceDocument{Sequence: sequence, UpdatedAt: time.Now().UTC()}
+
+	for {
+		result, err := s.collection.Get(key, nil)
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			_, err = s.collection.Insert(key, doc, nil)
+			if errors.Is(err, gocb.ErrDocumentExists) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		var stored sequenceDocument
+		if err = result.Content(&stored); err != nil {
+			return err
+		}
+		if stored.Sequence >= sequence {
+			return nil
+		}
+
+		_, err = s.collection.Replace(key, doc, &gocb.ReplaceOptions{Cas: result.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return err
+	}
+}
@@ -0,0 +1,937 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocb/v2"
+	"github.com/couchbase/gocbcore/v10"
+	"github.com/couchbase/gocbcore/v10/memd"
+)
+
+const (
+	defaultWorkers            = 8
+	defaultBatchSize          = 100
+	defaultCheckpointInterval = 5 * time.Second
+
+	connectTimeout       = 30 * time.Second
+	reopenDelay          = time.Second
+	reorderSweepInterval = time.Second
+	queueSize            = 1024
+)
+
+// DCPRelayOptions configure a DCPRelay. Workers, BatchSize,
+// CheckpointInterval and MaxAttempts fall back to defaults when zero.
+type DCPRelayOptions struct {
+	// Name names the DCP connection and the checkpoints of the relay. Relays
+	// with the same name resume from each others checkpoints.
+	Name    string
+	ConnStr string
+	// Security is the TLS settings and the authentication of the DCP
+	// connection, see config.Couchbase.DCPSecurityConfig.
+	Security gocbcore.SecurityConfig
+	// Collection is the outbox collection that is streamed.
+	Collection  *gocb.Collection
+	Checkpoints CheckpointStore
+	Producer    Producer
+	// Envelope decodes the outbox documents to key the messages by aggregate id.
+	Envelope outbox.Envelope
+	// Membership, when set, splits the vBuckets with the other instances of
+	// its group.
+	Membership *Membership
+	// Reorder, when set, publishes the events of every aggregate strictly in
+	// sequence order, across vBuckets and instances. It needs Sequences.
+	Reorder   *ReorderOptions
+	Sequences SequenceStore
+	// DeadLetters, when set, receives the documents that cannot be decoded
+	// or are still rejected with a PermanentError after MaxAttempts, the relay
+	// retries publishing forever otherwise.
+	DeadLetters DeadLetterStore
+	MaxAttempts int
+
+	// Workers is the number of concurrent publishers. The vBuckets are spread
+	// over them for processing and the messages by key for publishing, so
+	// the messages of an aggregate are published in order.
+	Workers            int
+	BatchSize          int
+	CheckpointInterval time.Duration
+}
+
+// DCPRelay streams the mutations of the outbox collection from every vBucket
+// and publishes them in DCP order per vBucket. A vBucket is checkpointed only
+// after everything up to the checkpoint has been published, so a restarted
+// relay publishes at least once.
+type DCPRelay struct {
+	opts         DCPRelayOptions
+	agent        *gocbcore.DCPAgent
+	collectionID uint32
+	vbuckets     []*vbucketState
+	queues       []chan streamEvent
+	lanes        []chan record
+	reorderer    *reorderer
+	deadLetters  *deadLetterer
+	done         <-chan struct{}
+	// started is closed once Run has set done.
+	started chan struct{}
+
+	// released are the vBuckets stopped since the last membership sync.
+	released []uint16
+	lastSync time.Time
+	streamed int
+	members  int
+}
+
+type vbucketState struct {
+	mu sync.Mutex
+	// generation identifies the current stream of the vBucket. Events still
+	// queued from an earlier stream are dropped, the current stream delivers
+	// them again from the checkpoint.
+	generation uint64
+	// owned is set while this instance streams the vBucket.
+	owned bool
+	// vbUUID is the vBucket UUID the current stream was opened on.
+	vbUUID     uint64
+	checkpoint Checkpoint
+	dirty      bool
+	// pending are the events received from the current stream that are not
+	// done yet, in stream order. The checkpoint never passes the first one.
+	pending []*trackedEvent
+}
+
+// trackedEvent is an event of a vBucket on its way to the producer.
+type trackedEvent struct {
+	vbID      uint16
+	seqNo     uint64
+	snapStart uint64
+	snapEnd   uint64
+	done      bool
+}
+
+// record is an outbox document on its way to the producer. The aggregate
+// and sequence are set for documents holding a single event when reordering.
+// A requeued dead letter has no tracked event, published is closed instead
+// once it is published or dead lettered again.
+type record struct {
+	tracked   *trackedEvent
+	message   Message
+	aggregate aggregateKey
+	sequence  int64
+	published chan struct{}
+}
+
+// streamEvent is a mutation or, with a nil value, any other event that
+// advances the seqno of the vBucket.
+type streamEvent struct {
+	vbID       uint16
+	generation uint64
+	seqNo      uint64
+	snapStart  uint64
+	snapEnd    uint64
+	key        []byte
+	value      []byte
+}
+
+func NewDCPRelay(opts DCPRelayOptions) (*DCPRelay, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = defaultCheckpointInterval
+	}
+	if opts.Reorder != nil && opts.Sequences == nil {
+		return nil, fmt.Errorf("reordering needs a sequence store")
+	}
+	if m := opts.Membership; m != nil && m.opts.HeartbeatInterval >= m.opts.LeaseTimeout {
+		return nil, fmt.Errorf("the heartbeat interval %s of the membership must be shorter than its lease timeout %s", m.opts.HeartbeatInterval, m.opts.LeaseTimeout)
+	}
+
+	collectionID, err := collectionID(opts.Collection)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve the id of the outbox collection: %w", err)
+	}
+
+	config := &gocbcore.DCPAgentConfig{}
+	if err = config.FromConnStr(opts.ConnStr); err != nil {
+		return nil, err
+	}
+	config.UserAgent = opts.Name
+	config.BucketName = opts.Collection.Bucket().Name()
+	config.SecurityConfig = opts.Security
+	config.IoConfig.UseCollections = true
+
+	// the server closes a DCP connection when another one opens with its name.
+	streamName := opts.Name
+	if opts.Membership != nil {
+		streamName += "::" + opts.Membership.opts.InstanceID
+	}
+
+	agent, err := gocbcore.CreateDcpAgent(config, streamName, memd.DcpOpenFlagProducer)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	_, err = agent.WaitUntilReady(time.Now().Add(connectTimeout), gocbcore.WaitUntilReadyOptions{}, func(_ *gocbcore.WaitUntilReadyResult, err error) {
+		ready <- err
+	})
+	if err == nil {
+		err = <-ready
+	}
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+
+	snapshot, err := agent.ConfigSnapshot()
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+	numVbuckets, err := snapshot.NumVbuckets()
+	if err != nil {
+		agent.Close()
+		return nil, err
+	}
+
+	relay := &DCPRelay{
+		opts:         opts,
+		agent:        agent,
+		collectionID: collectionID,
+		vbuckets:     make([]*vbucketState, numVbuckets),
+		queues:       make([]chan streamEvent, opts.Workers),
+		lanes:        make([]chan record, opts.Workers),
+		deadLetters:  newDeadLetterer(opts.Name, opts.DeadLetters, opts.MaxAttempts),
+		started:      make(chan struct{}),
+	}
+	for i := range relay.queues {
+		relay.queues[i] = make(chan streamEvent, queueSize)
+		relay.lanes[i] = make(chan record, queueSize)
+	}
+	if opts.Reorder != nil {
+		relay.reorderer = newReorderer(*opts.Reorder, opts.Sequences, relay.toLane, func(rec record) {
+			relay.complete(rec.tracked)
+		})
+	}
+
+	return relay, nil
+}
+
+// collectionID looks up the id DCP identifies the collection by.
+func collectionID(collection *gocb.Collection) (uint32, error) {
+	if err := collection.Bucket().WaitUntilReady(connectTimeout, nil); err != nil {
+		return 0, err
+	}
+
+	agent, err := collection.Bucket().Internal().IORouter()
+	if err != nil {
+		return 0, err
+	}
+
+	type result struct {
+		id  uint32
+		err error
+	}
+	resolved := make(chan result, 1)
+	_, err = agent.GetCollectionID(collection.ScopeName(), collection.Name(), gocbcore.GetCollectionIDOptions{}, func(res *gocbcore.GetCollectionIDResult, err error) {
+		if err != nil {
+			resolved <- result{err: err}
+			return
+		}
+		resolved <- result{id: res.CollectionID}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	res := <-resolved
+	return res.id, res.err
+}
+
+// Run streams and publishes until the context is cancelled, then it saves the
+// checkpoints and closes the DCP connection. The producer is left open.
+// Without a Membership the relay streams every vBucket, with one it streams
+// the share of the vBuckets it holds the leases of and follows the group as
+// instances join and leave.
+func (r *DCPRelay) Run(ctx context.Context) error {
+	defer r.agent.Close()
+	r.done = ctx.Done()
+	close(r.started)
+
+	for vbID := range r.vbuckets {
+		r.vbuckets[vbID] = &vbucketState{checkpoint: Checkpoint{VbID: uint16(vbID)}}
+	}
+
+	var wg sync.WaitGroup
+	for i := range r.queues {
+		wg.Add(2)
+		go func(queue chan streamEvent) {
+			defer wg.Done()
+			r.processLoop(ctx, queue)
+		}(r.queues[i])
+		go func(lane chan record) {
+			defer wg.Done()
+			r.laneLoop(ctx, lane)
+		}(r.lanes[i])
+	}
+
+	var sweep <-chan time.Time
+	if r.reorderer != nil {
+		ticker := time.NewTicker(reorderSweepInterval)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+
+	var heartbeat <-chan time.Time
+	if r.opts.Membership == nil {
+		for vbID := range r.vbuckets {
+			if err := r.startStream(uint16(vbID)); err != nil {
+				return err
+			}
+		}
+	} else {
+		r.rebalance()
+		ticker := time.NewTicker(r.opts.Membership.opts.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	ticker := time.NewTicker(r.opts.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.saveCheckpoints()
+		case <-heartbeat:
+			r.rebalance()
+		case <-sweep:
+			r.reorderer.sweep()
+		case <-ctx.Done():
+			wg.Wait()
+			r.saveCheckpoints()
+			if r.opts.Membership != nil {
+				if err := r.opts.Membership.Leave(); err != nil {
+					log.Printf("could not leave relay group %s: %s", r.opts.Membership.opts.Group, err)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// rebalance syncs the membership, stops the vBuckets that moved to other
+// instances and starts the ones this instance got the leases of. The leases
+// of stopped vBuckets are released with the next sync, after their final
+// checkpoint has been saved. An instance that could not renew its membership
+// stops everything a heartbeat before its leases run out, before another
+// instance can take them over.
+func (r *DCPRelay) rebalance() {
+	membership := r.opts.Membership
+
+	// the heartbeat of the sync is as old as its start.
+	started := time.Now()
+	assignment, err := membership.Sync(len(r.vbuckets), r.released)
+	if err != nil {
+		log.Printf("could not sync relay group %s: %s", membership.opts.Group, err)
+		if !time.Now().Before(membership.streamDeadline(r.lastSync)) {
+			for vbID := range r.vbuckets {
+				if r.owned(uint16(vbID)) {
+					r.stopStream(uint16(vbID))
+				}
+			}
+		}
+		return
+	}
+	r.lastSync = started
+	r.released = nil
+
+	streamed := 0
+	for vbID := range r.vbuckets {
+		vb := uint16(vbID)
+		owned := r.owned(vb)
+
+		switch {
+		case owned && !(assignment.Assigned[vb] && assignment.Leased[vb]):
+			r.stopStream(vb)
+			if assignment.Leased[vb] {
+				r.released = append(r.released, vb)
+			}
+		case !owned && assignment.Assigned[vb] && assignment.Leased[vb]:
+			if err = r.startStream(vb); err != nil {
+				log.Printf("could not start vBucket %d: %s", vb, err)
+				r.released = append(r.released, vb)
+				continue
+			}
+			streamed++
+		case owned:
+			streamed++
+		}
+	}
+
+	if streamed != r.streamed || len(assignment.Members) != r.members {
+		log.Printf("relay %s streams %d of %d vBuckets, %d instances in group %s", membership.opts.InstanceID, streamed, len(r.vbuckets), len(assignment.Members), membership.opts.Group)
+		r.streamed, r.members = streamed, len(assignment.Members)
+	}
+}
+
+func (r *DCPRelay) owned(vbID uint16) bool {
+	state := r.vbuckets[vbID]
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.owned
+}
+
+// startStream resumes the vBucket from its last checkpoint, which may have
+// been saved by another instance.
+func (r *DCPRelay) startStream(vbID uint16) error {
+	checkpoint, _, err := r.opts.Checkpoints.Load(vbID)
+	if err != nil {
+		return fmt.Errorf("could not load the checkpoint of vBucket %d: %w", vbID, err)
+	}
+
+	state := r.vbuckets[vbID]
+	state.mu.Lock()
+	state.owned = true
+	state.checkpoint = checkpoint
+	state.dirty = false
+	state.mu.Unlock()
+
+	r.openStream(vbID)
+	return nil
+}
+
+// stopStream closes the stream of the vBucket and saves its checkpoint. The
+// events still queued for it are dropped, the next owner publishes them again.
+func (r *DCPRelay) stopStream(vbID uint16) {
+	state := r.vbuckets[vbID]
+	state.mu.Lock()
+	state.owned = false
+	state.generation++
+	state.pending = nil
+	checkpoint, dirty := state.checkpoint, state.dirty
+	state.dirty = false
+	state.mu.Unlock()
+
+	_, err := r.agent.CloseStream(vbID, gocbcore.CloseStreamOptions{}, func(err error) {
+		if err != nil {
+			log.Printf("could not close the stream of vBucket %d: %s", vbID, err)
+		}
+	})
+	if err != nil {
+		log.Printf("could not close the stream of vBucket %d: %s", vbID, err)
+	}
+
+	if dirty {
+		if err = r.opts.Checkpoints.Save(checkpoint); err != nil {
+			log.Printf("could not save the checkpoint of vBucket %d: %s", vbID, err)
+		}
+	}
+}
+
+func (r *DCPRelay) openStream(vbID uint16) {
+	state := r.vbuckets[vbID]
+
+	state.mu.Lock()
+	state.generation++
+	state.pending = nil
+	generation := state.generation
+	checkpoint := state.checkpoint
+	observer := &streamObserver{
+		relay:      r,
+		vbID:       vbID,
+		generation: generation,
+		snapStart:  checkpoint.SnapStart,
+		snapEnd:    checkpoint.SnapEnd,
+	}
+	state.mu.Unlock()
+
+	_, err := r.agent.OpenStream(
+		vbID,
+		0,
+		gocbcore.VbUUID(checkpoint.VbUUID),
+		gocbcore.SeqNo(checkpoint.SeqNo),
+		gocbcore.SeqNo(math.MaxUint64),
+		gocbcore.SeqNo(checkpoint.SnapStart),
+		gocbcore.SeqNo(checkpoint.SnapEnd),
+		observer,
+		gocbcore.OpenStreamOptions{
+			FilterOptions: &gocbcore.OpenStreamFilterOptions{CollectionIDs: []uint32{r.collectionID}},
+		},
+		func(entries []gocbcore.FailoverEntry, err error) {
+			if errors.Is(err, gocbcore.ErrMemdRollback) {
+				go r.rollback(vbID, generation, checkpoint)
+				return
+			}
+			if err != nil {
+				log.Printf("could not open the stream of vBucket %d: %s", vbID, err)
+				r.reopenLater(vbID, generation)
+				return
+			}
+
+			state.mu.Lock()
+			if len(entries) > 0 {
+				state.vbUUID = uint64(entries[0].VbUUID)
+			}
+			state.mu.Unlock()
+		})
+	if err != nil {
+		log.Printf("could not open the stream of vBucket %d: %s", vbID, err)
+		r.reopenLater(vbID, generation)
+	}
+}
+
+// current reports whether the stream of the given generation is still the
+// one the vBucket should be streamed with.
+func (r *DCPRelay) current(vbID uint16, generation uint64) bool {
+	state := r.vbuckets[vbID]
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.owned && state.generation == generation
+}
+
+// reopenLater reopens the stream of the given generation after a delay,
+// unless it has been stopped or reopened by then.
+func (r *DCPRelay) reopenLater(vbID uint16, generation uint64) {
+	go func() {
+		select {
+		case <-time.After(reopenDelay):
+			if r.current(vbID, generation) {
+				r.openStream(vbID)
+			}
+		case <-r.done:
+		}
+	}()
+}
+
+// rollback resumes the stream of a vBucket that was rejected because the
+// checkpoint is ahead of what the vBucket holds after a failover.
+func (r *DCPRelay) rollback(vbID uint16, generation uint64, from Checkpoint) {
+	entries, err := r.failoverLog(vbID)
+	if err != nil {
+		log.Printf("could not get the failover log of vBucket %d: %s", vbID, err)
+		r.reopenLater(vbID, generation)
+		return
+	}
+
+	highSeqNo, err := r.highSeqNo(vbID)
+	if err != nil {
+		log.Printf("could not get the high seqno of vBucket %d: %s", vbID, err)
+		r.reopenLater(vbID, generation)
+		return
+	}
+
+	to := rollbackCheckpoint(from, entries, highSeqNo)
+
+	state := r.vbuckets[vbID]
+	state.mu.Lock()
+	if !state.owned || state.generation != generation {
+		state.mu.Unlock()
+		return
+	}
+	log.Printf("rolling back vBucket %d from seqno %d to %d", vbID, from.SeqNo, to.SeqNo)
+	state.checkpoint = to
+	state.dirty = true
+	state.mu.Unlock()
+
+	r.openStream(vbID)
+}
+
+// rollbackCheckpoint finds the branch of the failover log the checkpoint was
+// taken on and moves the checkpoint back to where that branch ended, or keeps
+// its seqno when the branch ended after it. The log lists the newest branch
+// first, a branch ends where the one after it starts. The current branch has
+// not ended, the checkpoint moves back to the high seqno of the vBucket. The
+// rollback seqno the server answers with would do, but gocbcore does not hand
+// it to the stream callback. Without a matching branch the vBucket starts over.
+func rollbackCheckpoint(from Checkpoint, entries []gocbcore.FailoverEntry, highSeqNo uint64) Checkpoint {
+	to := Checkpoint{VbID: from.VbID, UpdatedAt: time.Now().UTC()}
+
+	for i, entry := range entries {
+		if uint64(entry.VbUUID) != from.VbUUID {
+			continue
+		}
+
+		seqNo := highSeqNo
+		if i > 0 {
+			seqNo = uint64(entries[i-1].SeqNo)
+		}
+		if from.SeqNo < seqNo {
+			seqNo = from.SeqNo
+		}
+		to.VbUUID = from.VbUUID
+		to.SeqNo = seqNo
+		to.SnapStart = seqNo
+		to.SnapEnd = seqNo
+		break
+	}
+
+	return to
+}
+
+// highSeqNo asks the node the vBucket is active on for its high seqno.
+func (r *DCPRelay) highSeqNo(vbID uint16) (uint64, error) {
+	snapshot, err := r.agent.ConfigSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	server, err := snapshot.VbucketToServer(vbID, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	type result struct {
+		entries []gocbcore.VbSeqNoEntry
+		err     error
+	}
+	fetched := make(chan result, 1)
+
+	_, err = r.agent.GetVbucketSeqnos(server, memd.VbucketStateActive, gocbcore.GetVbucketSeqnoOptions{}, func(entries []gocbcore.VbSeqNoEntry, err error) {
+		fetched <- result{entries: entries, err: err}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	res := <-fetched
+	if res.err != nil {
+		return 0, res.err
+	}
+	for _, entry := range res.entries {
+		if entry.VbID == vbID {
+			return uint64(entry.SeqNo), nil
+		}
+	}
+	return 0, fmt.Errorf("vBucket %d is not active on server %d", vbID, server)
+}
+
+func (r *DCPRelay) failoverLog(vbID uint16) ([]gocbcore.FailoverEntry, error) {
+	type result struct {
+		entries []gocbcore.FailoverEntry
+		err     error
+	}
+	fetched := make(chan result, 1)
+
+	_, err := r.agent.GetFailoverLog(vbID, func(entries []gocbcore.FailoverEntry, err error) {
+		fetched <- result{entries: entries, err: err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := <-fetched
+	return res.entries, res.err
+}
+
+func (r *DCPRelay) enqueue(event streamEvent) {
+	select {
+	case r.queues[int(event.vbID)%len(r.queues)] <- event:
+	case <-r.done:
+	}
+}
+
+// processLoop tracks the events of its vBuckets in stream order and hands the
+// outbox documents on to the lanes, through the reorderer when reordering.
+func (r *DCPRelay) processLoop(ctx context.Context, queue chan streamEvent) {
+	for {
+		var event streamEvent
+		select {
+		case event = <-queue:
+		case <-ctx.Done():
+			return
+		}
+
+		tracked := r.track(event)
+		if tracked == nil {
+			continue
+		}
+		if event.value == nil {
+			r.complete(tracked)
+			continue
+		}
+
+		rec := record{tracked: tracked}
+		var events []outbox.Event
+		var err error
+		rec.message, events, err = keyedMessage(r.opts.Envelope, event.key, event.value)
+		if err != nil {
+			if r.deadLetters.undecodable(ctx, rec.message, err) != nil {
+				return
+			}
+			r.complete(tracked)
+			continue
+		}
+		if r.reorderer == nil || len(events) != 1 {
+			r.toLane(rec)
+			continue
+		}
+
+		rec.aggregate = aggregateKey{aggregateType: events[0].AggregateType, aggregateID: events[0].AggregateID}
+		rec.sequence = events[0].Sequence
+		for {
+			err := r.reorderer.add(rec)
+			if err == nil {
+				break
+			}
+			log.Printf("could not reorder outbox document %s, retrying: %s", rec.message.DocumentKey, err)
+
+			select {
+			case <-time.After(reopenDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// toLane queues the record for publishing. The lane is picked by the message
+// key, so the records of an aggregate are published one after the other.
+func (r *DCPRelay) toLane(rec record) {
+	hash := fnv.New32a()
+	hash.Write(rec.message.Key)
+
+	select {
+	case r.lanes[hash.Sum32()%uint32(len(r.lanes))] <- rec:
+	case <-r.done:
+	}
+}
+
+// laneLoop publishes the records of its lane in batches of whatever is
+// queued, up to the batch size.
+func (r *DCPRelay) laneLoop(ctx context.Context, lane chan record) {
+	for {
+		var batch []record
+		select {
+		case rec := <-lane:
+			batch = append(batch, rec)
+		case <-ctx.Done():
+			return
+		}
+
+	drain:
+		for len(batch) < r.opts.BatchSize {
+			select {
+			case rec := <-lane:
+				batch = append(batch, rec)
+			default:
+				break drain
+			}
+		}
+
+		messages := make([]Message, len(batch))
+		for i, rec := range batch {
+			messages[i] = rec.message
+		}
+		// dead lettered records count as published, the stream moves on.
+		if err := r.deadLetters.publish(ctx, r.opts.Producer, messages); err != nil {
+			return
+		}
+
+		for _, rec := range batch {
+			if rec.tracked == nil {
+				close(rec.published)
+				continue
+			}
+			if r.reorderer != nil && rec.sequence != 0 {
+				r.reorderer.markPublished(rec)
+			}
+			r.complete(rec.tracked)
+		}
+	}
+}
+
+// Requeue publishes the document of the dead letter on the lane of its
+// aggregate, in line with the documents read from the stream. Its sequence
+// was passed when it was dead lettered, so the reorderer releases it right
+// away, after the events of the aggregate it has released before.
+func (r *DCPRelay) Requeue(ctx context.Context, letter DeadLetter) error {
+	select {
+	case <-r.started:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	message, events, err := keyedMessage(r.opts.Envelope, []byte(letter.DocumentKey), letter.Message().Value)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUndecodable, err)
+	}
+	message.requeued = &letter
+
+	rec := record{message: message, published: make(chan struct{})}
+	if r.reorderer != nil && len(events) == 1 {
+		rec.aggregate = aggregateKey{aggregateType: events[0].AggregateType, aggregateID: events[0].AggregateID}
+		rec.sequence = events[0].Sequence
+		r.reorderer.requeue(rec)
+	} else {
+		r.toLane(rec)
+	}
+
+	select {
+	case <-rec.published:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track registers the event with its vBucket, nil when it belongs to a
+// stream that has been stopped or reopened since.
+func (r *DCPRelay) track(event streamEvent) *trackedEvent {
+	state := r.vbuckets[event.vbID]
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if !state.owned || event.generation != state.generation {
+		return nil
+	}
+
+	tracked := &trackedEvent{
+		vbID:      event.vbID,
+		seqNo:     event.seqNo,
+		snapStart: event.snapStart,
+		snapEnd:   event.snapEnd,
+	}
+	state.pending = append(state.pending, tracked)
+	return tracked
+}
+
+// complete marks the event as done and advances the checkpoint of its
+// vBucket past every event done without a pending one before it. Events are
+// done out of order when the reorderer holds some back or the lanes publish
+// at different pace.
+func (r *DCPRelay) complete(tracked *trackedEvent) {
+	state := r.vbuckets[tracked.vbID]
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	tracked.done = true
+	for len(state.pending) > 0 && state.pending[0].done {
+		front := state.pending[0]
+		state.pending = state.pending[1:]
+
+		if front.seqNo <= state.checkpoint.SeqNo {
+			continue
+		}
+		state.checkpoint = Checkpoint{
+			VbID:      front.vbID,
+			VbUUID:    state.vbUUID,
+			SeqNo:     front.seqNo,
+			SnapStart: front.snapStart,
+			SnapEnd:   front.snapEnd,
+			UpdatedAt: time.Now().UTC(),
+		}
+		state.dirty = true
+	}
+}
+
+func (r *DCPRelay) saveCheckpoints() {
+	if r.reorderer != nil {
+		if err := r.reorderer.flush(); err != nil {
+			log.Printf("could not save the published sequences, keeping the checkpoints: %s", err)
+			return
+		}
+	}
+
+	for _, state := range r.vbuckets {
+		state.mu.Lock()
+		checkpoint, dirty := state.checkpoint, state.dirty
+		state.dirty = false
+		state.mu.Unlock()
+
+		if !dirty {
+			continue
+		}
+
+		if err := r.opts.Checkpoints.Save(checkpoint); err != nil {
+			log.Printf("could not save the checkpoint of vBucket %d: %s", checkpoint.VbID, err)
+
+			state.mu.Lock()
+			state.dirty = true
+			state.mu.Unlock()
+		}
+	}
+}
+
+// streamObserver receives the events of one stream of one vBucket. gocbcore
+// calls it from the connection of the vBucket in stream order.
+type streamObserver struct {
+	relay      *DCPRelay
+	vbID       uint16
+	generation uint64
+	snapStart  uint64
+	snapEnd    uint64
+}
+
+func (o *streamObserver) event(seqNo uint64) streamEvent {
+	return streamEvent{
+		vbID:       o.vbID,
+		generation: o.generation,
+		seqNo:      seqNo,
+		snapStart:  o.snapStart,
+		snapEnd:    o.snapEnd,
+	}
+}
+
+func (o *streamObserver) SnapshotMarker(marker gocbcore.DcpSnapshotMarker) {
+	o.snapStart = marker.StartSeqNo
+	o.snapEnd = marker.EndSeqNo
+}
+
+func (o *streamObserver) Mutation(mutation gocbcore.DcpMutation) {
+	event := o.event(mutation.SeqNo)
+	event.key = mutation.Key
+	event.value = mutation.Value
+	o.relay.enqueue(event)
+}
+
+// Deletion and Expiration only advance the seqno, the DELETED event of an
+// item is a mutation of its own outbox document.
+func (o *streamObserver) Deletion(deletion gocbcore.DcpDeletion) {
+	o.relay.enqueue(o.event(deletion.SeqNo))
+}
+
+func (o *streamObserver) Expiration(expiration gocbcore.DcpExpiration) {
+	o.relay.enqueue(o.event(expiration.SeqNo))
+}
+
+func (o *streamObserver) SeqNoAdvanced(advanced gocbcore.DcpSeqNoAdvanced) {
+	o.relay.enqueue(o.event(advanced.SeqNo))
+}
+
+func (o *streamObserver) End(end gocbcore.DcpStreamEnd, err error) {
+	select {
+	case <-o.relay.done:
+		return
+	default:
+	}
+
+	if errors.Is(err, gocbcore.ErrDCPStreamFilterEmpty) {
+		log.Printf("stream of vBucket %d ended, the outbox collection has been dropped", o.vbID)
+		return
+	}
+
+	if !o.relay.current(o.vbID, o.generation) {
+		return
+	}
+
+	log.Printf("stream of vBucket %d ended, reopening: %v", o.vbID, err)
+	o.relay.reopenLater(o.vbID, o.generation)
+}
+
+func (o *streamObserver) CreateCollection(gocbcore.DcpCollectionCreation)     {}
+func (o *streamObserver) DeleteCollection(gocbcore.DcpCollectionDeletion)     {}
+func (o *streamObserver) FlushCollection(gocbcore.DcpCollectionFlush)         {}
+func (o *streamObserver) CreateScope(gocbcore.DcpScopeCreation)               {}
+func (o *streamObserver) DeleteScope(gocbcore.DcpScopeDeletion)               {}
+func (o *streamObserver) ModifyCollection(gocbcore.DcpCollectionModification) {}
+func (o *streamObserver) OSOSnapshot(gocbcore.DcpOSOSnapshot)                 {}
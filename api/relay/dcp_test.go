@@ -0,0 +1,336 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocbcore/v10"
+)
+
+const testVbUUID = 42
+
+type memoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[uint16]Checkpoint
+}
+
+func newMemoryCheckpointStore() *memoryCheckpointStore {
+	return &memoryCheckpointStore{checkpoints: map[uint16]Checkpoint{}}
+}
+
+func (s *memoryCheckpointStore) Load(vbID uint16) (Checkpoint, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoint, found := s.checkpoints[vbID]
+	if !found {
+		return Checkpoint{VbID: vbID}, false, nil
+	}
+	return checkpoint, true, nil
+}
+
+func (s *memoryCheckpointStore) Save(checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[checkpoint.VbID] = checkpoint
+	return nil
+}
+
+// newTestDCPRelay runs the processing and publishing of a relay over the
+// given number of vBuckets without a DCP connection, the tests feed the
+// streams through streamObservers. Every vBucket is owned and resumed from
+// its stored checkpoint.
+func newTestDCPRelay(t *testing.T, producer Producer, checkpoints CheckpointStore, numVbuckets int) *DCPRelay {
+	t.Helper()
+
+	envelope, _ := outbox.NewEnvelope(outbox.FormatCloudEvents, "/relay/test")
+	opts := DCPRelayOptions{
+		Name:        "test-relay",
+		Checkpoints: checkpoints,
+		Producer:    producer,
+		Envelope:    envelope,
+		Workers:     2,
+		BatchSize:   defaultBatchSize,
+	}
+	relay := &DCPRelay{
+		opts:     opts,
+		vbuckets: make([]*vbucketState, numVbuckets),
+		queues:   make([]chan streamEvent, opts.Workers),
+		lanes:    make([]chan record, opts.Workers),
+		started:  make(chan struct{}),
+	}
+	for vbID := range relay.vbuckets {
+		checkpoint, _, err := checkpoints.Load(uint16(vbID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay.vbuckets[vbID] = &vbucketState{owned: true, generation: 1, vbUUID: testVbUUID, checkpoint: checkpoint}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	relay.done = ctx.Done()
+	close(relay.started)
+
+	var wg sync.WaitGroup
+	for i := range relay.queues {
+		relay.queues[i] = make(chan streamEvent, queueSize)
+		relay.lanes[i] = make(chan record, queueSize)
+
+		wg.Add(2)
+		go func(queue chan streamEvent) {
+			defer wg.Done()
+			relay.processLoop(ctx, queue)
+		}(relay.queues[i])
+		go func(lane chan record) {
+			defer wg.Done()
+			relay.laneLoop(ctx, lane)
+		}(relay.lanes[i])
+	}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	return relay
+}
+
+func (r *DCPRelay) testStream(vbID uint16) *streamObserver {
+	return &streamObserver{relay: r, vbID: vbID, generation: r.vbuckets[vbID].generation}
+}
+
+func (r *DCPRelay) testCheckpoint(vbID uint16) Checkpoint {
+	state := r.vbuckets[vbID]
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	return state.checkpoint
+}
+
+// waitForCheckpoint waits until the checkpoint of the vBucket reached the seqno.
+func waitForCheckpoint(t *testing.T, relay *DCPRelay, vbID uint16, seqNo uint64) Checkpoint {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		checkpoint := relay.testCheckpoint(vbID)
+		if checkpoint.SeqNo >= seqNo {
+			return checkpoint
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("checkpoint of vBucket %d is at seqno %d, expected %d", vbID, checkpoint.SeqNo, seqNo)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func outboxMutation(t *testing.T, seqNo uint64, aggregateID string, sequence int64) gocbcore.DcpMutation {
+	t.Helper()
+
+	event := outbox.Event{
+		ID:             fmt.Sprintf("event-%d", seqNo),
+		AggregateType:  "item",
+		AggregateID:    aggregateID,
+		Type:           outbox.EventTypeUpdated,
+		Sequence:       sequence,
+		OccurrenceTime: time.Now(),
+	}
+	wrapped, err := outbox.CloudEventsEnvelope{}.Wrap(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gocbcore.DcpMutation{SeqNo: seqNo, Key: []byte(event.ID), Value: value}
+}
+
+func TestDCPRelayPublishesByAggregateAndCheckpoints(t *testing.T) {
+	producer := NewFakeProducer()
+	checkpoints := newMemoryCheckpointStore()
+	relay := newTestDCPRelay(t, producer, checkpoints, 2)
+
+	stream := relay.testStream(1)
+	stream.SnapshotMarker(gocbcore.DcpSnapshotMarker{StartSeqNo: 1, EndSeqNo: 4})
+	stream.Mutation(outboxMutation(t, 1, "a", 1))
+	stream.Mutation(outboxMutation(t, 2, "b", 1))
+	stream.Mutation(outboxMutation(t, 3, "a", 2))
+	stream.Deletion(gocbcore.DcpDeletion{SeqNo: 4})
+
+	checkpoint := waitForCheckpoint(t, relay, 1, 4)
+	expected := Checkpoint{VbID: 1, VbUUID: testVbUUID, SeqNo: 4, SnapStart: 1, SnapEnd: 4}
+	checkpoint.UpdatedAt = time.Time{}
+	if checkpoint != expected {
+		t.Fatalf("checkpoint %+v, expected %+v", checkpoint, expected)
+	}
+
+	// lanes publish in parallel, only the order within an aggregate is kept.
+	published := map[string][]string{}
+	for _, message := range producer.Messages() {
+		published[string(message.Key)] = append(published[string(message.Key)], message.DocumentKey)
+	}
+	if len(published["a"]) != 2 || published["a"][0] != "event-1" || published["a"][1] != "event-3" {
+		t.Fatalf("published %v for aggregate a, expected [event-1 event-3]", published["a"])
+	}
+	if len(published["b"]) != 1 || published["b"][0] != "event-2" {
+		t.Fatalf("published %v for aggregate b, expected [event-2]", published["b"])
+	}
+
+	relay.saveCheckpoints()
+	saved, found, _ := checkpoints.Load(1)
+	if !found || saved.SeqNo != 4 || saved.VbUUID != testVbUUID {
+		t.Fatalf("saved checkpoint %+v, expected seqno 4 on vBucket uuid %d", saved, testVbUUID)
+	}
+	if _, found, _ = checkpoints.Load(0); found {
+		t.Fatal("saved a checkpoint of the idle vBucket")
+	}
+}
+
+func TestDCPRelayDoesNotCheckpointUnpublishedEvents(t *testing.T) {
+	producer := NewFakeProducer()
+	producer.FailWith(errors.New("broker is down"))
+	checkpoints := newMemoryCheckpointStore()
+	relay := newTestDCPRelay(t, producer, checkpoints, 1)
+
+	stream := relay.testStream(0)
+	stream.SnapshotMarker(gocbcore.DcpSnapshotMarker{StartSeqNo: 1, EndSeqNo: 1})
+	stream.Mutation(outboxMutation(t, 1, "a", 1))
+
+	// the lane retries after 100ms, 200ms, ...
+	time.Sleep(300 * time.Millisecond)
+	if checkpoint := relay.testCheckpoint(0); checkpoint.SeqNo != 0 {
+		t.Fatalf("checkpointed seqno %d before it was published", checkpoint.SeqNo)
+	}
+	relay.saveCheckpoints()
+	if _, found, _ := checkpoints.Load(0); found {
+		t.Fatal("saved a checkpoint before anything was published")
+	}
+
+	producer.FailWith(nil)
+	waitForCheckpoint(t, relay, 0, 1)
+	if published := len(producer.Messages()); published != 1 {
+		t.Fatalf("published %d messages, expected 1", published)
+	}
+}
+
+func TestDCPRelaySkipsUndecodableDocumentsWithoutDeadLetters(t *testing.T) {
+	producer := NewFakeProducer()
+	relay := newTestDCPRelay(t, producer, newMemoryCheckpointStore(), 1)
+
+	stream := relay.testStream(0)
+	stream.SnapshotMarker(gocbcore.DcpSnapshotMarker{StartSeqNo: 1, EndSeqNo: 2})
+	stream.Mutation(gocbcore.DcpMutation{SeqNo: 1, Key: []byte("broken"), Value: []byte("{not json")})
+	stream.Mutation(outboxMutation(t, 2, "a", 1))
+
+	waitForCheckpoint(t, relay, 0, 2)
+	messages := producer.Messages()
+	if len(messages) != 1 || messages[0].DocumentKey != "event-2" {
+		t.Fatalf("published %v, expected only event-2", messages)
+	}
+}
+
+func TestDCPRelayResumesFromSavedCheckpoint(t *testing.T) {
+	checkpoints := newMemoryCheckpointStore()
+	checkpoints.Save(Checkpoint{VbID: 0, VbUUID: testVbUUID, SeqNo: 2, SnapStart: 1, SnapEnd: 2})
+	producer := NewFakeProducer()
+	relay := newTestDCPRelay(t, producer, checkpoints, 1)
+
+	// a stream resumed at seqno 2 only delivers what came after it.
+	stream := relay.testStream(0)
+	stream.SnapshotMarker(gocbcore.DcpSnapshotMarker{StartSeqNo: 3, EndSeqNo: 3})
+	stream.Mutation(outboxMutation(t, 3, "a", 3))
+
+	if checkpoint := waitForCheckpoint(t, relay, 0, 3); checkpoint.SnapStart != 3 {
+		t.Fatalf("checkpoint %+v, expected the snapshot of seqno 3", checkpoint)
+	}
+	if published := len(producer.Messages()); published != 1 {
+		t.Fatalf("published %d messages, expected 1", published)
+	}
+}
+
+func TestCheckpointWaitsForEarlierEvents(t *testing.T) {
+	relay := &DCPRelay{vbuckets: []*vbucketState{{owned: true, generation: 1, vbUUID: testVbUUID}}}
+
+	var tracked []*trackedEvent
+	for seqNo := uint64(1); seqNo <= 3; seqNo++ {
+		tracked = append(tracked, relay.track(streamEvent{vbID: 0, generation: 1, seqNo: seqNo, snapStart: 1, snapEnd: 3}))
+	}
+	if stale := relay.track(streamEvent{vbID: 0, generation: 0, seqNo: 4}); stale != nil {
+		t.Fatal("tracked an event of an earlier stream")
+	}
+
+	relay.complete(tracked[2])
+	relay.complete(tracked[1])
+	if seqNo := relay.testCheckpoint(0).SeqNo; seqNo != 0 {
+		t.Fatalf("checkpoint at seqno %d while seqno 1 is pending", seqNo)
+	}
+
+	relay.complete(tracked[0])
+	if seqNo := relay.testCheckpoint(0).SeqNo; seqNo != 3 {
+		t.Fatalf("checkpoint at seqno %d, expected 3", seqNo)
+	}
+}
+
+func TestRollbackCheckpoint(t *testing.T) {
+	// newest branch first, the branch of uuid 2 ran from seqno 100 to 200 and
+	// the current one of uuid 3 is at seqno 250.
+	entries := []gocbcore.FailoverEntry{
+		{VbUUID: 3, SeqNo: 200},
+		{VbUUID: 2, SeqNo: 100},
+		{VbUUID: 1, SeqNo: 0},
+	}
+
+	tests := []struct {
+		name     string
+		from     Checkpoint
+		expected Checkpoint
+	}{
+		{
+			name:     "checkpoint behind the end of its branch",
+			from:     Checkpoint{VbID: 7, VbUUID: 2, SeqNo: 150, SnapStart: 140, SnapEnd: 160},
+			expected: Checkpoint{VbID: 7, VbUUID: 2, SeqNo: 150, SnapStart: 150, SnapEnd: 150},
+		},
+		{
+			name:     "checkpoint past the end of its branch",
+			from:     Checkpoint{VbID: 7, VbUUID: 2, SeqNo: 250, SnapStart: 240, SnapEnd: 260},
+			expected: Checkpoint{VbID: 7, VbUUID: 2, SeqNo: 200, SnapStart: 200, SnapEnd: 200},
+		},
+		{
+			name:     "checkpoint on an old branch",
+			from:     Checkpoint{VbID: 7, VbUUID: 1, SeqNo: 120},
+			expected: Checkpoint{VbID: 7, VbUUID: 1, SeqNo: 100, SnapStart: 100, SnapEnd: 100},
+		},
+		{
+			name:     "checkpoint past the high seqno of the current branch",
+			from:     Checkpoint{VbID: 7, VbUUID: 3, SeqNo: 300, SnapStart: 290, SnapEnd: 310},
+			expected: Checkpoint{VbID: 7, VbUUID: 3, SeqNo: 250, SnapStart: 250, SnapEnd: 250},
+		},
+		{
+			name:     "checkpoint behind the high seqno of the current branch",
+			from:     Checkpoint{VbID: 7, VbUUID: 3, SeqNo: 220, SnapStart: 210, SnapEnd: 230},
+			expected: Checkpoint{VbID: 7, VbUUID: 3, SeqNo: 220, SnapStart: 220, SnapEnd: 220},
+		},
+		{
+			name:     "checkpoint on an unknown branch",
+			from:     Checkpoint{VbID: 7, VbUUID: 9, SeqNo: 50},
+			expected: Checkpoint{VbID: 7},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			to := rollbackCheckpoint(test.from, entries, 250)
+			to.UpdatedAt = time.Time{}
+			if to != test.expected {
+				t.Fatalf("rolled back to %+v, expected %+v", to, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/google/uuid"
+)
+
+const defaultMaxAttempts = 10
+
+// DeadLetter is an outbox document the relay gave up on, either because it
+// could not be decoded or because the producer kept rejecting it.
+type DeadLetter struct {
+	ID string `json:"id"`
+	// Relay is the name of the relay that gave up on the document.
+	Relay       string `json:"relay"`
+	DocumentKey string `json:"documentKey"`
+	// Key is the message key the document is published with.
+	Key string `json:"key"`
+	// Document is the outbox document, Value holds it instead when it is not
+	// valid JSON. Both are left out of listings.
+	Document json.RawMessage `json:"document,omitempty"`
+	Value    []byte          `json:"value,omitempty"`
+	Error    string          `json:"error"`
+	// Attempts counts the publish attempts, including the failed requeues.
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt"`
+}
+
+func newDeadLetter(relay string, message Message, err error, attempts int, firstFailedAt time.Time) DeadLetter {
+	letter := DeadLetter{
+		ID:            uuid.NewString(),
+		Relay:         relay,
+		DocumentKey:   message.DocumentKey,
+		Key:           string(message.Key),
+		Error:         err.Error(),
+		Attempts:      attempts,
+		FirstFailedAt: firstFailedAt.UTC(),
+		LastFailedAt:  time.Now().UTC(),
+	}
+	if json.Valid(message.Value) {
+		letter.Document = message.Value
+	} else {
+		letter.Value = message.Value
+	}
+	if requeued := message.requeued; requeued != nil {
+		letter.ID = requeued.ID
+		letter.Attempts += requeued.Attempts
+		letter.FirstFailedAt = requeued.FirstFailedAt
+	}
+	return letter
+}
+
+// Message returns the message the dead letter is published with when it is
+// requeued.
+func (l DeadLetter) Message() Message {
+	value := l.Value
+	if l.Document != nil {
+		value = l.Document
+	}
+	return Message{Key: []byte(l.Key), Value: value, DocumentKey: l.DocumentKey}
+}
+
+// DeadLetterStore keeps the dead letters until they are requeued or
+// discarded.
+type DeadLetterStore interface {
+	Save(letter DeadLetter) error
+	// Load returns false when there is no dead letter with the id.
+	Load(id string) (DeadLetter, bool, error)
+	// List returns the dead letters without their documents, oldest first.
+	List(offset int, limit int) ([]DeadLetter, error)
+	Remove(id string) error
+}
+
+// CouchbaseDeadLetterStore keeps one document per dead letter keyed by its
+// id, in a collection of its own such as demo.item_outbox_dlq.
+type CouchbaseDeadLetterStore struct {
+	collection *gocb.Collection
+}
+
+func NewCouchbaseDeadLetterStore(collection *gocb.Collection) (*CouchbaseDeadLetterStore, error) {
+	store := &CouchbaseDeadLetterStore{collection: collection}
+
+	statement := "CREATE INDEX `idx_outbox_dlq_failed_at` ON `" + collection.Name() + "`(firstFailedAt, id)"
+	_, err := store.scope().Query(statement, nil)
+	if err != nil && !errors.Is(err, gocb.ErrIndexExists) {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *CouchbaseDeadLetterStore) scope() *gocb.Scope {
+	return s.collection.Bucket().Scope(s.collection.ScopeName())
+}
+
+func (s *CouchbaseDeadLetterStore) Save(letter DeadLetter) error {
+	_, err := s.collection.Upsert(letter.ID, letter, nil)
+	return err
+}
+
+func (s *CouchbaseDeadLetterStore) Load(id string) (DeadLetter, bool, error) {
+	var letter DeadLetter
+
+	result, err := s.collection.Get(id, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return letter, false, nil
+	}
+	if err != nil {
+		return letter, false, err
+	}
+
+	err = result.Content(&letter)
+	return letter, err == nil, err
+}
+
+func (s *CouchbaseDeadLetterStore) List(offset int, limit int) ([]DeadLetter, error) {
+	statement := "SELECT d.id, d.relay, d.documentKey, d.`key`, d.error, d.attempts, d.firstFailedAt, d.lastFailedAt" +
+		" FROM `" + s.collection.Name() + "` AS d" +
+		" WHERE d.firstFailedAt IS NOT MISSING" +
+		" ORDER BY d.firstFailedAt, d.id" +
+		" OFFSET $offset LIMIT $limit"
+
+	result, err := s.scope().Query(statement, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{"offset": offset, "limit": limit},
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+		Readonly:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []DeadLetter{}
+	for result.Next() {
+		var letter DeadLetter
+		if err = result.Row(&letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, result.Err()
+}
+
+func (s *CouchbaseDeadLetterStore) Remove(id string) error {
+	_, err := s.collection.Remove(id, nil)
+	return err
+}
+
+// deadLetterer publishes the records of a relay and moves the ones it cannot
+// publish to the dead letter store, so the relay moves on instead of
+// retrying them forever. A nil deadLetterer retries forever.
+type deadLetterer struct {
+	relay       string
+	store       DeadLetterStore
+	maxAttempts int
+}
+
+func newDeadLetterer(relay string, store DeadLetterStore, maxAttempts int) *deadLetterer {
+	if store == nil {
+		return nil
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	return &deadLetterer{relay: relay, store: store, maxAttempts: maxAttempts}
+}
+
+// publish publishes the messages. When the producer still rejects the batch
+// with a permanent error after the max attempts, the messages are published
+// one by one to find the ones it rejects, and those are dead lettered.
+// Transient errors are retried until the broker is back. It only fails when
+// the context is cancelled, every message has been either published or dead
+// lettered otherwise.
+func (d *deadLetterer) publish(ctx context.Context, producer Producer, messages []Message) error {
+	if d == nil {
+		return publishWithRetry(ctx, producer, messages, 0)
+	}
+
+	firstFailedAt := time.Now()
+	err := publishWithRetry(ctx, producer, messages, d.maxAttempts)
+	if err == nil || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(messages) == 1 {
+		return d.deadLetter(ctx, newDeadLetter(d.relay, messages[0], err, d.maxAttempts, firstFailedAt))
+	}
+
+	for _, message := range messages {
+		firstFailedAt = time.Now()
+		err = publishWithRetry(ctx, producer, []Message{message}, d.maxAttempts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+		if err = d.deadLetter(ctx, newDeadLetter(d.relay, message, err, d.maxAttempts, firstFailedAt)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// undecodable dead letters a document that cannot be decoded right away,
+// publishing it again would not help. Without a dead letter store the document
+// is logged and skipped, it is never published.
+func (d *deadLetterer) undecodable(ctx context.Context, message Message, err error) error {
+	if d == nil {
+		log.Printf("SKIPPED outbox document %s could not be decoded and there are no dead letters: %s: %s", message.DocumentKey, err, message.Value)
+		return nil
+	}
+	return d.deadLetter(ctx, newDeadLetter(d.relay, message, err, 0, time.Now()))
+}
+
+// deadLetter saves the dead letter, retrying until it is saved or the context
+// is cancelled. The record must not be acknowledged before.
+func (d *deadLetterer) deadLetter(ctx context.Context, letter DeadLetter) error {
+	for {
+		err := d.store.Save(letter)
+		if err == nil {
+			log.Printf("DEAD LETTER %s outbox document %s moved to the dead letters after %d attempts: %s", letter.ID, letter.DocumentKey, letter.Attempts, letter.Error)
+			return nil
+		}
+		log.Printf("could not save the dead letter of outbox document %s, retrying: %s", letter.DocumentKey, err)
+
+		select {
+		case <-time.After(reopenDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// memoryDeadLetterStore keeps the dead letters in the order they were first
+// saved.
+type memoryDeadLetterStore struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (s *memoryDeadLetterStore) Save(letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.letters {
+		if s.letters[i].ID == letter.ID {
+			s.letters[i] = letter
+			return nil
+		}
+	}
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *memoryDeadLetterStore) Load(id string) (DeadLetter, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, letter := range s.letters {
+		if letter.ID == id {
+			return letter, true, nil
+		}
+	}
+	return DeadLetter{}, false, nil
+}
+
+func (s *memoryDeadLetterStore) List(offset int, limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset > len(s.letters) {
+		return nil, nil
+	}
+	letters := s.letters[offset:]
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return append([]DeadLetter(nil), letters...), nil
+}
+
+func (s *memoryDeadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, letter := range s.letters {
+		if letter.ID == id {
+			s.letters = append(s.letters[:i], s.letters[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func testMessages(documentKeys ...string) []Message {
+	messages := make([]Message, len(documentKeys))
+	for i, documentKey := range documentKeys {
+		messages[i] = Message{Key: []byte("a"), Value: []byte(`{}`), DocumentKey: documentKey}
+	}
+	return messages
+}
+
+func TestDeadLettererDeadLettersPermanentlyRejectedMessages(t *testing.T) {
+	producer := NewFakeProducer()
+	producer.Reject("event-2", &PermanentError{Err: kafka.MessageSizeTooLarge})
+	store := &memoryDeadLetterStore{}
+	deadLetters := newDeadLetterer("test-relay", store, 2)
+
+	if err := deadLetters.publish(context.Background(), producer, testMessages("event-1", "event-2", "event-3")); err != nil {
+		t.Fatal(err)
+	}
+
+	var published []string
+	for _, message := range producer.Messages() {
+		published = append(published, message.DocumentKey)
+	}
+	if fmt.Sprint(published) != "[event-1 event-3]" {
+		t.Fatalf("published %v, expected [event-1 event-3]", published)
+	}
+	if len(store.letters) != 1 || store.letters[0].DocumentKey != "event-2" || store.letters[0].Attempts != 2 {
+		t.Fatalf("dead lettered %+v, expected event-2 after 2 attempts", store.letters)
+	}
+}
+
+func TestDeadLettererRetriesTransientErrors(t *testing.T) {
+	producer := NewFakeProducer()
+	producer.FailWith(errors.New("broker is down"))
+	store := &memoryDeadLetterStore{}
+	deadLetters := newDeadLetterer("test-relay", store, 1)
+
+	published := make(chan error, 1)
+	go func() {
+		published <- deadLetters.publish(context.Background(), producer, testMessages("event-1", "event-2"))
+	}()
+
+	// the publisher retries after 100ms, 200ms, ...
+	select {
+	case err := <-published:
+		t.Fatalf("gave up on a transient error with %v", err)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	producer.FailWith(nil)
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.Messages()) != 2 || len(store.letters) != 0 {
+		t.Fatalf("published %d messages and dead lettered %d, expected 2 and none", len(producer.Messages()), len(store.letters))
+	}
+}
+
+func TestPermanentKafkaError(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{kafka.MessageSizeTooLarge, true},
+		{fmt.Errorf("%w: 2MB", kafka.InvalidRecord), true},
+		{kafka.MessageTooLargeError{}, true},
+		{kafka.WriteErrors{nil, kafka.InvalidMessage}, true},
+		{kafka.WriteErrors{kafka.NotLeaderForPartition, kafka.InvalidMessageSize}, true},
+		{kafka.WriteErrors{nil, kafka.NotLeaderForPartition}, false},
+		{kafka.LeaderNotAvailable, false},
+		{kafka.RequestTimedOut, false},
+		{io.EOF, false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if permanent := permanentKafkaError(test.err); permanent != test.permanent {
+			t.Errorf("%v is permanent: %t, expected %t", test.err, permanent, test.permanent)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaProducer publishes messages to a Kafka topic. Messages are partitioned
+// by key with the murmur2 hash of the Java client, so the relay and the
+// connector put the events of an aggregate on the same partition.
+type KafkaProducer struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaProducer(brokers []string, topic string) *KafkaProducer {
+	return &KafkaProducer{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Murmur2Balancer{},
+			RequiredAcks: kafka.RequireAll,
+			// a batch is handed over in one call, there is nothing to wait for.
+			BatchTimeout: 10 * time.Millisecond,
+		},
+	}
+}
+
+func (p *KafkaProducer) Publish(ctx context.Context, messages []Message) error {
+	kafkaMessages := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		kafkaMessages[i] = kafka.Message{Key: message.Key, Value: message.Value}
+	}
+
+	err := p.writer.WriteMessages(ctx, kafkaMessages...)
+	if permanentKafkaError(err) {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+func (p *KafkaProducer) Close() error {
+	return p.writer.Close()
+}
+
+// permanentKafkaErrors are the errors the broker rejects a message itself
+// with, writing it again fails the same way. Everything else, like a leader
+// election or an unreachable broker, passes.
+var permanentKafkaErrors = []kafka.Error{
+	kafka.InvalidMessage,
+	kafka.InvalidMessageSize,
+	kafka.MessageSizeTooLarge,
+	kafka.InvalidRecord,
+}
+
+// permanentKafkaError tells whether the writer rejected a message of the batch
+// for good.
+func permanentKafkaError(err error) bool {
+	var writeErrors kafka.WriteErrors
+	if errors.As(err, &writeErrors) {
+		for _, writeErr := range writeErrors {
+			if writeErr != nil && permanentKafkaError(writeErr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var tooLarge kafka.MessageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return true
+	}
+	for _, permanent := range permanentKafkaErrors {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
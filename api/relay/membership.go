@@ -0,0 +1,221 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+const (
+	defaultHeartbeatInterval = 2 * time.Second
+	defaultLeaseTimeout      = 10 * time.Second
+
+	maxMembershipUpdateAttempts = 10
+)
+
+// MembershipOptions configure a Membership. HeartbeatInterval and
+// LeaseTimeout fall back to defaults when zero.
+type MembershipOptions struct {
+	// Group is the name shared by the relay instances that split the vBuckets.
+	Group string
+	// InstanceID identifies this instance within the group.
+	InstanceID string
+	// HeartbeatInterval is how often the instance renews its membership.
+	HeartbeatInterval time.Duration
+	// LeaseTimeout is how long an instance stays a member, and keeps its
+	// vBuckets, after its last heartbeat. It has to exceed the
+	// HeartbeatInterval, an instance that could not renew its membership
+	// stops streaming a heartbeat before its lease runs out.
+	LeaseTimeout time.Duration
+}
+
+// Membership splits the vBuckets between the relay instances of a group the
+// way tasks.max splits them between the tasks of the connector. The members
+// and the vBucket leases are kept in one document per group that every
+// heartbeat updates with CAS. A vBucket is leased to at most one instance at
+// a time, the instance it is assigned to only gets the lease after the
+// previous owner released it or left the group.
+type Membership struct {
+	collection *gocb.Collection
+	opts       MembershipOptions
+}
+
+// Assignment is the share of the vBuckets of one instance.
+type Assignment struct {
+	// Members are the live instances of the group in assignment order.
+	Members []string
+	// Assigned are the vBuckets the instance should stream.
+	Assigned map[uint16]bool
+	// Leased are the vBuckets the instance holds the lease of. A vBucket that
+	// is leased but no longer assigned has to be stopped and released.
+	Leased map[uint16]bool
+}
+
+type membershipDocument struct {
+	// Members maps the instance ids to their last heartbeat in unix millis.
+	Members map[string]int64 `json:"members"`
+	// Leases maps the vBucket ids to the instance holding them.
+	Leases map[string]string `json:"leases"`
+}
+
+func NewMembership(collection *gocb.Collection, opts MembershipOptions) *Membership {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.LeaseTimeout <= 0 {
+		opts.LeaseTimeout = defaultLeaseTimeout
+	}
+
+	return &Membership{collection: collection, opts: opts}
+}
+
+func (m *Membership) key() string {
+	return m.opts.Group + "::membership"
+}
+
+// streamDeadline is when an instance whose last successful sync started at
+// lastSync has to stop streaming. It is a heartbeat before the lease runs out,
+// so the instance stops before another one can take its vBuckets over.
+func (m *Membership) streamDeadline(lastSync time.Time) time.Time {
+	return lastSync.Add(m.opts.LeaseTimeout - m.opts.HeartbeatInterval)
+}
+
+// Sync renews the membership of the instance, drops the members that missed
+// their lease timeout along with their leases, gives up the leases of the
+// released vBuckets and takes the free leases of the vBuckets assigned to
+// the instance.
+func (m *Membership) Sync(numVbuckets int, released []uint16) (Assignment, error) {
+	var assignment Assignment
+
+	err := m.update(func(doc *membershipDocument) {
+		now := time.Now()
+		doc.Members[m.opts.InstanceID] = now.UnixMilli()
+		for member, heartbeat := range doc.Members {
+			if now.Sub(time.UnixMilli(heartbeat)) > m.opts.LeaseTimeout {
+				log.Printf("relay instance %s missed its heartbeat, removing it from group %s", member, m.opts.Group)
+				delete(doc.Members, member)
+			}
+		}
+
+		for vb, owner := range doc.Leases {
+			if _, alive := doc.Members[owner]; !alive {
+				delete(doc.Leases, vb)
+			}
+		}
+		for _, vbID := range released {
+			vb := strconv.Itoa(int(vbID))
+			if doc.Leases[vb] == m.opts.InstanceID {
+				delete(doc.Leases, vb)
+			}
+		}
+
+		assignment = Assignment{
+			Members:  make([]string, 0, len(doc.Members)),
+			Assigned: map[uint16]bool{},
+			Leased:   map[uint16]bool{},
+		}
+		for member := range doc.Members {
+			assignment.Members = append(assignment.Members, member)
+		}
+		sort.Strings(assignment.Members)
+
+		for vbID, member := range assignVbuckets(assignment.Members, numVbuckets) {
+			if member != m.opts.InstanceID {
+				continue
+			}
+			assignment.Assigned[uint16(vbID)] = true
+
+			vb := strconv.Itoa(vbID)
+			if _, leased := doc.Leases[vb]; !leased {
+				doc.Leases[vb] = m.opts.InstanceID
+			}
+		}
+
+		for vb, owner := range doc.Leases {
+			if owner != m.opts.InstanceID {
+				continue
+			}
+			vbID, err := strconv.Atoi(vb)
+			if err == nil {
+				assignment.Leased[uint16(vbID)] = true
+			}
+		}
+	})
+
+	return assignment, err
+}
+
+// Leave removes the instance and its leases from the group so the other
+// members take over its vBuckets without waiting for the lease timeout.
+func (m *Membership) Leave() error {
+	return m.update(func(doc *membershipDocument) {
+		delete(doc.Members, m.opts.InstanceID)
+		for vb, owner := range doc.Leases {
+			if owner == m.opts.InstanceID {
+				delete(doc.Leases, vb)
+			}
+		}
+	})
+}
+
+// update applies change to the membership document and writes it back with
+// CAS, starting over when another instance changed it in the meantime.
+func (m *Membership) update(change func(doc *membershipDocument)) error {
+	for attempt := 0; attempt < maxMembershipUpdateAttempts; attempt++ {
+		doc := membershipDocument{}
+		var cas gocb.Cas
+
+		result, err := m.collection.Get(m.key(), nil)
+		if err != nil && !errors.Is(err, gocb.ErrDocumentNotFound) {
+			return err
+		}
+		if err == nil {
+			if err = result.Content(&doc); err != nil {
+				return err
+			}
+			cas = result.Cas()
+		}
+		if doc.Members == nil {
+			doc.Members = map[string]int64{}
+		}
+		if doc.Leases == nil {
+			doc.Leases = map[string]string{}
+		}
+
+		change(&doc)
+
+		if cas == 0 {
+			_, err = m.collection.Insert(m.key(), doc, nil)
+		} else {
+			_, err = m.collection.Replace(m.key(), doc, &gocb.ReplaceOptions{Cas: cas})
+		}
+		if errors.Is(err, gocb.ErrCasMismatch) || errors.Is(err, gocb.ErrDocumentExists) {
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("membership of group %s changed concurrently %d times in a row", m.opts.Group, maxMembershipUpdateAttempts)
+}
+
+// assignVbuckets splits the vBuckets into contiguous ranges of nearly equal
+// size, one per member in the given order.
+func assignVbuckets(members []string, numVbuckets int) []string {
+	assigned := make([]string, numVbuckets)
+	if len(members) == 0 {
+		return assigned
+	}
+
+	for i, member := range members {
+		for vbID := i * numVbuckets / len(members); vbID < (i+1)*numVbuckets/len(members); vbID++ {
+			assigned[vbID] = member
+		}
+	}
+
+	return assigned
+}
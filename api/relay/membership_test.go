@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssignVbuckets(t *testing.T) {
+	tests := []struct {
+		members     int
+		numVbuckets int
+	}{
+		{1, 1024}, {2, 1024}, {3, 1024}, {7, 1024}, {3, 64}, {5, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d members %d vBuckets", test.members, test.numVbuckets), func(t *testing.T) {
+			members := make([]string, test.members)
+			for i := range members {
+				members[i] = fmt.Sprintf("relay-%d", i)
+			}
+
+			assigned := assignVbuckets(members, test.numVbuckets)
+			if len(assigned) != test.numVbuckets {
+				t.Fatalf("assigned %d vBuckets, expected %d", len(assigned), test.numVbuckets)
+			}
+
+			// every vBucket goes to a member, in contiguous ranges in member order.
+			index := map[string]int{}
+			for i, member := range members {
+				index[member] = i
+			}
+			counts := map[string]int{}
+			for vbID, member := range assigned {
+				if _, found := index[member]; !found {
+					t.Fatalf("vBucket %d is assigned to %q", vbID, member)
+				}
+				if vbID > 0 && index[member] < index[assigned[vbID-1]] {
+					t.Fatalf("vBucket %d is assigned to %s out of order", vbID, member)
+				}
+				counts[member]++
+			}
+
+			lowest, highest := test.numVbuckets, 0
+			for _, member := range members {
+				if counts[member] < lowest {
+					lowest = counts[member]
+				}
+				if counts[member] > highest {
+					highest = counts[member]
+				}
+			}
+			if highest-lowest > 1 {
+				t.Fatalf("members got between %d and %d vBuckets", lowest, highest)
+			}
+		})
+	}
+
+	if assigned := assignVbuckets(nil, 4); !reflect.DeepEqual(assigned, []string{"", "", "", ""}) {
+		t.Fatalf("assigned %v without members", assigned)
+	}
+}
+
+func vbucketSet(from, to int) map[uint16]bool {
+	set := map[uint16]bool{}
+	for vbID := from; vbID <= to; vbID++ {
+		set[uint16(vbID)] = true
+	}
+	return set
+}
+
+func TestMembershipHandsOverReleasedLeases(t *testing.T) {
+	collection := testCollection(t)
+
+	const numVbuckets = 8
+	a := NewMembership(collection, MembershipOptions{Group: "test-relay", InstanceID: "a"})
+	b := NewMembership(collection, MembershipOptions{Group: "test-relay", InstanceID: "b"})
+
+	expectSync := func(m *Membership, released []uint16, members []string, assigned, leased map[uint16]bool) {
+		t.Helper()
+
+		var assignment Assignment
+		eventually(t, func() (err error) {
+			assignment, err = m.Sync(numVbuckets, released)
+			return err
+		})
+		if !reflect.DeepEqual(assignment.Members, members) {
+			t.Fatalf("%s sees members %v, expected %v", m.opts.InstanceID, assignment.Members, members)
+		}
+		if !reflect.DeepEqual(assignment.Assigned, assigned) {
+			t.Fatalf("%s is assigned %v, expected %v", m.opts.InstanceID, assignment.Assigned, assigned)
+		}
+		if !reflect.DeepEqual(assignment.Leased, leased) {
+			t.Fatalf("%s leases %v, expected %v", m.opts.InstanceID, assignment.Leased, leased)
+		}
+	}
+
+	expectSync(a, nil, []string{"a"}, vbucketSet(0, 7), vbucketSet(0, 7))
+
+	// b is assigned half of the vBuckets but a still streams them.
+	expectSync(b, nil, []string{"a", "b"}, vbucketSet(4, 7), map[uint16]bool{})
+	expectSync(a, nil, []string{"a", "b"}, vbucketSet(0, 3), vbucketSet(0, 7))
+
+	// a releases them once it stopped streaming them.
+	expectSync(a, []uint16{4, 5, 6, 7}, []string{"a", "b"}, vbucketSet(0, 3), vbucketSet(0, 3))
+	expectSync(b, nil, []string{"a", "b"}, vbucketSet(4, 7), vbucketSet(4, 7))
+
+	if err := b.Leave(); err != nil {
+		t.Fatal(err)
+	}
+	expectSync(a, nil, []string{"a"}, vbucketSet(0, 7), vbucketSet(0, 7))
+}
+
+func TestMembershipStreamDeadline(t *testing.T) {
+	lastSync := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		opts     MembershipOptions
+		deadline time.Time
+	}{
+		{MembershipOptions{}, lastSync.Add(8 * time.Second)},
+		{MembershipOptions{HeartbeatInterval: 5 * time.Second, LeaseTimeout: 30 * time.Second}, lastSync.Add(25 * time.Second)},
+	}
+
+	for _, test := range tests {
+		m := NewMembership(nil, test.opts)
+		if deadline := m.streamDeadline(lastSync); !deadline.Equal(test.deadline) {
+			t.Errorf("stream deadline with %+v is %s, expected %s", test.opts, deadline, test.deadline)
+		}
+	}
+}
+
+func TestNewDCPRelayRejectsHeartbeatsSlowerThanTheLease(t *testing.T) {
+	_, err := NewDCPRelay(DCPRelayOptions{
+		Name:        "test-relay",
+		Checkpoints: newMemoryCheckpointStore(),
+		Producer:    NewFakeProducer(),
+		Membership:  NewMembership(nil, MembershipOptions{HeartbeatInterval: 10 * time.Second, LeaseTimeout: 5 * time.Second}),
+	})
+	if err == nil || !strings.Contains(err.Error(), "must be shorter than its lease timeout") {
+		t.Fatalf("creating the relay returned %v, expected a heartbeat error", err)
+	}
+}
@@ -0,0 +1,311 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocb/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultMaxInFlight  = 1
+	defaultClaimTimeout = 30 * time.Second
+
+	// claimXattr is the extended attribute the polling relay keeps its claim
+	// and publish marks in, so the published document body stays untouched.
+	claimXattr = "relay"
+	// PublishedAtXattr is the path of the publish mark of the polling relay,
+	// unix millis of when the document was published.
+	PublishedAtXattr = claimXattr + ".publishedAt"
+)
+
+// PollRelayOptions configure a PollRelay. BatchSize, PollInterval,
+// MaxInFlight, ClaimTimeout and MaxAttempts fall back to defaults when zero.
+type PollRelayOptions struct {
+	// Name identifies the relay in the claims it puts on documents.
+	Name       string
+	Collection *gocb.Collection
+	Producer   Producer
+	Envelope   outbox.Envelope
+	// Format is the envelope format of the outbox documents.
+	Format string
+
+	BatchSize    int
+	PollInterval time.Duration
+	// MaxInFlight is the number of batches published concurrently. With more
+	// than one, batches may overtake each other and events are no longer
+	// published in occurrence time order.
+	MaxInFlight int
+	// ClaimTimeout is how long a claimed document is left to its relay
+	// before other relays may claim it again.
+	ClaimTimeout time.Duration
+	// Delete removes published documents instead of marking them published.
+	Delete bool
+	// DeadLetters, when set, receives the documents that cannot be decoded
+	// or are still rejected with a PermanentError after MaxAttempts. They are
+	// marked published or removed like the published ones.
+	DeadLetters DeadLetterStore
+	MaxAttempts int
+}
+
+// PollRelay publishes the outbox collection by polling it with N1QL, for
+// environments where the application user is not granted DCP access. Each
+// batch is claimed document by document with CAS, so concurrent relays never
+// publish the same document unless a claim times out. Only the event outbox
+// mode is supported, aggregate documents have no occurrence time.
+type PollRelay struct {
+	opts        PollRelayOptions
+	scope       *gocb.Scope
+	owner       string
+	orderField  string
+	deadLetters *deadLetterer
+}
+
+// claimedDocument is an outbox document claimed by this relay, cas is the CAS
+// of the claim.
+type claimedDocument struct {
+	id    string
+	cas   gocb.Cas
+	value []byte
+}
+
+func NewPollRelay(opts PollRelayOptions) (*PollRelay, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = defaultMaxInFlight
+	}
+	if opts.ClaimTimeout <= 0 {
+		opts.ClaimTimeout = defaultClaimTimeout
+	}
+
+	orderField, err := outbox.OccurrenceTimeField(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	relay := &PollRelay{
+		opts:        opts,
+		scope:       opts.Collection.Bucket().Scope(opts.Collection.ScopeName()),
+		owner:       opts.Name + "::" + uuid.NewString(),
+		orderField:  orderField,
+		deadLetters: newDeadLetterer(opts.Name, opts.DeadLetters, opts.MaxAttempts),
+	}
+	if err = relay.ensureIndex(); err != nil {
+		return nil, fmt.Errorf("could not create the outbox poll index: %w", err)
+	}
+
+	return relay, nil
+}
+
+// ensureIndex provisions the index of the poll query. It only holds the
+// documents that have not been published yet.
+func (r *PollRelay) ensureIndex() error {
+	statement := "CREATE INDEX `idx_outbox_relay_poll_" + r.opts.Format + "` ON `" + r.opts.Collection.Name() + "`" +
+		"(" + r.orderField + ", META().xattrs." + claimXattr + ".claimedUntil)" +
+		" WHERE META().xattrs." + PublishedAtXattr + " IS MISSING"
+
+	_, err := r.scope.Query(statement, nil)
+	if errors.Is(err, gocb.ErrIndexExists) {
+		return nil
+	}
+	return err
+}
+
+// Run polls and publishes until the context is cancelled. A poll that filled
+// a whole batch is followed by the next one right away.
+func (r *PollRelay) Run(ctx context.Context) error {
+	inFlight := make(chan struct{}, r.opts.MaxInFlight)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		batch, err := r.claimBatch()
+		if err != nil {
+			log.Printf("could not poll the outbox: %s", err)
+		}
+
+		if len(batch) == 0 {
+			<-inFlight
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				r.publish(ctx, batch)
+			}()
+		}
+
+		if len(batch) < r.opts.BatchSize {
+			select {
+			case <-time.After(r.opts.PollInterval):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// claimBatch queries the oldest unpublished and unclaimed documents and
+// claims them. Documents claimed or changed by someone else since the query
+// ran are skipped.
+func (r *PollRelay) claimBatch() ([]claimedDocument, error) {
+	statement := "SELECT RAW META(o).id FROM `" + r.opts.Collection.Name() + "` AS o" +
+		" WHERE " + "o." + r.orderField + " IS NOT MISSING" +
+		" AND META(o).xattrs." + PublishedAtXattr + " IS MISSING" +
+		" AND (META(o).xattrs." + claimXattr + ".claimedUntil IS MISSING OR META(o).xattrs." + claimXattr + ".claimedUntil < $now)" +
+		" ORDER BY o." + r.orderField + ", META(o).id" +
+		" LIMIT $limit"
+
+	result, err := r.scope.Query(statement, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{
+			"now":   time.Now().UnixMilli(),
+			"limit": r.opts.BatchSize,
+		},
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for result.Next() {
+		var id string
+		if err = result.Row(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = result.Err(); err != nil {
+		return nil, err
+	}
+
+	batch := make([]claimedDocument, 0, len(ids))
+	for _, id := range ids {
+		doc, claimed, err := r.claim(id)
+		if err != nil {
+			log.Printf("could not claim outbox document %s: %s", id, err)
+			continue
+		}
+		if claimed {
+			batch = append(batch, doc)
+		}
+	}
+
+	return batch, nil
+}
+
+// claim reads the document and puts the claim of this relay on it with the
+// CAS it was read with. It returns false when the document has been claimed,
+// published or removed by someone else in the meantime.
+func (r *PollRelay) claim(id string) (claimedDocument, bool, error) {
+	result, err := r.opts.Collection.LookupIn(id, []gocb.LookupInSpec{
+		gocb.GetSpec(claimXattr, &gocb.GetSpecOptions{IsXattr: true}),
+		gocb.GetSpec("", nil),
+	}, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return claimedDocument{}, false, nil
+	}
+	if err != nil {
+		return claimedDocument{}, false, err
+	}
+
+	var mark struct {
+		ClaimedUntil int64 `json:"claimedUntil"`
+		PublishedAt  int64 `json:"publishedAt"`
+	}
+	if result.Exists(0) {
+		if err = result.ContentAt(0, &mark); err != nil {
+			return claimedDocument{}, false, err
+		}
+	}
+	now := time.Now()
+	if mark.PublishedAt != 0 || mark.ClaimedUntil >= now.UnixMilli() {
+		return claimedDocument{}, false, nil
+	}
+
+	var value json.RawMessage
+	if err = result.ContentAt(1, &value); err != nil {
+		return claimedDocument{}, false, err
+	}
+
+	claimed, err := r.opts.Collection.MutateIn(id, []gocb.MutateInSpec{
+		gocb.UpsertSpec(claimXattr+".claimedBy", r.owner, &gocb.UpsertSpecOptions{IsXattr: true, CreatePath: true}),
+		gocb.UpsertSpec(claimXattr+".claimedUntil", now.Add(r.opts.ClaimTimeout).UnixMilli(), &gocb.UpsertSpecOptions{IsXattr: true, CreatePath: true}),
+	}, &gocb.MutateInOptions{Cas: result.Cas(), PreserveExpiry: true})
+	if errors.Is(err, gocb.ErrCasMismatch) || errors.Is(err, gocb.ErrDocumentNotFound) {
+		return claimedDocument{}, false, nil
+	}
+	if err != nil {
+		return claimedDocument{}, false, err
+	}
+
+	return claimedDocument{id: id, cas: claimed.Cas(), value: value}, true, nil
+}
+
+// Requeue publishes the document of the dead letter like a polled batch.
+func (r *PollRelay) Requeue(ctx context.Context, letter DeadLetter) error {
+	message, _, err := keyedMessage(r.opts.Envelope, []byte(letter.DocumentKey), letter.Message().Value)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUndecodable, err)
+	}
+	message.requeued = &letter
+
+	return r.deadLetters.publish(ctx, r.opts.Producer, []Message{message})
+}
+
+// publish retries the batch until it is published, dead lettered or the
+// context is cancelled, then marks or removes the documents. A document whose claim was
+// taken over by another relay in the meantime is left to that relay.
+func (r *PollRelay) publish(ctx context.Context, batch []claimedDocument) {
+	messages := make([]Message, 0, len(batch))
+	for _, doc := range batch {
+		message, _, err := keyedMessage(r.opts.Envelope, []byte(doc.id), doc.value)
+		if err != nil {
+			if r.deadLetters.undecodable(ctx, message, err) != nil {
+				return
+			}
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	if len(messages) > 0 {
+		if err := r.deadLetters.publish(ctx, r.opts.Producer, messages); err != nil {
+			return
+		}
+	}
+
+	for _, doc := range batch {
+		var err error
+		if r.opts.Delete {
+			_, err = r.opts.Collection.Remove(doc.id, &gocb.RemoveOptions{Cas: doc.cas})
+		} else {
+			_, err = r.opts.Collection.MutateIn(doc.id, []gocb.MutateInSpec{
+				gocb.UpsertSpec(PublishedAtXattr, time.Now().UnixMilli(), &gocb.UpsertSpecOptions{IsXattr: true, CreatePath: true}),
+				gocb.RemoveSpec(claimXattr+".claimedUntil", &gocb.RemoveSpecOptions{IsXattr: true}),
+			}, &gocb.MutateInOptions{Cas: doc.cas, PreserveExpiry: true})
+		}
+		if err != nil {
+			log.Printf("could not mark outbox document %s published: %s", doc.id, err)
+		}
+	}
+}
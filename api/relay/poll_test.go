@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocb/v2"
+	"github.com/google/uuid"
+)
+
+// couchbaseTestEnv gates the tests that need a Couchbase server. It holds the
+// connection string, the credentials, TLS settings, bucket and scope are read
+// from the COUCHBASE_* envs of the api.
+const couchbaseTestEnv = "COUCHBASE_TEST_HOST"
+
+// testCollection connects to the Couchbase server of couchbaseTestEnv and
+// creates a collection of its own for the test, it is dropped afterwards.
+func testCollection(t *testing.T) *gocb.Collection {
+	t.Helper()
+
+	host, set := os.LookupEnv(couchbaseTestEnv)
+	if !set {
+		t.Skip(couchbaseTestEnv + " env is not set")
+	}
+
+	t.Setenv("COUCHBASE_HOST", host)
+	cb, err := config.CouchbaseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := cb.Connect(cb.Username, cb.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Close(nil) })
+
+	bucket := cluster.Bucket(os.Getenv("COUCHBASE_BUCKET"))
+	if err = bucket.WaitUntilReady(connectTimeout, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := gocb.CollectionSpec{
+		Name:      "relay_test_" + uuid.NewString()[:8],
+		ScopeName: os.Getenv("COUCHBASE_SCOPE"),
+	}
+	if err = bucket.Collections().CreateCollection(spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := bucket.Collections().DropCollection(spec, nil); err != nil {
+			t.Logf("could not drop collection %s: %s", spec.Name, err)
+		}
+	})
+
+	return bucket.Scope(spec.ScopeName).Collection(spec.Name)
+}
+
+// eventually retries f until it succeeds, a new collection takes a moment to
+// show up on every service.
+func eventually(t *testing.T, f func() error) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func TestPollRelayPublishesInOccurrenceTimeOrder(t *testing.T) {
+	collection := testCollection(t)
+
+	envelope, _ := outbox.NewEnvelope(outbox.FormatCloudEvents, "/relay/test")
+	start := time.Now().Add(-time.Minute)
+	events := []outbox.Event{
+		{ID: "event-3", AggregateType: "item", AggregateID: "a", Type: outbox.EventTypeUpdated, Sequence: 2, OccurrenceTime: start.Add(2 * time.Second)},
+		{ID: "event-1", AggregateType: "item", AggregateID: "a", Type: outbox.EventTypeCreated, Sequence: 1, OccurrenceTime: start},
+		{ID: "event-2", AggregateType: "item", AggregateID: "b", Type: outbox.EventTypeCreated, Sequence: 1, OccurrenceTime: start.Add(time.Second)},
+	}
+	for _, event := range events {
+		document, err := envelope.Wrap(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, func() error {
+			_, err := collection.Insert(event.ID, document, nil)
+			if errors.Is(err, gocb.ErrDocumentExists) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	producer := NewFakeProducer()
+	producer.FailWith(errors.New("broker is down"))
+
+	var relay *PollRelay
+	eventually(t, func() (err error) {
+		relay, err = NewPollRelay(PollRelayOptions{
+			Name:         "test-relay",
+			Collection:   collection,
+			Producer:     producer,
+			Envelope:     envelope,
+			Format:       outbox.FormatCloudEvents,
+			PollInterval: 100 * time.Millisecond,
+		})
+		return err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- relay.Run(ctx)
+	}()
+	var stopOnce sync.Once
+	var runErr error
+	stop := func() error {
+		stopOnce.Do(func() {
+			cancel()
+			runErr = <-stopped
+		})
+		return runErr
+	}
+	defer stop()
+
+	time.Sleep(time.Second)
+	for _, event := range events {
+		if published(t, collection, event.ID) {
+			t.Fatalf("%s is marked published while the broker is down", event.ID)
+		}
+	}
+
+	producer.FailWith(nil)
+	eventually(t, func() error {
+		if n := len(producer.Messages()); n < len(events) {
+			return errors.New("not every event has been published yet")
+		}
+		return nil
+	})
+
+	expected := []struct{ documentKey, key string }{{"event-1", "a"}, {"event-2", "b"}, {"event-3", "a"}}
+	messages := producer.Messages()
+	if len(messages) != len(expected) {
+		t.Fatalf("published %d messages, expected %d", len(messages), len(expected))
+	}
+	for i, message := range messages {
+		if message.DocumentKey != expected[i].documentKey || string(message.Key) != expected[i].key {
+			t.Fatalf("message %d is %s keyed %s, expected %s keyed %s", i, message.DocumentKey, message.Key, expected[i].documentKey, expected[i].key)
+		}
+	}
+	eventually(t, func() error {
+		for _, event := range events {
+			if !published(t, collection, event.ID) {
+				return errors.New(event.ID + " is not marked published")
+			}
+		}
+		return nil
+	})
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if producer.Closed() {
+		t.Fatal("the relay closed the producer it was given")
+	}
+}
+
+func published(t *testing.T, collection *gocb.Collection, id string) bool {
+	t.Helper()
+
+	result, err := collection.LookupIn(id, []gocb.LookupInSpec{
+		gocb.ExistsSpec(PublishedAtXattr, &gocb.ExistsSpecOptions{IsXattr: true}),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.Exists(0)
+}
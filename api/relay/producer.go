@@ -0,0 +1,181 @@
+// Package relay publishes the documents of the outbox collection to Kafka
+// without the Kafka Connect couchbase connector.
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+)
+
+const maxPublishDelay = 30 * time.Second
+
+// Message is one outbox document as published to Kafka.
+type Message struct {
+	Key   []byte
+	Value []byte
+	// DocumentKey is the key of the outbox document the message was read from.
+	DocumentKey string
+
+	// requeued is the dead letter the message was requeued from, it is
+	// updated instead of a new one saved when the message fails again.
+	requeued *DeadLetter
+}
+
+// Producer publishes messages to the message broker. Publish either publishes
+// all messages of the batch in order or returns an error, in which case the
+// relay publishes the batch again.
+type Producer interface {
+	Publish(ctx context.Context, messages []Message) error
+	Close() error
+}
+
+// keyedMessage keys the outbox document by the id of its aggregate so all
+// events of an aggregate land on one partition, it returns the events the
+// document holds as well. Documents that cannot be decoded are keyed by their
+// document key, along with the decoding error.
+func keyedMessage(envelope outbox.Envelope, documentKey []byte, value []byte) (Message, []outbox.Event, error) {
+	message := Message{Key: documentKey, Value: value, DocumentKey: string(documentKey)}
+
+	events, err := outbox.DecodeRecord(envelope, value)
+	if err != nil || len(events) == 0 {
+		return message, nil, err
+	}
+
+	message.Key = []byte(events[0].AggregateID)
+	return message, events, nil
+}
+
+// PermanentError wraps an error of the producer that publishing the messages
+// again will not fix, like a message the broker rejects as too large. Only
+// those are dead lettered, every other error is retried until the broker is
+// back.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func permanentError(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// publishWithRetry publishes the messages with an exponential backoff until
+// the producer accepts them or the context is cancelled. When maxAttempts is
+// not zero it gives up on a permanent error once maxAttempts attempts failed
+// and returns it, transient errors are retried regardless.
+func publishWithRetry(ctx context.Context, producer Producer, messages []Message, maxAttempts int) error {
+	delay := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := producer.Publish(ctx, messages)
+		if err == nil {
+			return nil
+		}
+		if maxAttempts > 0 && attempt >= maxAttempts && permanentError(err) {
+			log.Printf("could not publish %d messages after %d attempts: %s", len(messages), attempt, err)
+			return err
+		}
+		log.Printf("could not publish %d messages, retrying in %s: %s", len(messages), delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxPublishDelay {
+			delay = maxPublishDelay
+		}
+	}
+}
+
+// FakeProducer keeps the published messages in memory, it lets the relay run
+// without a broker.
+type FakeProducer struct {
+	mu       sync.Mutex
+	messages []Message
+	err      error
+	rejected map[string]error
+	closed   bool
+}
+
+func NewFakeProducer() *FakeProducer {
+	return &FakeProducer{}
+}
+
+func (p *FakeProducer) Publish(ctx context.Context, messages []Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if err := p.rejected[message.DocumentKey]; err != nil {
+			return err
+		}
+	}
+
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *FakeProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+// Messages returns the messages published so far in the order they were published.
+func (p *FakeProducer) Messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	messages := make([]Message, len(p.messages))
+	copy(messages, p.messages)
+	return messages
+}
+
+// FailWith makes every following Publish fail with err until it is called
+// again with nil.
+func (p *FakeProducer) FailWith(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.err = err
+}
+
+// Reject makes every following Publish of a batch with the outbox document
+// fail with err, nil accepts it again.
+func (p *FakeProducer) Reject(documentKey string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rejected == nil {
+		p.rejected = map[string]error{}
+	}
+	p.rejected[documentKey] = err
+}
+
+// Closed reports whether Close has been called.
+func (p *FakeProducer) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
@@ -0,0 +1,343 @@
+package relay
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGapTimeout = 30 * time.Second
+
+	// aggregateIdleTimeout is how long the reorderer remembers an aggregate
+	// without events, it reloads the sequence from the store when it shows up
+	// again.
+	aggregateIdleTimeout = 10 * time.Minute
+)
+
+// ReorderOptions configure the reordering of the DCP relay. GapTimeout falls
+// back to a default when zero and OnGap to logging the gap.
+type ReorderOptions struct {
+	// GapTimeout is how long the events of an aggregate are held back
+	// waiting for a missing sequence number. After that the gap is reported
+	// and the held back events are published.
+	GapTimeout time.Duration
+	OnGap      func(gap Gap)
+}
+
+// Gap is a sequence number of an aggregate that did not arrive within the
+// gap timeout.
+type Gap struct {
+	AggregateType string
+	AggregateID   string
+	// Expected is the first missing sequence number, Next the sequence number
+	// of the earliest event held back.
+	Expected int64
+	Next     int64
+	Since    time.Time
+}
+
+// SequenceStore persists the last published sequence number of every
+// aggregate, so a restarted relay or the other instances of its group know
+// which sequence number comes next.
+type SequenceStore interface {
+	// LoadSequence returns 0 when nothing of the aggregate has been published.
+	LoadSequence(aggregateType string, aggregateID string) (int64, error)
+	SaveSequence(aggregateType string, aggregateID string, sequence int64) error
+}
+
+type aggregateKey struct {
+	aggregateType string
+	aggregateID   string
+}
+
+// reorderer holds back the events of an aggregate that arrive before their
+// predecessors, which happens when the outbox documents of an aggregate are
+// spread over vBuckets, and releases them in sequence order. Events whose
+// sequence number has been released already are duplicates, they are
+// acknowledged without being published once the original has been published.
+type reorderer struct {
+	opts    ReorderOptions
+	store   SequenceStore
+	release func(rec record)
+	ack     func(rec record)
+
+	mu         sync.Mutex
+	aggregates map[aggregateKey]*aggregateBuffer
+
+	// publishedMu guards the fields below, they are updated by the publishers
+	// while release may be blocked holding mu.
+	publishedMu sync.Mutex
+	// published is the highest sequence accepted by the producer.
+	published map[aggregateKey]int64
+	unsaved   map[aggregateKey]bool
+	// duplicates wait for the publishing of their original.
+	duplicates map[aggregateKey][]record
+}
+
+type aggregateBuffer struct {
+	// next is the first sequence number not released yet.
+	next     int64
+	pending  map[int64]record
+	gapSince time.Time
+	lastSeen time.Time
+}
+
+func newReorderer(opts ReorderOptions, store SequenceStore, release func(rec record), ack func(rec record)) *reorderer {
+	if opts.GapTimeout <= 0 {
+		opts.GapTimeout = defaultGapTimeout
+	}
+	if opts.OnGap == nil {
+		opts.OnGap = func(gap Gap) {
+			log.Printf("GAP %s/%s expected sequence %d since %s, publishing from sequence %d", gap.AggregateType, gap.AggregateID, gap.Expected, gap.Since.Format(time.RFC3339), gap.Next)
+		}
+	}
+
+	return &reorderer{
+		opts:       opts,
+		store:      store,
+		release:    release,
+		ack:        ack,
+		aggregates: map[aggregateKey]*aggregateBuffer{},
+		published:  map[aggregateKey]int64{},
+		unsaved:    map[aggregateKey]bool{},
+		duplicates: map[aggregateKey][]record{},
+	}
+}
+
+// add releases the record, and the records held back behind it, when it is
+// the next of its aggregate and holds it back otherwise.
+func (r *reorderer) add(rec record) error {
+	if err := r.load(rec.aggregate); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	buffer := r.aggregates[rec.aggregate]
+	buffer.lastSeen = time.Now()
+
+	switch {
+	case rec.sequence < buffer.next:
+		r.duplicate(rec)
+	case rec.sequence == buffer.next:
+		r.release(rec)
+		buffer.next++
+		r.releasePending(buffer)
+	default:
+		if previous, held := buffer.pending[rec.sequence]; held {
+			r.ack(previous)
+		}
+		buffer.pending[rec.sequence] = rec
+		if buffer.gapSince.IsZero() {
+			buffer.gapSince = time.Now()
+		}
+	}
+
+	return nil
+}
+
+// load seeds an aggregate seen for the first time with the sequence number
+// last published for it, which may have been published by an earlier run or
+// another instance.
+func (r *reorderer) load(key aggregateKey) error {
+	r.mu.Lock()
+	_, known := r.aggregates[key]
+	r.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	sequence, err := r.store.LoadSequence(key.aggregateType, key.aggregateID)
+	if err != nil {
+		return err
+	}
+
+	// the stored sequence has been published, the events up to it that DCP
+	// delivers again from the checkpoint are duplicates to acknowledge.
+	r.publishedMu.Lock()
+	if sequence > r.published[key] {
+		r.published[key] = sequence
+	}
+	r.publishedMu.Unlock()
+
+	r.mu.Lock()
+	if _, known = r.aggregates[key]; !known {
+		r.aggregates[key] = &aggregateBuffer{next: sequence + 1, pending: map[int64]record{}}
+	}
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *reorderer) releasePending(buffer *aggregateBuffer) {
+	for {
+		rec, held := buffer.pending[buffer.next]
+		if !held {
+			break
+		}
+		delete(buffer.pending, buffer.next)
+		r.release(rec)
+		buffer.next++
+	}
+
+	if len(buffer.pending) == 0 {
+		buffer.gapSince = time.Time{}
+	}
+}
+
+// skipTo releases the held back records from sequence on, the ones before it
+// have been published by another instance.
+func (r *reorderer) skipTo(buffer *aggregateBuffer, sequence int64) {
+	for held, rec := range buffer.pending {
+		if held < sequence {
+			delete(buffer.pending, held)
+			r.ack(rec)
+		}
+	}
+	if sequence > buffer.next {
+		buffer.next = sequence
+	}
+	r.releasePending(buffer)
+}
+
+// requeue releases a requeued record. Its sequence has been released before,
+// the record was dead lettered instead of published.
+func (r *reorderer) requeue(rec record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.release(rec)
+}
+
+// duplicate acknowledges a record released before, or holds it until the
+// original has been published. Acknowledging it earlier would let the
+// checkpoint pass an event that may still fail to publish.
+func (r *reorderer) duplicate(rec record) {
+	r.publishedMu.Lock()
+	if rec.sequence > r.published[rec.aggregate] {
+		r.duplicates[rec.aggregate] = append(r.duplicates[rec.aggregate], rec)
+		r.publishedMu.Unlock()
+		return
+	}
+	r.publishedMu.Unlock()
+
+	r.ack(rec)
+}
+
+// markPublished records that the record has been accepted by the producer.
+func (r *reorderer) markPublished(rec record) {
+	r.publishedMu.Lock()
+	if rec.sequence > r.published[rec.aggregate] {
+		r.published[rec.aggregate] = rec.sequence
+		r.unsaved[rec.aggregate] = true
+	}
+
+	var acked []record
+	waiting := r.duplicates[rec.aggregate][:0]
+	for _, duplicate := range r.duplicates[rec.aggregate] {
+		if duplicate.sequence <= r.published[rec.aggregate] {
+			acked = append(acked, duplicate)
+		} else {
+			waiting = append(waiting, duplicate)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(r.duplicates, rec.aggregate)
+	} else {
+		r.duplicates[rec.aggregate] = waiting
+	}
+	r.publishedMu.Unlock()
+
+	for _, duplicate := range acked {
+		r.ack(duplicate)
+	}
+}
+
+// flush saves the sequences published since the last flush. It has to run
+// before the checkpoints are saved, a replayed event is then recognised as
+// a duplicate instead of leaving a gap.
+func (r *reorderer) flush() error {
+	r.publishedMu.Lock()
+	unsaved := make(map[aggregateKey]int64, len(r.unsaved))
+	for key := range r.unsaved {
+		unsaved[key] = r.published[key]
+	}
+	r.unsaved = map[aggregateKey]bool{}
+	r.publishedMu.Unlock()
+
+	for key, sequence := range unsaved {
+		if err := r.store.SaveSequence(key.aggregateType, key.aggregateID, sequence); err != nil {
+			r.publishedMu.Lock()
+			for key := range unsaved {
+				r.unsaved[key] = true
+			}
+			r.publishedMu.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forget drops what is known about the publishing of an idle aggregate.
+func (r *reorderer) forget(key aggregateKey) bool {
+	r.publishedMu.Lock()
+	defer r.publishedMu.Unlock()
+
+	if r.unsaved[key] || len(r.duplicates[key]) > 0 {
+		return false
+	}
+	delete(r.published, key)
+	return true
+}
+
+// sweep looks at the aggregates held back by a gap. The missing events may
+// have been published by another relay instance, so the stored sequence is
+// checked first. A gap older than the gap timeout is reported and skipped.
+// Aggregates idle for long are forgotten.
+func (r *reorderer) sweep() {
+	r.mu.Lock()
+	var gapped []aggregateKey
+	for key, buffer := range r.aggregates {
+		if !buffer.gapSince.IsZero() {
+			gapped = append(gapped, key)
+		} else if time.Since(buffer.lastSeen) > aggregateIdleTimeout && r.forget(key) {
+			delete(r.aggregates, key)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, key := range gapped {
+		sequence, err := r.store.LoadSequence(key.aggregateType, key.aggregateID)
+		if err != nil {
+			log.Printf("could not load the sequence of %s/%s: %s", key.aggregateType, key.aggregateID, err)
+			continue
+		}
+
+		r.mu.Lock()
+		buffer, known := r.aggregates[key]
+		if known && !buffer.gapSince.IsZero() {
+			r.skipTo(buffer, sequence+1)
+		}
+		if known && !buffer.gapSince.IsZero() && time.Since(buffer.gapSince) > r.opts.GapTimeout {
+			var next int64
+			for held := range buffer.pending {
+				if next == 0 || held < next {
+					next = held
+				}
+			}
+
+			r.opts.OnGap(Gap{
+				AggregateType: key.aggregateType,
+				AggregateID:   key.aggregateID,
+				Expected:      buffer.next,
+				Next:          next,
+				Since:         buffer.gapSince,
+			})
+			r.skipTo(buffer, next)
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"sync"
+	"testing"
+)
+
+type memorySequenceStore struct {
+	mu        sync.Mutex
+	sequences map[aggregateKey]int64
+}
+
+func newMemorySequenceStore() *memorySequenceStore {
+	return &memorySequenceStore{sequences: map[aggregateKey]int64{}}
+}
+
+func (s *memorySequenceStore) LoadSequence(aggregateType string, aggregateID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sequences[aggregateKey{aggregateType: aggregateType, aggregateID: aggregateID}], nil
+}
+
+func (s *memorySequenceStore) SaveSequence(aggregateType string, aggregateID string, sequence int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sequences[aggregateKey{aggregateType: aggregateType, aggregateID: aggregateID}] = sequence
+	return nil
+}
+
+// reorderRun records what a reorderer released and acknowledged. Released
+// records are published right away like a lane would.
+type reorderRun struct {
+	reorderer *reorderer
+	released  []int64
+	acked     []int64
+}
+
+func newReorderRun(store SequenceStore) *reorderRun {
+	run := &reorderRun{}
+	run.reorderer = newReorderer(ReorderOptions{OnGap: func(Gap) {}}, store,
+		func(rec record) {
+			run.released = append(run.released, rec.sequence)
+			run.reorderer.markPublished(rec)
+		},
+		func(rec record) {
+			run.acked = append(run.acked, rec.sequence)
+		})
+	return run
+}
+
+func (run *reorderRun) add(t *testing.T, sequences ...int64) {
+	t.Helper()
+	for _, sequence := range sequences {
+		rec := record{aggregate: aggregateKey{aggregateType: "item", aggregateID: "1"}, sequence: sequence}
+		if err := run.reorderer.add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectSequences(t *testing.T, name string, got []int64, expected ...int64) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("%s %v, expected %v", name, got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("%s %v, expected %v", name, got, expected)
+		}
+	}
+}
+
+func TestReordererReleasesInSequenceOrder(t *testing.T) {
+	run := newReorderRun(newMemorySequenceStore())
+
+	run.add(t, 2, 3, 1, 4)
+
+	expectSequences(t, "released", run.released, 1, 2, 3, 4)
+	expectSequences(t, "acknowledged", run.acked)
+}
+
+func TestReordererAcknowledgesDuplicatesOncePublished(t *testing.T) {
+	run := newReorderRun(newMemorySequenceStore())
+
+	run.add(t, 1, 2, 1, 2)
+
+	expectSequences(t, "released", run.released, 1, 2)
+	expectSequences(t, "acknowledged", run.acked, 1, 2)
+}
+
+func TestReordererReleasesRequeuedRecordsRightAway(t *testing.T) {
+	run := newReorderRun(newMemorySequenceStore())
+
+	run.add(t, 1, 2, 4)
+	run.reorderer.requeue(record{aggregate: aggregateKey{aggregateType: "item", aggregateID: "1"}, sequence: 2})
+	run.add(t, 3)
+
+	expectSequences(t, "released", run.released, 1, 2, 2, 3, 4)
+	expectSequences(t, "acknowledged", run.acked)
+}
+
+func TestRestartedReordererDropsReplayedEvents(t *testing.T) {
+	store := newMemorySequenceStore()
+
+	first := newReorderRun(store)
+	first.add(t, 1, 2, 3)
+	if err := first.reorderer.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// DCP delivers everything after the checkpoint again, which lags behind
+	// the saved sequences.
+	restarted := newReorderRun(store)
+	restarted.add(t, 1, 2, 3)
+
+	expectSequences(t, "released", restarted.released)
+	expectSequences(t, "acknowledged", restarted.acked, 1, 2, 3)
+
+	key := aggregateKey{aggregateType: "item", aggregateID: "1"}
+	if held := len(restarted.reorderer.duplicates[key]); held != 0 {
+		t.Fatalf("%d replayed events are held back", held)
+	}
+	if !restarted.reorderer.aggregates[key].gapSince.IsZero() {
+		t.Fatal("the replayed events opened a gap")
+	}
+
+	restarted.add(t, 4)
+	expectSequences(t, "released", restarted.released, 4)
+}
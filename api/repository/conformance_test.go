@@ -0,0 +1,708 @@
+package repository_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/config"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/repository"
+	"github.com/couchbase/gocb/v2"
+	"github.com/google/uuid"
+)
+
+const conformanceWriters = 5
+
+var errConformanceAbort = errors.New("aborted by the conformance check")
+
+// couchbaseTestEnv gates the Couchbase run of the conformance tests. It holds
+// the connection string, the credentials, TLS settings, collections and
+// outbox settings are read from the envs of the api.
+const couchbaseTestEnv = "COUCHBASE_TEST_HOST"
+
+func TestMemoryConformance(t *testing.T) {
+	envelope, err := outbox.NewEnvelope(outbox.FormatCloudEvents, "/kafka-couchbase-connector-poc/conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testConformance(t, repository.NewMemoryItemRepository(), repository.NewMemoryOutbox(envelope, nil), true)
+}
+
+// TestCouchbaseConformance writes items with random ids and conformance
+// events to the configured collections, which the relay and the connector
+// publish.
+func TestCouchbaseConformance(t *testing.T) {
+	format := envOr("OUTBOX_EVENT_FORMAT", outbox.FormatCloudEvents)
+	envelope, err := outbox.NewEnvelope(format, "/kafka-couchbase-connector-poc/conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, scope := couchbaseTestScope(t)
+	mode := envOr("OUTBOX_MODE", repository.OutboxModeEvent)
+
+	items, err := repository.NewCouchbaseItemRepository(cluster, scope.Collection(requiredTestEnv(t, "COUCHBASE_COLLECTION")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	itemOutbox, err := repository.NewCouchbaseOutbox(repository.CouchbaseOutboxOptions{
+		Collection: scope.Collection(requiredTestEnv(t, "COUCHBASE_OUTBOX_COLLECTION")),
+		Counters:   scope.Collection(requiredTestEnv(t, "COUCHBASE_COUNTER_COLLECTION")),
+		Envelope:   envelope,
+		Format:     format,
+		Mode:       mode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testConformance(t, items, itemOutbox, mode != repository.OutboxModeAggregate)
+}
+
+// TestCouchbaseOutboxExpiresByTheCollectionMaxTTL appends an event to an
+// outbox collection of its own with a max ttl. Transactions cannot set an
+// expiry, the max ttl of the collection is the only one the outbox documents
+// get.
+func TestCouchbaseOutboxExpiresByTheCollectionMaxTTL(t *testing.T) {
+	cluster, scope := couchbaseTestScope(t)
+	const maxTTL = time.Hour
+
+	collections := cluster.Bucket(scope.BucketName()).Collections()
+	spec := gocb.CollectionSpec{Name: "outbox_ttl_" + uuid.NewString()[:8], ScopeName: scope.Name(), MaxExpiry: maxTTL}
+	if err := collections.CreateCollection(spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := collections.DropCollection(spec, nil); err != nil {
+			t.Logf("could not drop collection %s: %s", spec.Name, err)
+		}
+	})
+
+	envelope, err := outbox.NewEnvelope(outbox.FormatCloudEvents, "/kafka-couchbase-connector-poc/conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := repository.NewCouchbaseItemRepository(cluster, scope.Collection(requiredTestEnv(t, "COUCHBASE_COLLECTION")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outboxCollection := scope.Collection(spec.Name)
+	itemOutbox, err := repository.NewCouchbaseOutbox(repository.CouchbaseOutboxOptions{
+		Collection: outboxCollection,
+		Counters:   scope.Collection(requiredTestEnv(t, "COUCHBASE_COUNTER_COLLECTION")),
+		Envelope:   envelope,
+		Format:     outbox.FormatCloudEvents,
+		Mode:       repository.OutboxModeEvent,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := newConformanceItem("expiring")
+	event := conformanceEvent(item, outbox.EventTypeCreated)
+	appended := time.Now()
+
+	// a new collection takes a moment to show up on every node.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		err = items.Transact(func(tx repository.Tx) error {
+			if err := tx.Insert(item); err != nil {
+				return err
+			}
+			return itemOutbox.Append(tx, event)
+		})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+	}
+
+	result, err := outboxCollection.Get(event.ID, &gocb.GetOptions{WithExpiry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := result.ExpiryTime()
+	if expiry.Before(appended.Add(maxTTL-time.Minute)) || expiry.After(time.Now().Add(maxTTL+time.Minute)) {
+		t.Fatalf("the outbox document expires at %s, expected about %s after it was appended at %s", expiry, maxTTL, appended)
+	}
+}
+
+// TestCouchbaseMutationTokenFollowsTheWrites checks the tokens read back from
+// the $document xattr after the transactions, the removal included.
+func TestCouchbaseMutationTokenFollowsTheWrites(t *testing.T) {
+	cluster, scope := couchbaseTestScope(t)
+
+	items, err := repository.NewCouchbaseItemRepository(cluster, scope.Collection(requiredTestEnv(t, "COUCHBASE_COLLECTION")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := newConformanceItem("mutation token")
+	writes := []struct {
+		name  string
+		write func(tx repository.Tx) error
+	}{
+		{"insert", func(tx repository.Tx) error { return tx.Insert(item) }},
+		{"replace", func(tx repository.Tx) error { return tx.Replace(item) }},
+		{"remove", func(tx repository.Tx) error { return tx.Remove(item.ID) }},
+	}
+
+	var previous *gocb.MutationToken
+	for _, write := range writes {
+		if err = items.Transact(write.write); err != nil {
+			t.Fatalf("%s: %s", write.name, err)
+		}
+
+		token, err := items.MutationToken(item.ID)
+		if err != nil {
+			t.Fatalf("token of the %s: %s", write.name, err)
+		}
+		if token == nil || token.BucketName() != scope.BucketName() || token.SequenceNumber() == 0 {
+			t.Fatalf("token of the %s is %+v, expected a seqno in bucket %s", write.name, token, scope.BucketName())
+		}
+		if previous != nil && (token.PartitionID() != previous.PartitionID() || token.SequenceNumber() <= previous.SequenceNumber()) {
+			t.Fatalf("token of the %s is at seqno %d of vBucket %d, expected past seqno %d of vBucket %d",
+				write.name, token.SequenceNumber(), token.PartitionID(), previous.SequenceNumber(), previous.PartitionID())
+		}
+		previous = token
+	}
+}
+
+// TestCouchbaseAggregateOutboxKeepsTheNewestEvents appends more events than
+// an outbox document of the aggregate mode keeps and expects the oldest ones
+// to be trimmed.
+func TestCouchbaseAggregateOutboxKeepsTheNewestEvents(t *testing.T) {
+	const maxEvents = 3
+
+	envelope, err := outbox.NewEnvelope(outbox.FormatCloudEvents, "/kafka-couchbase-connector-poc/conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster, scope := couchbaseTestScope(t)
+
+	items, err := repository.NewCouchbaseItemRepository(cluster, scope.Collection(requiredTestEnv(t, "COUCHBASE_COLLECTION")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	itemOutbox, err := repository.NewCouchbaseOutbox(repository.CouchbaseOutboxOptions{
+		Collection:         scope.Collection(requiredTestEnv(t, "COUCHBASE_OUTBOX_COLLECTION")),
+		Counters:           scope.Collection(requiredTestEnv(t, "COUCHBASE_COUNTER_COLLECTION")),
+		Envelope:           envelope,
+		Format:             outbox.FormatCloudEvents,
+		Mode:               repository.OutboxModeAggregate,
+		AggregateMaxEvents: maxEvents,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := newConformanceItem("trimmed")
+	var appended []string
+	for i := 0; i < maxEvents+2; i++ {
+		event := conformanceEvent(item, outbox.EventTypeUpdated)
+		err = items.Transact(func(tx repository.Tx) error {
+			write := tx.Replace
+			if i == 0 {
+				write = tx.Insert
+			}
+			if err := write(item); err != nil {
+				return err
+			}
+			return itemOutbox.Append(tx, event)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		appended = append(appended, event.ID)
+		item.Version++
+		item.Sequence++
+	}
+
+	events, err := itemOutbox.Events("conformance", item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, event := range events {
+		kept = append(kept, event.ID)
+	}
+	if expected := appended[len(appended)-maxEvents:]; strings.Join(kept, ",") != strings.Join(expected, ",") {
+		t.Fatalf("the outbox document keeps %v, expected the newest events %v", kept, expected)
+	}
+}
+
+// couchbaseTestScope connects to the Couchbase server of couchbaseTestEnv and
+// returns the configured scope, it skips the test without the env.
+func couchbaseTestScope(t *testing.T) (*gocb.Cluster, *gocb.Scope) {
+	t.Helper()
+
+	host, set := os.LookupEnv(couchbaseTestEnv)
+	if !set {
+		t.Skip(couchbaseTestEnv + " env is not set")
+	}
+
+	t.Setenv("COUCHBASE_HOST", host)
+	cb, err := config.CouchbaseEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := cb.Connect(cb.Username, cb.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Close(nil) })
+
+	return cluster, cluster.Bucket(requiredTestEnv(t, "COUCHBASE_BUCKET")).Scope(requiredTestEnv(t, "COUCHBASE_SCOPE"))
+}
+
+func requiredTestEnv(t *testing.T, name string) string {
+	t.Helper()
+
+	value, set := os.LookupEnv(name)
+	if !set {
+		t.Fatal(name + " env is required")
+	}
+	return value
+}
+
+func envOr(name string, fallback string) string {
+	if value, set := os.LookupEnv(name); set {
+		return value
+	}
+	return fallback
+}
+
+// testConformance runs the checks every ItemRepository and its Outbox have to
+// pass, one subtest each. It writes items with random ids, so it can run
+// against a repository in use. An outbox that is not atomic with the
+// transactions keeps the events of the attempts that did not commit, the
+// checks then expect the last event of each sequence to be the committed one.
+func testConformance(t *testing.T, items repository.ItemRepository, events repository.Outbox, atomic bool) {
+	c := conformance{items: items, events: events, atomic: atomic}
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"insert commits the item and its event", c.checkInsert},
+		{"an aborted transaction writes nothing", c.checkAbort},
+		{"insert of an existing item fails", c.checkInsertExisting},
+		{"replace and remove of a missing item fail", c.checkMissing},
+		{"a transaction sees its own writes", c.checkOwnWrites},
+		{"replace changes the CAS", c.checkReplace},
+		{"remove deletes the item and keeps its events", c.checkRemove},
+		{"concurrent transactions lose no update", c.checkConcurrentReplaces},
+		{"list filters, sorts and continues after the cursor", c.checkList},
+	}
+	for _, check := range checks {
+		check := check
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.check(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+type conformance struct {
+	items  repository.ItemRepository
+	events repository.Outbox
+	atomic bool
+}
+
+func newConformanceItem(name string) repository.Item {
+	return repository.Item{
+		ID:             uuid.NewString(),
+		Version:        1,
+		Sequence:       1,
+		Name:           name,
+		Price:          10,
+		Active:         true,
+		OccurrenceTime: time.Now().UTC(),
+	}
+}
+
+func conformanceEvent(item repository.Item, eventType string) outbox.Event {
+	return outbox.Event{
+		ID:             uuid.NewString(),
+		AggregateType:  "conformance",
+		AggregateID:    item.ID,
+		Type:           eventType,
+		Version:        item.Version,
+		SchemaVersion:  1,
+		OccurrenceTime: time.Now().UTC(),
+		Sequence:       item.Sequence,
+	}
+}
+
+// insert creates the item along with its created event.
+func (c *conformance) insert(item repository.Item) error {
+	return c.items.Transact(func(tx repository.Tx) error {
+		if err := tx.Insert(item); err != nil {
+			return err
+		}
+		return c.events.Append(tx, conformanceEvent(item, outbox.EventTypeCreated))
+	})
+}
+
+// update bumps the version and sequence of the item along with an updated
+// event.
+func (c *conformance) update(id string) (repository.Item, error) {
+	var item repository.Item
+	err := c.items.Transact(func(tx repository.Tx) error {
+		var err error
+		if item, err = tx.Get(id); err != nil {
+			return err
+		}
+		item.Version++
+		item.Sequence++
+		if err = tx.Replace(item); err != nil {
+			return err
+		}
+		return c.events.Append(tx, conformanceEvent(item, outbox.EventTypeUpdated))
+	})
+	return item, err
+}
+
+// expectItem compares the stored item with the expected one, the occurrence
+// time by instant.
+func (c *conformance) expectItem(expected repository.Item) (gocb.Cas, error) {
+	stored, cas, err := c.items.Get(expected.ID)
+	if err != nil {
+		return 0, err
+	}
+	if cas == 0 {
+		return 0, fmt.Errorf("item %s has no CAS", expected.ID)
+	}
+
+	if !stored.OccurrenceTime.Equal(expected.OccurrenceTime) {
+		return 0, fmt.Errorf("item %s has occurrence time %s, expected %s", expected.ID, stored.OccurrenceTime, expected.OccurrenceTime)
+	}
+	stored.OccurrenceTime, expected.OccurrenceTime = time.Time{}, time.Time{}
+	if stored != expected {
+		return 0, fmt.Errorf("item %s is %+v, expected %+v", expected.ID, stored, expected)
+	}
+
+	return cas, nil
+}
+
+// expectSequences checks the sequences of the events of the aggregate and
+// that their global sequences increase.
+func (c *conformance) expectSequences(id string, sequences ...int64) error {
+	events, err := c.events.Events("conformance", id)
+	if err != nil {
+		return err
+	}
+	if !c.atomic {
+		events = committedEvents(events)
+	}
+
+	if len(events) != len(sequences) {
+		return fmt.Errorf("aggregate %s has %d events, expected %d", id, len(events), len(sequences))
+	}
+	for i, event := range events {
+		if event.Sequence != sequences[i] {
+			return fmt.Errorf("event %d of aggregate %s has sequence %d, expected %d", i, id, event.Sequence, sequences[i])
+		}
+		if event.GlobalSequence == 0 || (i > 0 && event.GlobalSequence <= events[i-1].GlobalSequence) {
+			return fmt.Errorf("event %d of aggregate %s has global sequence %d, expected it to increase", i, id, event.GlobalSequence)
+		}
+	}
+
+	return nil
+}
+
+// committedEvents drops the events a later event of the same or an earlier
+// sequence supersedes, which leaves the committed events of an outbox that
+// keeps the events of aborted attempts.
+func committedEvents(events []outbox.Event) []outbox.Event {
+	var committed []outbox.Event
+	for _, event := range events {
+		for len(committed) > 0 && committed[len(committed)-1].Sequence >= event.Sequence {
+			committed = committed[:len(committed)-1]
+		}
+		committed = append(committed, event)
+	}
+	return committed
+}
+
+func (c *conformance) checkInsert() error {
+	item := newConformanceItem("insert")
+	if err := c.insert(item); err != nil {
+		return err
+	}
+
+	if _, err := c.expectItem(item); err != nil {
+		return err
+	}
+	return c.expectSequences(item.ID, 1)
+}
+
+func (c *conformance) checkAbort() error {
+	item := newConformanceItem("abort")
+	err := c.items.Transact(func(tx repository.Tx) error {
+		if err := tx.Insert(item); err != nil {
+			return err
+		}
+		if err := c.events.Append(tx, conformanceEvent(item, outbox.EventTypeCreated)); err != nil {
+			return err
+		}
+		return errConformanceAbort
+	})
+	if !errors.Is(err, errConformanceAbort) {
+		return fmt.Errorf("transact returned %v, expected the error of the transaction", err)
+	}
+
+	if _, _, err = c.items.Get(item.ID); !errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("get of the aborted item returned %v, expected not found", err)
+	}
+	if !c.atomic {
+		// the event of the aborted attempt stays until a later write of the
+		// item supersedes it.
+		return nil
+	}
+	return c.expectSequences(item.ID)
+}
+
+func (c *conformance) checkInsertExisting() error {
+	item := newConformanceItem("existing")
+	if err := c.insert(item); err != nil {
+		return err
+	}
+
+	duplicate := item
+	duplicate.Name = "duplicate"
+	if err := c.insert(duplicate); !errors.Is(err, repository.ErrExists) {
+		return fmt.Errorf("second insert returned %v, expected exists", err)
+	}
+
+	if _, err := c.expectItem(item); err != nil {
+		return err
+	}
+	return c.expectSequences(item.ID, 1)
+}
+
+func (c *conformance) checkMissing() error {
+	missing := newConformanceItem("missing")
+
+	err := c.items.Transact(func(tx repository.Tx) error {
+		return tx.Replace(missing)
+	})
+	if !errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("replace returned %v, expected not found", err)
+	}
+
+	err = c.items.Transact(func(tx repository.Tx) error {
+		return tx.Remove(missing.ID)
+	})
+	if !errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("remove returned %v, expected not found", err)
+	}
+
+	return nil
+}
+
+func (c *conformance) checkOwnWrites() error {
+	item := newConformanceItem("own writes")
+
+	return c.items.Transact(func(tx repository.Tx) error {
+		if err := tx.Insert(item); err != nil {
+			return err
+		}
+		read, err := tx.Get(item.ID)
+		if err != nil {
+			return err
+		}
+		if read.Name != item.Name {
+			return fmt.Errorf("read %q after the insert, expected %q", read.Name, item.Name)
+		}
+
+		item.Name = "own writes replaced"
+		if err = tx.Replace(item); err != nil {
+			return err
+		}
+		if read, err = tx.Get(item.ID); err != nil {
+			return err
+		}
+		if read.Name != item.Name {
+			return fmt.Errorf("read %q after the replace, expected %q", read.Name, item.Name)
+		}
+
+		if err = tx.Remove(item.ID); err != nil {
+			return err
+		}
+		if _, err = tx.Get(item.ID); !errors.Is(err, repository.ErrNotFound) {
+			return fmt.Errorf("read after the remove returned %v, expected not found", err)
+		}
+		return nil
+	})
+}
+
+func (c *conformance) checkReplace() error {
+	item := newConformanceItem("replace")
+	if err := c.insert(item); err != nil {
+		return err
+	}
+	before, err := c.expectItem(item)
+	if err != nil {
+		return err
+	}
+
+	updated, err := c.update(item.ID)
+	if err != nil {
+		return err
+	}
+	after, err := c.expectItem(updated)
+	if err != nil {
+		return err
+	}
+
+	if after == before {
+		return fmt.Errorf("the CAS stayed %d", before)
+	}
+	return c.expectSequences(item.ID, 1, 2)
+}
+
+func (c *conformance) checkRemove() error {
+	item := newConformanceItem("remove")
+	if err := c.insert(item); err != nil {
+		return err
+	}
+
+	err := c.items.Transact(func(tx repository.Tx) error {
+		stored, err := tx.Get(item.ID)
+		if err != nil {
+			return err
+		}
+		if err = tx.Remove(item.ID); err != nil {
+			return err
+		}
+		stored.Sequence++
+		return c.events.Append(tx, conformanceEvent(stored, outbox.EventTypeDeleted))
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = c.items.Get(item.ID); !errors.Is(err, repository.ErrNotFound) {
+		return fmt.Errorf("get of the removed item returned %v, expected not found", err)
+	}
+	return c.expectSequences(item.ID, 1, 2)
+}
+
+func (c *conformance) checkConcurrentReplaces() error {
+	item := newConformanceItem("concurrent")
+	if err := c.insert(item); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, conformanceWriters)
+	for i := 0; i < conformanceWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.update(item.ID); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	item.Version += conformanceWriters
+	item.Sequence += conformanceWriters
+	stored, _, err := c.items.Get(item.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Version != item.Version {
+		return fmt.Errorf("item is at version %d after %d updates, expected %d", stored.Version, conformanceWriters, item.Version)
+	}
+
+	sequences := make([]int64, 0, item.Sequence)
+	for sequence := int64(1); sequence <= item.Sequence; sequence++ {
+		sequences = append(sequences, sequence)
+	}
+	return c.expectSequences(item.ID, sequences...)
+}
+
+func (c *conformance) checkList() error {
+	prefix := "list " + uuid.NewString() + " "
+
+	var listed []repository.Item
+	var tokens []gocb.MutationToken
+	for i, price := range []float64{30, 10, 20} {
+		item := newConformanceItem(prefix + string(rune('a'+i)))
+		item.Price = price
+		if err := c.insert(item); err != nil {
+			return err
+		}
+		listed = append(listed, item)
+
+		token, err := c.items.MutationToken(item.ID)
+		if err != nil {
+			return err
+		}
+		if token != nil {
+			tokens = append(tokens, *token)
+		}
+	}
+
+	query := repository.ItemQuery{Sort: "price", Limit: 2, NamePrefix: prefix}
+	if len(tokens) > 0 {
+		query.ConsistentWith = gocb.NewMutationState(tokens...)
+	}
+
+	page, err := c.items.List(query)
+	if err != nil {
+		return err
+	}
+	if err = expectIDs(page, listed[1].ID, listed[2].ID); err != nil {
+		return fmt.Errorf("first page: %w", err)
+	}
+
+	query.After = &repository.ItemCursor{Value: page[1].Price, ID: page[1].ID}
+	if page, err = c.items.List(query); err != nil {
+		return err
+	}
+	if err = expectIDs(page, listed[0].ID); err != nil {
+		return fmt.Errorf("second page: %w", err)
+	}
+
+	query = repository.ItemQuery{Sort: "name", Descending: true, Limit: 10, NamePrefix: prefix, MaxPrice: &listed[2].Price, ConsistentWith: query.ConsistentWith}
+	if page, err = c.items.List(query); err != nil {
+		return err
+	}
+	if err = expectIDs(page, listed[2].ID, listed[1].ID); err != nil {
+		return fmt.Errorf("descending by name up to a price: %w", err)
+	}
+
+	return nil
+}
+
+func expectIDs(items []repository.Item, ids ...string) error {
+	got := make([]string, len(items))
+	for i, item := range items {
+		got[i] = item.ID
+	}
+
+	if strings.Join(got, ",") != strings.Join(ids, ",") {
+		return fmt.Errorf("listed %v, expected %v", got, ids)
+	}
+	return nil
+}
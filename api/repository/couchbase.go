@@ -0,0 +1,532 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocb/v2"
+	"github.com/couchbase/gocbcore/v10"
+)
+
+const defaultAggregateMaxEvents = 100
+
+// globalSequenceKey is the counter document the global sequence of all outbox
+// events is allocated from.
+const globalSequenceKey = "outbox::global-sequence"
+
+// itemSortFields maps the sort of a query to the document field it orders
+// by. Only these identifiers ever reach the statement.
+var itemSortFields = map[string]string{
+	"name":           "name",
+	"price":          "price",
+	"occurrenceTime": "occurrenceTime",
+}
+
+// itemIndexes are the secondary indexes the list query relies on, one per
+// sort field with the id as tie breaker and the filtered fields covered.
+var itemIndexes = map[string][]string{
+	"idx_item_name":            {"name", "id", "active", "price"},
+	"idx_item_price":           {"price", "id", "active", "name"},
+	"idx_item_occurrence_time": {"occurrenceTime", "id", "active", "price", "name"},
+}
+
+// CouchbaseItemRepository keeps the items in a collection and changes them
+// with gocb transactions.
+type CouchbaseItemRepository struct {
+	cluster    *gocb.Cluster
+	scope      *gocb.Scope
+	collection *gocb.Collection
+}
+
+// NewCouchbaseItemRepository provisions the indexes of the list query,
+// existing indexes are left untouched.
+func NewCouchbaseItemRepository(cluster *gocb.Cluster, collection *gocb.Collection) (*CouchbaseItemRepository, error) {
+	for name, fields := range itemIndexes {
+		err := cluster.QueryIndexes().CreateIndex(collection.Bucket().Name(), name, fields, &gocb.CreateQueryIndexOptions{
+			IgnoreIfExists: true,
+			ScopeName:      collection.ScopeName(),
+			CollectionName: collection.Name(),
+		})
+		if err != nil && !errors.Is(err, gocb.ErrIndexExists) {
+			return nil, err
+		}
+	}
+
+	return &CouchbaseItemRepository{
+		cluster:    cluster,
+		scope:      collection.Bucket().Scope(collection.ScopeName()),
+		collection: collection,
+	}, nil
+}
+
+func (r *CouchbaseItemRepository) Get(id string) (Item, gocb.Cas, error) {
+	var item Item
+
+	result, err := r.collection.Get(id, nil)
+	if err != nil {
+		return item, 0, err
+	}
+
+	err = result.Content(&item)
+	return item, result.Cas(), err
+}
+
+// List runs the query as a parameterised statement. Query values only ever
+// end up in the named parameters, the statement is assembled from constants
+// and whitelisted identifiers.
+func (r *CouchbaseItemRepository) List(query ItemQuery) ([]Item, error) {
+	field, ok := itemSortFields[query.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown item sort %q", query.Sort)
+	}
+
+	order, comparison := "ASC", ">"
+	if query.Descending {
+		order, comparison = "DESC", "<"
+	}
+
+	params := map[string]interface{}{"limit": query.Limit}
+	conditions := []string{"i.id IS NOT MISSING"}
+
+	if query.Active != nil {
+		params["active"] = *query.Active
+		conditions = append(conditions, "i.active = $active")
+	}
+	if query.MinPrice != nil {
+		params["minPrice"] = *query.MinPrice
+		conditions = append(conditions, "i.price >= $minPrice")
+	}
+	if query.MaxPrice != nil {
+		params["maxPrice"] = *query.MaxPrice
+		conditions = append(conditions, "i.price <= $maxPrice")
+	}
+	if query.NamePrefix != "" {
+		params["namePattern"] = escapeLikePattern(query.NamePrefix) + "%"
+		conditions = append(conditions, "i.name LIKE $namePattern")
+	}
+	if query.After != nil {
+		params["cursorValue"] = query.After.Value
+		// cursors handed out before the times were stored in a fixed width
+		// still compare right.
+		if value, isString := query.After.Value.(string); isString && query.Sort == "occurrenceTime" {
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cursor value %q: %w", value, err)
+			}
+			params["cursorValue"] = outbox.FormatTime(t)
+		}
+		params["cursorId"] = query.After.ID
+		conditions = append(conditions, "(i."+field+" "+comparison+" $cursorValue OR (i."+field+" = $cursorValue AND i.id "+comparison+" $cursorId))")
+	}
+
+	statement := "SELECT i.* FROM `" + r.collection.Name() + "` AS i" +
+		" WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY i." + field + " " + order + ", i.id " + order +
+		" LIMIT $limit"
+
+	result, err := r.scope.Query(statement, &gocb.QueryOptions{
+		NamedParameters: params,
+		ConsistentWith:  query.ConsistentWith,
+		Readonly:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := []Item{}
+	for result.Next() {
+		var item Item
+		if err = result.Row(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, result.Err()
+}
+
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// MutationToken builds the token of the latest write of the item from its
+// $document virtual xattr, which a removed item keeps on its tombstone.
+// Transactions do not expose the mutation tokens of their writes, and reading
+// them back leaves the item alone, where a touch would be one more mutation for
+// the relay and the connector. A write committed in between hands out its
+// later token, which still covers the write the caller made, unless a failover
+// changed the vBucket uuid, then the query waits for nothing.
+func (r *CouchbaseItemRepository) MutationToken(id string) (*gocb.MutationToken, error) {
+	opts := &gocb.LookupInOptions{}
+	opts.Internal.DocFlags = gocb.SubdocDocFlagAccessDeleted
+	result, err := r.collection.LookupIn(id, []gocb.LookupInSpec{
+		gocb.GetSpec("$document", &gocb.GetSpecOptions{IsXattr: true}),
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		VbUUID string `json:"vbucket_uuid"`
+		SeqNo  string `json:"seqno"`
+	}
+	if err = result.ContentAt(0, &document); err != nil {
+		return nil, err
+	}
+	vbUUID, err := strconv.ParseUint(strings.TrimPrefix(document.VbUUID, "0x"), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vBucket uuid %q of item %s", document.VbUUID, id)
+	}
+	seqNo, err := strconv.ParseUint(strings.TrimPrefix(document.SeqNo, "0x"), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seqno %q of item %s", document.SeqNo, id)
+	}
+
+	agent, err := r.collection.Bucket().Internal().IORouter()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := agent.ConfigSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	vbID, err := snapshot.KeyToVbucket([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+
+	state := gocb.NewMutationState()
+	state.Internal().Add(r.collection.Bucket().Name(), gocbcore.MutationToken{
+		VbID:   vbID,
+		VbUUID: gocbcore.VbUUID(vbUUID),
+		SeqNo:  gocbcore.SeqNo(seqNo),
+	})
+	token := state.Internal().Tokens()[0]
+	return &token, nil
+}
+
+func (r *CouchbaseItemRepository) Transact(fn func(tx Tx) error) error {
+	_, err := r.cluster.Transactions().Run(func(ctx *gocb.TransactionAttemptContext) error {
+		return fn(&couchbaseTx{
+			ctx:        ctx,
+			collection: r.collection,
+			read:       map[string]*gocb.TransactionGetResult{},
+		})
+	}, nil)
+	return err
+}
+
+// couchbaseTx remembers the items it has read, a transaction replaces and
+// removes documents by their get result.
+type couchbaseTx struct {
+	ctx        *gocb.TransactionAttemptContext
+	collection *gocb.Collection
+	read       map[string]*gocb.TransactionGetResult
+}
+
+func (tx *couchbaseTx) Get(id string) (Item, error) {
+	var item Item
+
+	result, err := tx.ctx.Get(tx.collection, id)
+	if err != nil {
+		return item, err
+	}
+	tx.read[id] = result
+
+	err = result.Content(&item)
+	return item, err
+}
+
+func (tx *couchbaseTx) Insert(item Item) error {
+	result, err := tx.ctx.Insert(tx.collection, item.ID, item)
+	if err != nil {
+		return err
+	}
+	tx.read[item.ID] = result
+	return nil
+}
+
+func (tx *couchbaseTx) Replace(item Item) error {
+	result, err := tx.getResult(item.ID)
+	if err != nil {
+		return err
+	}
+
+	if result, err = tx.ctx.Replace(result, item); err != nil {
+		return err
+	}
+	tx.read[item.ID] = result
+	return nil
+}
+
+func (tx *couchbaseTx) Remove(id string) error {
+	result, err := tx.getResult(id)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.ctx.Remove(result); err != nil {
+		return err
+	}
+	delete(tx.read, id)
+	return nil
+}
+
+func (tx *couchbaseTx) getResult(id string) (*gocb.TransactionGetResult, error) {
+	if result, read := tx.read[id]; read {
+		return result, nil
+	}
+
+	result, err := tx.ctx.Get(tx.collection, id)
+	if err != nil {
+		return nil, err
+	}
+	tx.read[id] = result
+	return result, nil
+}
+
+// CouchbaseOutboxOptions configure a CouchbaseOutbox. Mode falls back to the
+// event mode and AggregateMaxEvents to a default when zero.
+type CouchbaseOutboxOptions struct {
+	Collection *gocb.Collection
+	// Counters holds the counter the global sequence is allocated from.
+	Counters *gocb.Collection
+	Envelope outbox.Envelope
+	// Format is the format of Envelope.
+	Format string
+	Mode   string
+	// AggregateMaxEvents is how many events the outbox documents of the
+	// aggregate mode keep.
+	AggregateMaxEvents int
+}
+
+// CouchbaseOutbox writes the events to the outbox collection as part of the
+// transactions of a CouchbaseItemRepository.
+type CouchbaseOutbox struct {
+	opts             CouchbaseOutboxOptions
+	aggregateIDField string
+
+	indexMu sync.Mutex
+	indexed bool
+}
+
+func NewCouchbaseOutbox(opts CouchbaseOutboxOptions) (*CouchbaseOutbox, error) {
+	if opts.Mode == "" {
+		opts.Mode = OutboxModeEvent
+	}
+	if opts.Mode != OutboxModeEvent && opts.Mode != OutboxModeAggregate {
+		return nil, fmt.Errorf("unknown outbox mode %q, expected %s or %s", opts.Mode, OutboxModeEvent, OutboxModeAggregate)
+	}
+	if opts.AggregateMaxEvents <= 0 {
+		opts.AggregateMaxEvents = defaultAggregateMaxEvents
+	}
+
+	aggregateIDField, err := outbox.AggregateIDField(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CouchbaseOutbox{opts: opts, aggregateIDField: aggregateIDField}, nil
+}
+
+// Append wraps the event in the envelope and writes it to the outbox
+// collection as part of the transaction.
+func (o *CouchbaseOutbox) Append(tx Tx, event outbox.Event) error {
+	cbTx, ok := tx.(*couchbaseTx)
+	if !ok {
+		return fmt.Errorf("the couchbase outbox only takes part in couchbase transactions")
+	}
+
+	// counters cannot take part in a transaction, a retried attempt allocates
+	// a new value and leaves a gap in the global sequence.
+	counter, err := o.opts.Counters.Binary().Increment(globalSequenceKey, &gocb.IncrementOptions{
+		Initial: 1,
+		Delta:   1,
+	})
+	if err != nil {
+		return err
+	}
+	event.GlobalSequence = counter.Content()
+
+	doc, err := o.opts.Envelope.Wrap(event)
+	if err != nil {
+		return err
+	}
+
+	if o.opts.Mode == OutboxModeAggregate {
+		return o.appendAggregate(event, doc)
+	}
+
+	_, err = cbTx.ctx.Insert(o.opts.Collection, event.ID, doc)
+	return err
+}
+
+// appendAggregate appends the event to the outbox document of its aggregate,
+// keeping at most AggregateMaxEvents events.
+//
+// Random event keys spread the events of one item over many vBuckets, and the
+// connector publishes vBuckets independently, so they can reach Kafka out of
+// order. Keeping them in a document keyed by the item id puts them on one
+// vBucket whose DCP order carries through to Kafka, and makes the item id the
+// Kafka record key. DCP may deduplicate quick successive mutations of the
+// document, which is why it holds the latest events rather than only the last
+// one; consumers skip the events they have already seen by eventId.
+//
+// Transactions do not support sub-document mutations, and a read-modify-replace
+// within them makes every write of an item conflict on its outbox document, so
+// the append is a sub-document mutation outside the transaction. It is not
+// atomic with the writes of the item: the event stays in the document when the
+// transaction aborts afterwards, and a retried attempt appends it again. The
+// retry carries the same eventId, which the consumers skip.
+func (o *CouchbaseOutbox) appendAggregate(event outbox.Event, doc interface{}) error {
+	_, err := o.opts.Collection.MutateIn(event.AggregateID, []gocb.MutateInSpec{
+		gocb.UpsertSpec("aggregateType", event.AggregateType, nil),
+		gocb.UpsertSpec("aggregateId", event.AggregateID, nil),
+		gocb.ArrayAppendSpec("events", doc, &gocb.ArrayAppendSpecOptions{CreatePath: true}),
+	}, &gocb.MutateInOptions{StoreSemantic: gocb.StoreSemanticsUpsert})
+	if err != nil {
+		return err
+	}
+
+	return o.trimAggregate(event.AggregateID)
+}
+
+// trimAggregate removes the oldest events from the front of the outbox
+// document until it holds at most AggregateMaxEvents. The removal is guarded
+// by the cas of the count, so concurrent appends never lose a newer event.
+func (o *CouchbaseOutbox) trimAggregate(aggregateID string) error {
+	for {
+		result, err := o.opts.Collection.LookupIn(aggregateID, []gocb.LookupInSpec{
+			gocb.CountSpec("events", nil),
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		var count int
+		if err = result.ContentAt(0, &count); err != nil {
+			return err
+		}
+
+		overflow := aggregateOverflow(count, o.opts.AggregateMaxEvents)
+		if overflow == 0 {
+			return nil
+		}
+
+		specs := make([]gocb.MutateInSpec, 0, overflow)
+		for i := 0; i < overflow; i++ {
+			specs = append(specs, gocb.RemoveSpec("events[0]", nil))
+		}
+		_, err = o.opts.Collection.MutateIn(aggregateID, specs, &gocb.MutateInOptions{Cas: result.Cas()})
+		if err != nil && !errors.Is(err, gocb.ErrCasMismatch) {
+			return err
+		}
+	}
+}
+
+// maxMutateInSpecs is the most specs a sub-document mutation takes.
+const maxMutateInSpecs = 16
+
+// aggregateOverflow is how many of the oldest events a single trim of an
+// outbox document with count events removes.
+func aggregateOverflow(count int, maxEvents int) int {
+	overflow := count - maxEvents
+	if overflow < 0 {
+		return 0
+	}
+	if overflow > maxMutateInSpecs {
+		return maxMutateInSpecs
+	}
+	return overflow
+}
+
+// Events reads the outbox document of the aggregate in the aggregate mode and
+// queries the outbox collection in the event mode. The index of the query is
+// created on first use, the relay and the connector do not need it.
+func (o *CouchbaseOutbox) Events(aggregateType string, aggregateID string) ([]outbox.Event, error) {
+	var events []outbox.Event
+
+	if o.opts.Mode == OutboxModeAggregate {
+		result, err := o.opts.Collection.Get(aggregateID, nil)
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var raw json.RawMessage
+		if err = result.Content(&raw); err != nil {
+			return nil, err
+		}
+		if events, err = outbox.DecodeRecord(o.opts.Envelope, raw); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := o.ensureIndex(); err != nil {
+			return nil, err
+		}
+
+		statement := "SELECT RAW o FROM `" + o.opts.Collection.Name() + "` AS o WHERE o." + o.aggregateIDField + " = $id"
+		result, err := o.opts.Collection.Bucket().Scope(o.opts.Collection.ScopeName()).Query(statement, &gocb.QueryOptions{
+			NamedParameters: map[string]interface{}{"id": aggregateID},
+			ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+			Readonly:        true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for result.Next() {
+			var raw json.RawMessage
+			if err = result.Row(&raw); err != nil {
+				return nil, err
+			}
+			event, err := o.opts.Envelope.Unwrap(raw)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		if err = result.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	matching := events[:0]
+	for _, event := range events {
+		if event.AggregateType == aggregateType {
+			matching = append(matching, event)
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].Sequence < matching[j].Sequence
+	})
+
+	return matching, nil
+}
+
+func (o *CouchbaseOutbox) ensureIndex() error {
+	o.indexMu.Lock()
+	defer o.indexMu.Unlock()
+
+	if o.indexed {
+		return nil
+	}
+
+	statement := "CREATE INDEX `idx_outbox_aggregate_id_" + o.opts.Format + "` ON `" + o.opts.Collection.Name() + "`(" + o.aggregateIDField + ")"
+	_, err := o.opts.Collection.Bucket().Scope(o.opts.Collection.ScopeName()).Query(statement, nil)
+	if err != nil && !errors.Is(err, gocb.ErrIndexExists) {
+		return err
+	}
+
+	o.indexed = true
+	return nil
+}
@@ -0,0 +1,342 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocb/v2"
+)
+
+// MemoryItemRepository keeps the items in memory. Transactions run one at a
+// time, which gives them the atomicity and isolation of the Couchbase ones,
+// and every write gives the item a new CAS.
+type MemoryItemRepository struct {
+	// mu is held for writing by the running transaction, fn must not call the
+	// repository itself.
+	mu      sync.RWMutex
+	items   map[string]memoryItem
+	lastCas gocb.Cas
+}
+
+type memoryItem struct {
+	item Item
+	cas  gocb.Cas
+}
+
+func NewMemoryItemRepository() *MemoryItemRepository {
+	return &MemoryItemRepository{items: map[string]memoryItem{}}
+}
+
+func (r *MemoryItemRepository) Get(id string) (Item, gocb.Cas, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stored, found := r.items[id]
+	if !found {
+		return Item{}, 0, ErrNotFound
+	}
+	return stored.item, stored.cas, nil
+}
+
+// List filters and sorts the items the way the N1QL query of the Couchbase
+// repository does.
+func (r *MemoryItemRepository) List(query ItemQuery) ([]Item, error) {
+	if _, ok := itemSortFields[query.Sort]; !ok {
+		return nil, fmt.Errorf("unknown item sort %q", query.Sort)
+	}
+
+	r.mu.RLock()
+	items := make([]Item, 0, len(r.items))
+	for _, stored := range r.items {
+		items = append(items, stored.item)
+	}
+	r.mu.RUnlock()
+
+	order := 1
+	if query.Descending {
+		order = -1
+	}
+
+	selected := []Item{}
+	for _, item := range items {
+		if query.Active != nil && item.Active != *query.Active {
+			continue
+		}
+		if query.MinPrice != nil && item.Price < *query.MinPrice {
+			continue
+		}
+		if query.MaxPrice != nil && item.Price > *query.MaxPrice {
+			continue
+		}
+		if !strings.HasPrefix(item.Name, query.NamePrefix) {
+			continue
+		}
+		if query.After != nil {
+			comparison, err := compareToCursor(item, query.Sort, *query.After)
+			if err != nil {
+				return nil, err
+			}
+			if comparison*order <= 0 {
+				continue
+			}
+		}
+		selected = append(selected, item)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return compareItems(selected[i], selected[j], query.Sort)*order < 0
+	})
+	if len(selected) > query.Limit {
+		selected = selected[:query.Limit]
+	}
+
+	return selected, nil
+}
+
+// compareItems orders the items by the sort field and then by id.
+func compareItems(a Item, b Item, sort string) int {
+	var comparison int
+	switch sort {
+	case "name":
+		comparison = strings.Compare(a.Name, b.Name)
+	case "price":
+		comparison = compareFloats(a.Price, b.Price)
+	default:
+		comparison = compareTimes(a.OccurrenceTime, b.OccurrenceTime)
+	}
+
+	if comparison != 0 {
+		return comparison
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// compareToCursor compares the item with the position of the cursor, whose
+// value is in JSON form.
+func compareToCursor(item Item, sort string, cursor ItemCursor) (int, error) {
+	var comparison int
+	switch value := cursor.Value.(type) {
+	case string:
+		switch sort {
+		case "name":
+			comparison = strings.Compare(item.Name, value)
+		case "occurrenceTime":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return 0, fmt.Errorf("invalid cursor value %q: %w", value, err)
+			}
+			comparison = compareTimes(item.OccurrenceTime, t)
+		default:
+			return 0, fmt.Errorf("cursor value of %s must be a number", sort)
+		}
+	case float64:
+		if sort != "price" {
+			return 0, fmt.Errorf("cursor value of %s must be a string", sort)
+		}
+		comparison = compareFloats(item.Price, value)
+	default:
+		return 0, fmt.Errorf("invalid cursor value %v", cursor.Value)
+	}
+
+	if comparison != 0 {
+		return comparison, nil
+	}
+	return strings.Compare(item.ID, cursor.ID), nil
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareTimes(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// MutationToken returns nil, the memory repository is always consistent,
+// including for removed items.
+func (r *MemoryItemRepository) MutationToken(id string) (*gocb.MutationToken, error) {
+	return nil, nil
+}
+
+// Transact stages the writes of fn and applies them together with the
+// appended events once fn returned without an error.
+func (r *MemoryItemRepository) Transact(fn func(tx Tx) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := &memoryTx{repository: r, staged: map[string]*Item{}}
+	if err := fn(tx); err != nil {
+		return fmt.Errorf("transaction failed: %w", err)
+	}
+
+	for id, item := range tx.staged {
+		if item == nil {
+			delete(r.items, id)
+			continue
+		}
+		r.lastCas++
+		r.items[id] = memoryItem{item: *item, cas: r.lastCas}
+	}
+	for _, appended := range tx.appended {
+		appended.outbox.commit(appended.document)
+	}
+
+	return nil
+}
+
+// memoryTx overlays the staged writes, nil for a removed item, on the
+// committed items.
+type memoryTx struct {
+	repository *MemoryItemRepository
+	staged     map[string]*Item
+	appended   []memoryAppend
+}
+
+type memoryAppend struct {
+	outbox   *MemoryOutbox
+	document json.RawMessage
+}
+
+func (tx *memoryTx) visible(id string) (Item, bool) {
+	if item, staged := tx.staged[id]; staged {
+		if item == nil {
+			return Item{}, false
+		}
+		return *item, true
+	}
+
+	stored, found := tx.repository.items[id]
+	return stored.item, found
+}
+
+func (tx *memoryTx) Get(id string) (Item, error) {
+	item, found := tx.visible(id)
+	if !found {
+		return item, ErrNotFound
+	}
+	return item, nil
+}
+
+func (tx *memoryTx) Insert(item Item) error {
+	if _, found := tx.visible(item.ID); found {
+		return ErrExists
+	}
+	tx.staged[item.ID] = &item
+	return nil
+}
+
+func (tx *memoryTx) Replace(item Item) error {
+	if _, found := tx.visible(item.ID); !found {
+		return ErrNotFound
+	}
+	tx.staged[item.ID] = &item
+	return nil
+}
+
+func (tx *memoryTx) Remove(id string) error {
+	if _, found := tx.visible(id); !found {
+		return ErrNotFound
+	}
+	tx.staged[id] = nil
+	return nil
+}
+
+// MemoryOutbox keeps the outbox documents of a MemoryItemRepository in commit
+// order. With a sink it also publishes them there as they are committed, one
+// JSON document per line, the way the relay publishes them to Kafka.
+type MemoryOutbox struct {
+	envelope outbox.Envelope
+	sink     io.Writer
+
+	mu             sync.Mutex
+	globalSequence uint64
+	documents      []json.RawMessage
+}
+
+// NewMemoryOutbox returns an outbox publishing to the sink, which may be nil.
+func NewMemoryOutbox(envelope outbox.Envelope, sink io.Writer) *MemoryOutbox {
+	return &MemoryOutbox{envelope: envelope, sink: sink}
+}
+
+// Append allocates the global sequence right away like the Couchbase outbox,
+// an aborted transaction leaves a gap.
+func (o *MemoryOutbox) Append(tx Tx, event outbox.Event) error {
+	memTx, ok := tx.(*memoryTx)
+	if !ok {
+		return fmt.Errorf("the memory outbox only takes part in memory transactions")
+	}
+
+	o.mu.Lock()
+	o.globalSequence++
+	event.GlobalSequence = o.globalSequence
+	o.mu.Unlock()
+
+	doc, err := o.envelope.Wrap(event)
+	if err != nil {
+		return err
+	}
+	document, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	memTx.appended = append(memTx.appended, memoryAppend{outbox: o, document: document})
+	return nil
+}
+
+func (o *MemoryOutbox) commit(document json.RawMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.documents = append(o.documents, document)
+	if o.sink == nil {
+		return
+	}
+	if _, err := o.sink.Write(append(document, '\n')); err != nil {
+		log.Printf("could not publish outbox document: %s", err)
+	}
+}
+
+func (o *MemoryOutbox) Events(aggregateType string, aggregateID string) ([]outbox.Event, error) {
+	o.mu.Lock()
+	documents := make([]json.RawMessage, len(o.documents))
+	copy(documents, o.documents)
+	o.mu.Unlock()
+
+	var events []outbox.Event
+	for _, document := range documents {
+		event, err := o.envelope.Unwrap(document)
+		if err != nil {
+			return nil, err
+		}
+		if event.AggregateType == aggregateType && event.AggregateID == aggregateID {
+			events = append(events, event)
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Sequence < events[j].Sequence
+	})
+	return events, nil
+}
@@ -0,0 +1,109 @@
+// Package repository keeps the items and writes their outbox events, either
+// in Couchbase or in memory, behind the same transactional interfaces.
+package repository
+
+import (
+	"encoding/json"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"github.com/couchbase/gocb/v2"
+)
+
+const (
+	// OutboxModeEvent writes every event to its own outbox document.
+	OutboxModeEvent = "event"
+	// OutboxModeAggregate appends all events of an aggregate to one outbox
+	// document keyed by the aggregate id.
+	OutboxModeAggregate = "aggregate"
+)
+
+// Both implementations fail with the gocb errors, so callers handle them
+// alike whichever they run with.
+var (
+	ErrNotFound    = gocb.ErrDocumentNotFound
+	ErrExists      = gocb.ErrDocumentExists
+	ErrCasMismatch = gocb.ErrCasMismatch
+)
+
+// Item is the document stored in the item collection.
+type Item struct {
+	ID             string    `json:"id"`
+	Version        int       `json:"version"`
+	Sequence       int64     `json:"sequence"`
+	Name           string    `json:"name"`
+	Price          float64   `json:"price"`
+	Description    string    `json:"description"`
+	Active         bool      `json:"active"`
+	OccurrenceTime time.Time `json:"occurrenceTime"`
+}
+
+// MarshalJSON renders the occurrence time in the fixed width layout of
+// outbox.FormatTime, so the stored times sort chronologically as strings,
+// which the N1QL ordering and cursors of List rely on.
+func (i Item) MarshalJSON() ([]byte, error) {
+	type item Item
+	return json.Marshal(struct {
+		item
+		OccurrenceTime string `json:"occurrenceTime"`
+	}{item(i), outbox.FormatTime(i.OccurrenceTime)})
+}
+
+// ItemQuery selects one page of items. Sort is one of name, price and
+// occurrenceTime, ties are broken by id in the same order.
+type ItemQuery struct {
+	Sort       string
+	Descending bool
+	Limit      int
+	Active     *bool
+	MinPrice   *float64
+	MaxPrice   *float64
+	NamePrefix string
+	// After continues the listing behind the item it points at.
+	After *ItemCursor
+	// ConsistentWith makes the query wait for the indexes to catch up with
+	// these mutations.
+	ConsistentWith *gocb.MutationState
+}
+
+// ItemCursor is the position of an item in the sort order of a query, Value
+// is its value of the sort field in JSON form.
+type ItemCursor struct {
+	Value interface{}
+	ID    string
+}
+
+// ItemRepository reads the items and runs the transactions that change them.
+type ItemRepository interface {
+	// Get returns the item along with its CAS, which changes with every write.
+	Get(id string) (Item, gocb.Cas, error)
+	List(query ItemQuery) ([]Item, error)
+	// MutationToken returns a token covering the latest write of the item,
+	// its removal included, nil when the repository is always consistent.
+	MutationToken(id string) (*gocb.MutationToken, error)
+	// Transact runs fn in a transaction together with the outbox events it
+	// appends. Either all of its writes are committed or none, and an error
+	// returned by fn aborts the transaction and is returned wrapped. fn may
+	// run more than once.
+	Transact(fn func(tx Tx) error) error
+}
+
+// Tx changes items within a transaction. The transaction sees its own writes.
+type Tx interface {
+	Get(id string) (Item, error)
+	Insert(item Item) error
+	// Replace and Remove fail when the item does not exist, or has been
+	// changed by another transaction since this one read it.
+	Replace(item Item) error
+	Remove(id string) error
+}
+
+// Outbox writes the events of the items as part of the transactions of the
+// repository it was created with.
+type Outbox interface {
+	// Append allocates the global sequence of the event and writes it in tx.
+	Append(tx Tx, event outbox.Event) error
+	// Events returns the events of the aggregate in sequence order. In the
+	// aggregate outbox mode only the latest events are kept.
+	Events(aggregateType string, aggregateID string) ([]outbox.Event, error)
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestItemOccurrenceTimesSortAsStrings(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		base,
+		base.Add(100 * time.Millisecond),
+		base.Add(120 * time.Millisecond),
+		base.Add(time.Second),
+	}
+
+	var stored []string
+	for _, occurrenceTime := range times {
+		raw, err := json.Marshal(Item{ID: "1", OccurrenceTime: occurrenceTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var doc struct {
+			OccurrenceTime string `json:"occurrenceTime"`
+		}
+		if err = json.Unmarshal(raw, &doc); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, doc.OccurrenceTime)
+
+		var item Item
+		if err = json.Unmarshal(raw, &item); err != nil {
+			t.Fatal(err)
+		}
+		if !item.OccurrenceTime.Equal(occurrenceTime) || item.ID != "1" {
+			t.Fatalf("%s decoded to %+v", raw, item)
+		}
+	}
+
+	if !sort.StringsAreSorted(stored) {
+		t.Fatalf("stored occurrence times %v do not sort chronologically", stored)
+	}
+}
+
+func TestAggregateOverflow(t *testing.T) {
+	tests := []struct {
+		count, maxEvents int
+		expected         int
+	}{
+		{count: 2, maxEvents: 3, expected: 0},
+		{count: 3, maxEvents: 3, expected: 0},
+		{count: 4, maxEvents: 3, expected: 1},
+		{count: 103, maxEvents: 100, expected: 3},
+		{count: 100, maxEvents: 1, expected: maxMutateInSpecs},
+	}
+	for _, test := range tests {
+		if overflow := aggregateOverflow(test.count, test.maxEvents); overflow != test.expected {
+			t.Fatalf("overflow of %d events over %d is %d, expected %d", test.count, test.maxEvents, overflow, test.expected)
+		}
+	}
+}
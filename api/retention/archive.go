@@ -0,0 +1,66 @@
+// Package retention removes published events from the outbox collection.
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Archive writes outbox documents to a gzip compressed JSON lines file, one
+// {"id": ..., "document": ...} object per line.
+type Archive struct {
+	path    string
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+type archivedDocument struct {
+	ID       string          `json:"id"`
+	Document json.RawMessage `json:"document"`
+}
+
+// NewArchive creates a new archive file in dir named after the collection and
+// the current time, e.g. item_outbox_event-20220401T101500Z.jsonl.gz.
+func NewArchive(dir string, collectionName string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, collectionName+"-"+time.Now().UTC().Format("20060102T150405Z")+".jsonl.gz")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	return &Archive{path: path, file: file, gz: gz, encoder: json.NewEncoder(gz)}, nil
+}
+
+func (a *Archive) Path() string {
+	return a.path
+}
+
+func (a *Archive) Write(id string, document json.RawMessage) error {
+	return a.encoder.Encode(archivedDocument{ID: id, Document: document})
+}
+
+// Sync makes sure everything written so far is on disk, documents are only
+// removed after that.
+func (a *Archive) Sync() error {
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *Archive) Close() error {
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,329 @@
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/outbox"
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/relay"
+	"github.com/couchbase/gocb/v2"
+	"github.com/couchbase/gocbcore/v10"
+)
+
+const (
+	defaultBatchSize = 500
+	connectTimeout   = 10 * time.Second
+)
+
+// PurgeOptions configure Purge. BatchSize falls back to a default when zero.
+type PurgeOptions struct {
+	Collection *gocb.Collection
+	// Format is the envelope format of the outbox documents.
+	Format string
+	// Before is the occurrence time the events have to be older than. An
+	// aggregate document is as old as its latest event.
+	Before    time.Time
+	BatchSize int
+	// Checkpoints are the checkpoints of the DCP relay. A document counts as
+	// published when the checkpoint of its vBucket has passed the seqno of
+	// the document on its vBucket uuid, or when the polling relay marked it
+	// published.
+	Checkpoints relay.CheckpointStore
+	// Unpublished removes the documents whether they count as published or not.
+	Unpublished bool
+	// Archive, when set, receives the documents before they are removed.
+	Archive *Archive
+	// DryRun only counts and archives the documents that would be removed.
+	DryRun bool
+}
+
+// PurgeResult counts the documents old enough to be purged.
+type PurgeResult struct {
+	Removed int
+	// Unpublished were kept because they did not count as published.
+	Unpublished int
+	// Changed were kept because they changed while being purged.
+	Changed int
+}
+
+type purgeCandidate struct {
+	ID             string `json:"id"`
+	OccurrenceTime string `json:"occurrenceTime"`
+}
+
+type purgedDocument struct {
+	id       string
+	cas      gocb.Cas
+	document json.RawMessage
+}
+
+type purger struct {
+	opts        PurgeOptions
+	field       string
+	agent       *gocbcore.Agent
+	checkpoints map[uint16]relay.Checkpoint
+}
+
+// Purge removes the outbox documents older than opts.Before that have been
+// published, oldest first. The archive is synced to disk before the
+// documents of a batch are removed.
+func Purge(opts PurgeOptions) (PurgeResult, error) {
+	var result PurgeResult
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	field, err := outbox.OccurrenceTimeField(opts.Format)
+	if err != nil {
+		return result, err
+	}
+
+	if err = opts.Collection.Bucket().WaitUntilReady(connectTimeout, nil); err != nil {
+		return result, err
+	}
+	agent, err := opts.Collection.Bucket().Internal().IORouter()
+	if err != nil {
+		return result, err
+	}
+
+	p := &purger{
+		opts:        opts,
+		field:       field,
+		agent:       agent,
+		checkpoints: map[uint16]relay.Checkpoint{},
+	}
+	if err = p.ensureIndex(); err != nil {
+		return result, fmt.Errorf("could not create the outbox purge index: %w", err)
+	}
+
+	var after *purgeCandidate
+	for {
+		candidates, err := p.candidates(after)
+		if err != nil {
+			return result, err
+		}
+
+		var batch []purgedDocument
+		for _, candidate := range candidates {
+			doc, published, err := p.inspect(candidate.ID)
+			if errors.Is(err, gocb.ErrDocumentNotFound) {
+				continue
+			}
+			if err != nil {
+				return result, err
+			}
+			if !published && !opts.Unpublished {
+				result.Unpublished++
+				continue
+			}
+			batch = append(batch, doc)
+		}
+
+		if err = p.remove(batch, &result); err != nil {
+			return result, err
+		}
+
+		if len(candidates) < opts.BatchSize {
+			return result, nil
+		}
+		after = &candidates[len(candidates)-1]
+	}
+}
+
+// timeExpression is the occurrence time of the outbox documents, of the
+// documents of alias when not empty. Aggregate documents are as old as their
+// latest event.
+func (p *purger) timeExpression(alias string) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	return "IFMISSING(" + prefix + p.field + ", " + prefix + "`events`[-1]." + p.field + ")"
+}
+
+// ensureIndex provisions the index of the candidates query.
+func (p *purger) ensureIndex() error {
+	statement := "CREATE INDEX `idx_outbox_purge_" + p.opts.Format + "` ON `" + p.opts.Collection.Name() + "`(" + p.timeExpression("") + ")"
+
+	_, err := p.opts.Collection.Bucket().Scope(p.opts.Collection.ScopeName()).Query(statement, nil)
+	if errors.Is(err, gocb.ErrIndexExists) {
+		return nil
+	}
+	return err
+}
+
+// candidates returns the next page of documents older than the cutoff, after
+// the given one in occurrence time and id order.
+func (p *purger) candidates(after *purgeCandidate) ([]purgeCandidate, error) {
+	field := p.timeExpression("o")
+	conditions := []string{field + " < $before"}
+	params := map[string]interface{}{
+		"before": outbox.FormatTime(p.opts.Before),
+		"limit":  p.opts.BatchSize,
+	}
+	if after != nil {
+		conditions = append(conditions, "("+field+" > $afterTime OR ("+field+" = $afterTime AND META(o).id > $afterId))")
+		params["afterTime"] = after.OccurrenceTime
+		params["afterId"] = after.ID
+	}
+
+	statement := "SELECT META(o).id AS id, " + field + " AS occurrenceTime FROM `" + p.opts.Collection.Name() + "` AS o" +
+		" WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY " + field + ", META(o).id" +
+		" LIMIT $limit"
+
+	result, err := p.opts.Collection.Bucket().Scope(p.opts.Collection.ScopeName()).Query(statement, &gocb.QueryOptions{
+		NamedParameters: params,
+		Readonly:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []purgeCandidate
+	for result.Next() {
+		var candidate purgeCandidate
+		if err = result.Row(&candidate); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, result.Err()
+}
+
+// documentVersion is where a document lives in the history of its vBucket,
+// the $document virtual xattr holds both as hex strings.
+type documentVersion struct {
+	VbUUID string `json:"vbucket_uuid"`
+	SeqNo  string `json:"seqno"`
+}
+
+// passed tells whether the checkpoint has passed the document. A checkpoint
+// of another vBucket uuid may be on another branch of the history, where its
+// seqnos say nothing about the document.
+func (v documentVersion) passed(checkpoint relay.Checkpoint) (bool, error) {
+	vbUUID, err := strconv.ParseUint(strings.TrimPrefix(v.VbUUID, "0x"), 16, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid vBucket uuid %q", v.VbUUID)
+	}
+	seqNo, err := strconv.ParseUint(strings.TrimPrefix(v.SeqNo, "0x"), 16, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid seqno %q", v.SeqNo)
+	}
+	return checkpoint.VbUUID == vbUUID && checkpoint.SeqNo >= seqNo, nil
+}
+
+// inspect reads the document and decides whether it has been published.
+func (p *purger) inspect(id string) (purgedDocument, bool, error) {
+	result, err := p.opts.Collection.LookupIn(id, []gocb.LookupInSpec{
+		gocb.GetSpec("$document", &gocb.GetSpecOptions{IsXattr: true}),
+		gocb.GetSpec("", nil),
+	}, nil)
+	if err != nil {
+		return purgedDocument{}, false, err
+	}
+
+	doc := purgedDocument{id: id, cas: result.Cas()}
+	if err = result.ContentAt(1, &doc.document); err != nil {
+		return doc, false, err
+	}
+
+	var version documentVersion
+	if err = result.ContentAt(0, &version); err != nil {
+		return doc, false, err
+	}
+
+	if p.opts.Checkpoints != nil {
+		checkpoint, err := p.checkpoint(id)
+		if err != nil {
+			return doc, false, err
+		}
+		passed, err := version.passed(checkpoint)
+		if err != nil {
+			return doc, false, fmt.Errorf("document %s: %w", id, err)
+		}
+		if passed {
+			return doc, true, nil
+		}
+	}
+
+	// the publish mark is read on its own, a lookup may only touch one
+	// extended attribute besides the virtual ones.
+	marked, err := p.opts.Collection.LookupIn(id, []gocb.LookupInSpec{
+		gocb.ExistsSpec(relay.PublishedAtXattr, &gocb.ExistsSpecOptions{IsXattr: true}),
+	}, nil)
+	if err != nil {
+		return doc, false, err
+	}
+
+	return doc, marked.Exists(0), nil
+}
+
+// checkpoint returns the relay checkpoint of the vBucket the document lives
+// in. Checkpoints are loaded once per purge, a stale one only keeps more.
+func (p *purger) checkpoint(id string) (relay.Checkpoint, error) {
+	snapshot, err := p.agent.ConfigSnapshot()
+	if err != nil {
+		return relay.Checkpoint{}, err
+	}
+	vbID, err := snapshot.KeyToVbucket([]byte(id))
+	if err != nil {
+		return relay.Checkpoint{}, err
+	}
+
+	if checkpoint, loaded := p.checkpoints[vbID]; loaded {
+		return checkpoint, nil
+	}
+
+	checkpoint, _, err := p.opts.Checkpoints.Load(vbID)
+	if err != nil {
+		return checkpoint, err
+	}
+	p.checkpoints[vbID] = checkpoint
+	return checkpoint, nil
+}
+
+// remove archives the documents and then removes them unless they changed
+// since they were inspected.
+func (p *purger) remove(batch []purgedDocument, result *PurgeResult) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if p.opts.Archive != nil {
+		for _, doc := range batch {
+			if err := p.opts.Archive.Write(doc.id, doc.document); err != nil {
+				return err
+			}
+		}
+		if err := p.opts.Archive.Sync(); err != nil {
+			return err
+		}
+	}
+
+	for _, doc := range batch {
+		if p.opts.DryRun {
+			result.Removed++
+			continue
+		}
+
+		_, err := p.opts.Collection.Remove(doc.id, &gocb.RemoveOptions{Cas: doc.cas})
+		switch {
+		case err == nil:
+			result.Removed++
+		case errors.Is(err, gocb.ErrCasMismatch):
+			result.Changed++
+		case errors.Is(err, gocb.ErrDocumentNotFound):
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package retention
+
+import (
+	"testing"
+
+	"erdaldalkiran.com/kafka-couchbase-connector-poc/relay"
+)
+
+func TestDocumentVersionPassed(t *testing.T) {
+	version := documentVersion{VbUUID: "0x00002a", SeqNo: "0x10"}
+
+	tests := []struct {
+		name       string
+		checkpoint relay.Checkpoint
+		passed     bool
+	}{
+		{"checkpoint past the document", relay.Checkpoint{VbUUID: 42, SeqNo: 17}, true},
+		{"checkpoint at the document", relay.Checkpoint{VbUUID: 42, SeqNo: 16}, true},
+		{"checkpoint before the document", relay.Checkpoint{VbUUID: 42, SeqNo: 15}, false},
+		{"checkpoint of another branch", relay.Checkpoint{VbUUID: 7, SeqNo: 100}, false},
+		{"no checkpoint", relay.Checkpoint{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			passed, err := version.passed(test.checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if passed != test.passed {
+				t.Fatalf("passed is %t, expected %t", passed, test.passed)
+			}
+		})
+	}
+
+	if _, err := (documentVersion{VbUUID: "uuid", SeqNo: "0x10"}).passed(relay.Checkpoint{}); err == nil {
+		t.Fatal("accepted an invalid vBucket uuid")
+	}
+}
+
+func TestTimeExpression(t *testing.T) {
+	p := &purger{field: "`time`"}
+
+	if expression := p.timeExpression(""); expression != "IFMISSING(`time`, `events`[-1].`time`)" {
+		t.Fatalf("expression is %s", expression)
+	}
+	if expression := p.timeExpression("o"); expression != "IFMISSING(o.`time`, o.`events`[-1].`time`)" {
+		t.Fatalf("aliased expression is %s", expression)
+	}
+}
@@ -1,5 +1,10 @@
 set -m
 
+# the password comes from the couchbase_password secret of docker compose
+if [ -n "$COUCHBASE_ADMINISTRATOR_PASSWORD_FILE" ]; then
+  COUCHBASE_ADMINISTRATOR_PASSWORD=$(cat "$COUCHBASE_ADMINISTRATOR_PASSWORD_FILE")
+fi
+
 /entrypoint.sh couchbase-server &
 
 sleep 15
@@ -40,7 +45,35 @@ sleep 15
 # Setup Collection
 couchbase-cli collection-manage -c 127.0.0.1:8091 --username $COUCHBASE_ADMINISTRATOR_USERNAME \
   --password $COUCHBASE_ADMINISTRATOR_PASSWORD --bucket $COUCHBASE_BUCKET \
-  --create-collection $COUCHBASE_SCOPE.$COUCHBASE_OUTBOX_COLLECTION
+  --create-collection $COUCHBASE_SCOPE.$COUCHBASE_OUTBOX_COLLECTION --max-ttl ${COUCHBASE_OUTBOX_MAX_TTL:-0}
+
+sleep 15
+
+# Setup Collection
+couchbase-cli collection-manage -c 127.0.0.1:8091 --username $COUCHBASE_ADMINISTRATOR_USERNAME \
+  --password $COUCHBASE_ADMINISTRATOR_PASSWORD --bucket $COUCHBASE_BUCKET \
+  --create-collection $COUCHBASE_SCOPE.$COUCHBASE_IDEMPOTENCY_COLLECTION
+
+sleep 15
+
+# Setup Collection
+couchbase-cli collection-manage -c 127.0.0.1:8091 --username $COUCHBASE_ADMINISTRATOR_USERNAME \
+  --password $COUCHBASE_ADMINISTRATOR_PASSWORD --bucket $COUCHBASE_BUCKET \
+  --create-collection $COUCHBASE_SCOPE.$COUCHBASE_COUNTER_COLLECTION
+
+sleep 15
+
+# Setup Collection
+couchbase-cli collection-manage -c 127.0.0.1:8091 --username $COUCHBASE_ADMINISTRATOR_USERNAME \
+  --password $COUCHBASE_ADMINISTRATOR_PASSWORD --bucket $COUCHBASE_BUCKET \
+  --create-collection $COUCHBASE_SCOPE.$COUCHBASE_CHECKPOINT_COLLECTION
+
+sleep 15
+
+# Setup Collection
+couchbase-cli collection-manage -c 127.0.0.1:8091 --username $COUCHBASE_ADMINISTRATOR_USERNAME \
+  --password $COUCHBASE_ADMINISTRATOR_PASSWORD --bucket $COUCHBASE_BUCKET \
+  --create-collection $COUCHBASE_SCOPE.$COUCHBASE_DLQ_COLLECTION
 
 sleep 15
 
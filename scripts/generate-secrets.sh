@@ -0,0 +1,17 @@
+#!/bin/bash
+
+# writes a random Couchbase administrator password to secrets/couchbase_password
+# and a random token of the relay admin endpoints to secrets/relay_admin_token,
+# docker compose hands them to the services as secret files.
+cd "$(dirname "$0")/.." || exit 1
+
+mkdir -p secrets
+for secret in couchbase_password relay_admin_token; do
+  if [ -s "secrets/$secret" ]; then
+    echo "secrets/$secret exists, keeping it"
+    continue
+  fi
+
+  (umask 077 && LC_ALL=C tr -dc 'A-Za-z0-9' < /dev/urandom | head -c 24 > "secrets/$secret")
+  echo "wrote a new secret to secrets/$secret"
+done
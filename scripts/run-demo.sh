@@ -1,13 +1,17 @@
 #!/bin/bash
 
-id=$(curl -s --location --request POST 'http://localhost:8080/create-item' | jq -r .id)
+id=$(curl -s --location --request POST 'http://localhost:8080/create-item' \
+--header 'Content-Type: application/json' \
+-d '{"name": "ciko", "price": 13.75, "description": "Lorem ipsum dolor sit amet, consectetur adipiscing elit.", "active": true}' | jq -r .id)
 echo "item created with id: $id"
 
 echo "updating item: $id"
 x=1
 while [ $x -le 5 ]
 do
-  curl -s --location --request POST "http://localhost:8080/update-item?id=$id" | jq .
+  curl -s --location --request POST "http://localhost:8080/update-item?id=$id" \
+  --header 'Content-Type: application/json' \
+  -d "{\"name\": \"ciko\", \"price\": $x.25, \"description\": \"Lorem ipsum dolor sit amet, consectetur adipiscing elit.\", \"active\": true}" | jq .
   echo ""
   x=$(( $x + 1 ))
 done